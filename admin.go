@@ -12,28 +12,45 @@ func (c *CubbyServer) FetchUser(name string, password string) User {
 		return &AnonymousUser{}
 	}
 
+	user := c.lookupUser(name)
+	if user == nil {
+		return &AnonymousUser{}
+	}
+
+	if user.PasswordMatches(password) {
+		c.log.Printf("Found valid user: %s", user)
+		return user
+	} else {
+		c.log.Printf("Invalid credentials specified for user with name: %s", name)
+		return &AnonymousUser{}
+	}
+}
+
+// lookupUser returns the named user without checking credentials, or nil if
+// there is no such user.
+func (c *CubbyServer) lookupUser(name string) *RegularUser {
 	var value []byte
+	var err error
 	c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(c.usersBucket))
-		value = b.Get([]byte(name))
+		value, err = c.unseal(b.Get([]byte(name)))
+		// the unsealed value may still point into the mmap'd db, so copy it
+		value = append([]byte{}, value...)
 		return nil
 	})
+	if err != nil {
+		c.log.Printf("Unable to decrypt user with name: %s. %v", name, err)
+		return nil
+	}
 
 	decoder := gob.NewDecoder(bytes.NewBuffer(value))
 	var user RegularUser
-	err := decoder.Decode(&user)
+	err = decoder.Decode(&user)
 	if err != nil {
 		c.log.Printf("Unable to find user with name: %s. %v", name, err)
-		return &AnonymousUser{}
-	}
-
-	if user.PasswordMatches(password) {
-		c.log.Printf("Found valid user: %s", user)
-		return &user
-	} else {
-		c.log.Printf("Invalid credentials specified for user with name: %s", name)
-		return &AnonymousUser{}
+		return nil
 	}
+	return &user
 }
 
 func (c *CubbyServer) ListUsers() []string {
@@ -64,9 +81,15 @@ func (c *CubbyServer) AddUser(name string, password string, isAdmin bool) error
 		return err
 	}
 
+	sealed, err := c.seal(buf.Bytes())
+	if err != nil {
+		c.log.Printf("Error encrypting new user: %s", name)
+		return err
+	}
+
 	err = c.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(c.usersBucket))
-		return b.Put([]byte(user.Name()), buf.Bytes())
+		return b.Put([]byte(user.Name()), sealed)
 	})
 
 	if err != nil {
@@ -80,7 +103,10 @@ func (c *CubbyServer) AddUser(name string, password string, isAdmin bool) error
 func (c *CubbyServer) RemoveUser(name string) error {
 	err := c.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(c.usersBucket))
-		return b.Delete([]byte(name))
+		if err := b.Delete([]byte(name)); err != nil {
+			return err
+		}
+		return c.revokeUserAccessKeys(name, tx)
 	})
 
 	if err != nil {
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	MAX_BATCH_OPS   = 1000
+	BASE64_ENCODING = "base64"
+)
+
+// BatchOp is a single operation of a batch. Values are plain strings unless
+// Encoding is "base64".
+//
+//	{"op": "get", "key": "k"}
+//	{"op": "put", "key": "k", "value": "v", "contentType": "text/plain", "readers": "user"}
+//	{"op": "delete", "key": "k"}
+//	{"op": "check", "key": "k", "etag": "\"...\""}   or   "exists": false
+type BatchOp struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Readers     string `json:"readers,omitempty"`
+	Writers     string `json:"writers,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	Exists      *bool  `json:"exists,omitempty"`
+}
+
+// BatchResult is the outcome of a single batch operation. Get results hold
+// the value, base64 encoded if it isn't valid UTF-8 or if requested.
+type BatchResult struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Found       bool   `json:"found"`
+	Value       string `json:"value,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+}
+
+// BatchError aborts a batch, rolling back every operation in it.
+type BatchError struct {
+	Index   int      `json:"index"`
+	Status  int      `json:"status"`
+	Message string   `json:"error"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch operation %d failed: %s", e.Index, e.Message)
+}
+
+func batchError(index, status int, format string, args ...any) *BatchError {
+	return &BatchError{Index: index, Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+func (op *BatchOp) decodeValue() ([]byte, error) {
+	switch op.Encoding {
+	case "":
+		return []byte(op.Value), nil
+	case BASE64_ENCODING:
+		return base64.StdEncoding.DecodeString(op.Value)
+	}
+	return nil, fmt.Errorf("unknown encoding: %s", op.Encoding)
+}
+
+// ExecuteBatch runs every operation in a single transaction. If any operation
+// fails, none of them take effect and a *BatchError is returned. The returned
+// events should be published once the batch has been committed.
+func (c *CubbyServer) ExecuteBatch(ops []BatchOp, user User, tx *bolt.Tx) ([]BatchResult, []*ChangeEvent, error) {
+	results := make([]BatchResult, 0, len(ops))
+	events := []*ChangeEvent{}
+	_, anonymous := user.(*AnonymousUser)
+
+	for i, op := range ops {
+		if op.Key == "" {
+			return nil, nil, batchError(i, http.StatusBadRequest, "key required")
+		}
+		metadata, err := c.GetMetadata(op.Key, tx)
+		if err != nil {
+			return nil, nil, err
+		}
+		result := BatchResult{Op: op.Op, Key: op.Key, Found: !metadata.Empty()}
+
+		switch op.Op {
+		case "get":
+			if metadata.Empty() {
+				break
+			}
+			// auth check: reader allowlist
+			if !user.InGroup(metadata.Readers) {
+				return nil, nil, batchError(i, http.StatusUnauthorized, "Unauthorized Reader")
+			}
+			data, err := c.Get(op.Key, tx)
+			if err != nil {
+				return nil, nil, err
+			}
+			result.ContentType = metadata.ContentType
+			result.ETag = ETag(data)
+			if op.Encoding == BASE64_ENCODING || !utf8.Valid(data) {
+				result.Value = base64.StdEncoding.EncodeToString(data)
+				result.Encoding = BASE64_ENCODING
+			} else {
+				result.Value = string(data)
+			}
+
+		case "check":
+			if !metadata.Empty() && !user.InGroup(metadata.Readers) {
+				return nil, nil, batchError(i, http.StatusUnauthorized, "Unauthorized Reader")
+			}
+			if op.Exists != nil && *op.Exists != result.Found {
+				return nil, nil, batchError(i, http.StatusPreconditionFailed, "existence check failed for %s", op.Key)
+			}
+			if op.ETag != "" {
+				data, err := c.Get(op.Key, tx)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !result.Found || ETag(data) != op.ETag {
+					return nil, nil, batchError(i, http.StatusPreconditionFailed, "ETag check failed for %s", op.Key)
+				}
+			}
+
+		case "put":
+			// auth check: disallow public writes, and writer allowlist
+			if anonymous || (!metadata.Empty() && !user.InGroup(metadata.Writers)) {
+				return nil, nil, batchError(i, http.StatusUnauthorized, "Unauthorized Writer")
+			}
+			value, err := op.decodeValue()
+			if err != nil {
+				return nil, nil, batchError(i, http.StatusBadRequest, "invalid value: %v", err)
+			}
+			if int64(len(value)) > c.maxObjectSize {
+				return nil, nil, batchError(i, http.StatusRequestEntityTooLarge, "value exceeds the maximum object size")
+			}
+
+			metadata.UpdateReaders(StringToGroup(op.Readers))
+			metadata.UpdateWriters(StringToGroup(op.Writers))
+			metadata.SetContentType(op.ContentType)
+			metadata.MarkUpdated()
+
+			event, err := c.CommitPut(op.Key, value, metadata, tx)
+			var schemaErr *SchemaError
+			if errors.As(err, &schemaErr) {
+				e := batchError(i, http.StatusUnprocessableEntity, "value does not match schema %s", schemaErr.Schema)
+				e.Errors = schemaErr.Errors
+				return nil, nil, e
+			} else if err != nil {
+				return nil, nil, err
+			}
+			events = append(events, event)
+			result.ContentType = metadata.ContentType
+			result.ETag = ETag(value)
+
+		case "delete":
+			// auth check: disallow public deletes, and writer allowlist
+			if anonymous || (!metadata.Empty() && !user.InGroup(metadata.Writers)) {
+				return nil, nil, batchError(i, http.StatusUnauthorized, "Unauthorized Writer")
+			}
+			event, err := c.CommitTrash(op.Key, metadata, user.Name(), tx)
+			if err != nil {
+				return nil, nil, err
+			}
+			if event != nil {
+				events = append(events, event)
+			}
+
+		default:
+			return nil, nil, batchError(i, http.StatusBadRequest, "unknown op: %q", op.Op)
+		}
+		results = append(results, result)
+	}
+	return results, events, nil
+}
+
+// BatchHandler executes a JSON list of operations atomically:
+//
+//	POST /_batch  [{"op": "put", ...}, {"op": "delete", ...}]
+//
+// On success, the list of results is returned. Otherwise nothing is changed,
+// and the index and reason of the failing operation are returned with its
+// status code.
+func (c *CubbyServer) BatchHandler(w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid batch action", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// base64 encoded values take up to 4/3 of their size, plus JSON overhead
+	var ops []BatchOp
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*c.maxObjectSize)).Decode(&ops)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Batch exceeds the %d byte limit", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "Invalid batch", http.StatusBadRequest)
+		return
+	}
+	if len(ops) == 0 || len(ops) > MAX_BATCH_OPS {
+		http.Error(w, fmt.Sprintf("Batch must contain between 1 and %d operations", MAX_BATCH_OPS), http.StatusBadRequest)
+		return
+	}
+
+	var results []BatchResult
+	var events []*ChangeEvent
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		results, events, err = c.ExecuteBatch(ops, user, tx)
+		return err
+	})
+
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		if batchErr.Status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		}
+		writeJSON(w, batchErr.Status, batchErr)
+		return
+	} else if err != nil {
+		log.Printf("Error executing batch: %v", err)
+		http.Error(w, "Could not execute batch", http.StatusInternalServerError)
+		return
+	}
+
+	for _, event := range events {
+		c.publish(event)
+	}
+	log.Printf("Executed batch of %d operations for %s", len(ops), user.Name())
+	writeJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchTooLarge(t *testing.T) {
+	c := newTestServer(t)
+	server := httptest.NewServer(http.HandlerFunc(c.Handler))
+	defer server.Close()
+	t.Setenv("CUBBY_USERNAME", "u")
+	t.Setenv("CUBBY_PASSWORD", "p")
+	client, err := NewCubbyClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each value is within the max object size, but together they aren't
+	value := strings.Repeat("x", int(c.maxObjectSize)*3/4)
+	_, err = client.Batch().Put("a", value, "").Put("b", value, "").Commit()
+	if !errors.Is(err, ErrBatchTooLarge) {
+		t.Errorf("oversized batch returned %v", err)
+	}
+
+	if _, err := client.Batch().Put("a", value, "").Commit(); err != nil {
+		t.Errorf("batch within the limit returned %v", err)
+	}
+}
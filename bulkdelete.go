@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// BULK_DELETE_LIMIT caps how many keys a single bulk delete removes, so that
+// one request can't hold the write transaction for too long. Callers repeat
+// the request while the result is truncated.
+const BULK_DELETE_LIMIT = 1000
+
+// BulkDeleteFilter selects keys to delete. Empty fields match everything, but
+// at least one of them must be set.
+type BulkDeleteFilter struct {
+	Prefix      string
+	OlderThan   time.Duration
+	ContentType string
+}
+
+func ParseBulkDeleteFilter(query url.Values) (*BulkDeleteFilter, error) {
+	filter := &BulkDeleteFilter{
+		Prefix:      query.Get("prefix"),
+		ContentType: query.Get("content-type"),
+	}
+	if olderThan := query.Get("older-than"); olderThan != "" {
+		var err error
+		filter.OlderThan, err = time.ParseDuration(olderThan)
+		if err != nil || filter.OlderThan <= 0 {
+			return nil, errors.New("Invalid older-than duration")
+		}
+	}
+	if filter.Prefix == "" && filter.OlderThan == 0 && filter.ContentType == "" {
+		return nil, errors.New("Bulk delete requires a prefix, older-than or content-type filter")
+	}
+	return filter, nil
+}
+
+func (f *BulkDeleteFilter) Matches(metadata *CubbyMetadata, now time.Time) bool {
+	if f.OlderThan > 0 && !metadata.UpdatedAt.Before(now.Add(-f.OlderThan)) {
+		return false
+	}
+	if f.ContentType != "" && mediaType(metadata.ContentType) != mediaType(f.ContentType) {
+		return false
+	}
+	return true
+}
+
+// BulkDeleteResult lists the keys that were (or in a dry run, would be)
+// deleted, and the matching keys that the user isn't allowed to delete.
+type BulkDeleteResult struct {
+	Deleted   []string `json:"deleted"`
+	Skipped   []string `json:"skipped"`
+	DryRun    bool     `json:"dryRun"`
+	Truncated bool     `json:"truncated"`
+}
+
+// BulkDelete moves up to BULK_DELETE_LIMIT keys matching the filter to the
+// trash, skipping keys the user can't write.
+func (c *CubbyServer) BulkDelete(filter *BulkDeleteFilter, user User, dryRun bool, tx *bolt.Tx) (*BulkDeleteResult, []*ChangeEvent, error) {
+	result := &BulkDeleteResult{Deleted: []string{}, Skipped: []string{}, DryRun: dryRun}
+	events := []*ChangeEvent{}
+	now := time.Now()
+
+	for _, key := range c.ListPrefix(filter.Prefix, tx) {
+		metadata, err := c.GetMetadata(key, tx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if metadata.Empty() || !filter.Matches(metadata, now) {
+			continue
+		}
+		// auth check: writer allowlist
+		if !user.InGroup(metadata.Writers) {
+			result.Skipped = append(result.Skipped, key)
+			continue
+		}
+		if len(result.Deleted) == BULK_DELETE_LIMIT {
+			result.Truncated = true
+			break
+		}
+
+		result.Deleted = append(result.Deleted, key)
+		if dryRun {
+			continue
+		}
+		event, err := c.CommitTrash(key, metadata, user.Name(), tx)
+		if err != nil {
+			return nil, nil, err
+		}
+		events = append(events, event)
+	}
+	return result, events, nil
+}
+
+// BulkDeleteHandler serves DELETE /?prefix=...&older-than=...&content-type=...
+// with an optional dry-run parameter to preview the keys that would be
+// deleted.
+func (c *CubbyServer) BulkDeleteHandler(w http.ResponseWriter, r *http.Request, user User) {
+	filter, err := ParseBulkDeleteFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, dryRun := r.URL.Query()["dry-run"]
+
+	// a dry run doesn't need to hold up writers
+	transaction := c.db.Update
+	if dryRun {
+		transaction = c.db.View
+	}
+
+	var result *BulkDeleteResult
+	var events []*ChangeEvent
+	err = transaction(func(tx *bolt.Tx) error {
+		var err error
+		result, events, err = c.BulkDelete(filter, user, dryRun, tx)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error bulk deleting: %v", err)
+		http.Error(w, "Could not delete keys", http.StatusInternalServerError)
+		return
+	}
+
+	for _, event := range events {
+		c.publish(event)
+	}
+	if !dryRun {
+		log.Printf("Bulk deleted %d keys for %s", len(result.Deleted), user.Name())
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	RESUMABLE_THRESHOLD = 4 << 20 // values larger than this are uploaded in chunks
+	UPLOAD_CHUNK_SIZE   = 1 << 20
+	UPLOAD_RETRIES      = 5
 )
 
 type CubbyClient struct {
@@ -14,6 +26,7 @@ type CubbyClient struct {
 	httpClient *http.Client
 	username   string
 	password   string
+	secret     []byte
 }
 
 func NewCubbyClient(serverAddr string) (*CubbyClient, error) {
@@ -28,6 +41,13 @@ func NewCubbyClient(serverAddr string) (*CubbyClient, error) {
 		httpClient: &http.Client{}}, nil
 }
 
+// EnableEncryption turns on end-to-end encryption using the given passphrase
+// (or key file contents). Values are encrypted before being sent to the
+// server, and encrypted values are decrypted transparently on Get.
+func (c *CubbyClient) EnableEncryption(secret []byte) {
+	c.secret = secret
+}
+
 func (c *CubbyClient) keyUrlString(key string) string {
 	return c.serverAddr.JoinPath(key).String()
 }
@@ -36,7 +56,7 @@ func (c *CubbyClient) validate(resp *http.Response, err error) (*http.Response,
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return nil, fmt.Errorf("request failed with status code %v", resp.StatusCode)
 	}
 	return resp, nil
@@ -52,10 +72,71 @@ func (c *CubbyClient) NewRequest(method, key string, body io.Reader) (*http.Requ
 }
 
 func (c *CubbyClient) Get(key string) (string, error) {
+	value, _, err := c.GetObject(key)
+	return value, err
+}
+
+// GetObject fetches the value stored at key along with its content type.
+// End-to-end encrypted values are decrypted, and their original content type
+// restored.
+func (c *CubbyClient) GetObject(key string) (string, string, error) {
+	request, err := c.NewRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := c.validate(c.httpClient.Do(request))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == ENCRYPTED_CONTENT_TYPE {
+		if c.secret == nil {
+			return "", "", ErrNoPassphrase
+		}
+		bodyBytes, contentType, err = decryptE2E(c.secret, bodyBytes)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return string(bodyBytes), contentType, nil
+}
+
+// Stat fetches the metadata, size and ETag of the value stored at key,
+// without downloading the value itself.
+func (c *CubbyClient) Stat(key string) (*KeyStat, error) {
+	request, err := c.NewRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.URL.RawQuery = "meta"
+	resp, err := c.validate(c.httpClient.Do(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var stat KeyStat
+	if err := json.NewDecoder(resp.Body).Decode(&stat); err != nil {
+		return nil, err
+	}
+	return &stat, nil
+}
+
+// GetPath fetches just the part of the JSON stored at key that the JSON path
+// selects (eg. $.a.b[0] or a.b.0).
+func (c *CubbyClient) GetPath(key, path string) (string, error) {
 	request, err := c.NewRequest(http.MethodGet, key, nil)
 	if err != nil {
 		return "", err
 	}
+	request.URL.RawQuery = url.Values{"path": {path}}.Encode()
 	resp, err := c.validate(c.httpClient.Do(request))
 	if err != nil {
 		return "", err
@@ -70,14 +151,212 @@ func (c *CubbyClient) Get(key string) (string, error) {
 }
 
 func (c *CubbyClient) Put(key, value string) error {
-	request, err := c.NewRequest(http.MethodPost, key, strings.NewReader(value))
+	return c.PutObject(key, value, "")
+}
+
+// PutObject stores value at key with the given content type (which may be
+// empty). If encryption is enabled, the value and content type are encrypted
+// before leaving the client.
+func (c *CubbyClient) PutObject(key, value, contentType string) error {
+	body := []byte(value)
+	if c.secret != nil {
+		var err error
+		body, err = encryptE2E(c.secret, body, contentType)
+		if err != nil {
+			return err
+		}
+		contentType = ENCRYPTED_CONTENT_TYPE
+	}
+
+	if len(body) > RESUMABLE_THRESHOLD {
+		err := c.resumablePut(key, body, contentType)
+		if !errors.Is(err, errUploadsUnsupported) {
+			return err
+		}
+		// older servers don't have /_uploads, so send it in one go
+	}
+
+	request, err := c.NewRequest(http.MethodPost, key, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
 	_, err = c.validate(c.httpClient.Do(request))
 	return err
 }
 
+var errUploadsUnsupported = errors.New("server does not support resumable uploads")
+
+// uploadRetryDelay is how much longer to wait after each failed chunk.
+var uploadRetryDelay = time.Second
+
+// resumablePut uploads a large value in chunks, resuming from wherever the
+// server got to if a chunk fails. It returns errUploadsUnsupported if the
+// server has no resumable uploads, before anything has been sent.
+func (c *CubbyClient) resumablePut(key string, body []byte, contentType string) error {
+	request, err := c.NewRequest(http.MethodPost, "_uploads", nil)
+	if err != nil {
+		return err
+	}
+	request.URL.RawQuery = url.Values{"key": {key}}.Encode()
+	request.Header.Set(UPLOAD_LENGTH_HEADER, strconv.Itoa(len(body)))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return errUploadsUnsupported
+	}
+	if _, err := c.validate(resp, nil); err != nil {
+		return err
+	}
+	upload := strings.TrimPrefix(resp.Header.Get("Location"), "/")
+
+	offset, failures, stale := 0, 0, false
+	for offset < len(body) {
+		var err error
+		if stale {
+			// the failed chunk may have been partly stored, so only resend
+			// once the server has said where it got to
+			var resumed int
+			if resumed, err = c.uploadOffset(upload); err == nil {
+				offset, stale = resumed, false
+			}
+		}
+		if !stale {
+			var retry bool
+			var sent int
+			sent, retry, err = c.sendChunk(upload, body[offset:min(offset+UPLOAD_CHUNK_SIZE, len(body))], offset)
+			if err == nil {
+				offset, failures = sent, 0
+				continue
+			}
+			if !retry {
+				return err
+			}
+			stale = true
+		}
+
+		failures++
+		if failures > UPLOAD_RETRIES {
+			return err
+		}
+		time.Sleep(time.Duration(failures) * uploadRetryDelay)
+	}
+	return nil
+}
+
+// sendChunk sends part of an upload starting at offset, returning the
+// server's new offset, or whether the failure is worth retrying.
+func (c *CubbyClient) sendChunk(upload string, chunk []byte, offset int) (int, bool, error) {
+	request, err := c.NewRequest(http.MethodPatch, upload, bytes.NewReader(chunk))
+	if err != nil {
+		return 0, false, err
+	}
+	request.Header.Set("Content-Type", UPLOAD_CHUNK_MEDIATYPE)
+	request.Header.Set(UPLOAD_OFFSET_HEADER, strconv.Itoa(offset))
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return 0, true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		sent, err := strconv.Atoi(resp.Header.Get(UPLOAD_OFFSET_HEADER))
+		return sent, false, err
+	}
+	// anything but a server error or an offset mismatch won't get better by
+	// retrying
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusConflict
+	return 0, retry, fmt.Errorf("request failed with status code %v", resp.StatusCode)
+}
+
+// uploadOffset asks the server how much of an upload it has received.
+func (c *CubbyClient) uploadOffset(upload string) (int, error) {
+	request, err := c.NewRequest(http.MethodHead, upload, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.validate(c.httpClient.Do(request))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return strconv.Atoi(resp.Header.Get(UPLOAD_OFFSET_HEADER))
+}
+
+// Increment atomically adds delta (which may be negative) to the integer
+// stored at key, returning the new value.
+func (c *CubbyClient) Increment(key string, delta int64) (int64, error) {
+	request, err := c.NewRequest(http.MethodPost, key, nil)
+	if err != nil {
+		return 0, err
+	}
+	request.URL.RawQuery = url.Values{"incr": {strconv.FormatInt(delta, 10)}}.Encode()
+	resp, err := c.validate(c.httpClient.Do(request))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(bodyBytes), 10, 64)
+}
+
+// CompareAndSwap replaces the value at key only if it currently equals
+// expected, returning whether the swap happened.
+func (c *CubbyClient) CompareAndSwap(key, expected, value, contentType string) (bool, error) {
+	request, err := c.NewRequest(http.MethodPost, key, strings.NewReader(value))
+	if err != nil {
+		return false, err
+	}
+	request.URL.RawQuery = url.Values{"cas": {expected}}.Encode()
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return false, nil
+	}
+	_, err = c.validate(resp, nil)
+	return err == nil, err
+}
+
+// Patch atomically applies a JSON merge patch (MERGE_PATCH_CONTENT_TYPE) or
+// JSON Patch (JSON_PATCH_CONTENT_TYPE) to the JSON stored at key, returning
+// the patched document.
+func (c *CubbyClient) Patch(key, patch, patchType string) (string, error) {
+	request, err := c.NewRequest(http.MethodPatch, key, strings.NewReader(patch))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", patchType)
+	resp, err := c.validate(c.httpClient.Do(request))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(bodyBytes), nil
+}
+
 func (c *CubbyClient) Remove(key string) error {
 	request, err := c.NewRequest(http.MethodDelete, key, nil)
 	if err != nil {
@@ -86,3 +365,329 @@ func (c *CubbyClient) Remove(key string) error {
 	_, err = c.validate(c.httpClient.Do(request))
 	return err
 }
+
+// Search returns up to limit keys matching the query, best matches first.
+func (c *CubbyClient) Search(query string, limit int) ([]SearchResult, error) {
+	request, err := c.NewRequest(http.MethodGet, "_search", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.URL.RawQuery = url.Values{"q": {query}, "limit": {strconv.Itoa(limit)}}.Encode()
+	resp, err := c.validate(c.httpClient.Do(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var results []SearchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ListKeys lists the keys under prefix that the user can read.
+func (c *CubbyClient) ListKeys(prefix string) ([]KeyListing, error) {
+	request, err := c.NewRequest(http.MethodGet, "_keys", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.URL.RawQuery = url.Values{"prefix": {prefix}}.Encode()
+	resp, err := c.validate(c.httpClient.Do(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var listings []KeyListing
+	if err := json.NewDecoder(resp.Body).Decode(&listings); err != nil {
+		return nil, err
+	}
+	return listings, nil
+}
+
+func (c *CubbyClient) copyRequest(method, src, dst string) error {
+	request, err := c.NewRequest(method, src, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set(DESTINATION_HEADER, c.keyUrlString(dst))
+	_, err = c.validate(c.httpClient.Do(request))
+	return err
+}
+
+// Copy copies the value at src, along with its metadata, to dst on the
+// server. If both end in a slash, every key under the src prefix is copied.
+func (c *CubbyClient) Copy(src, dst string) error {
+	return c.copyRequest(METHOD_COPY, src, dst)
+}
+
+// Move is like Copy, but removes src afterwards.
+func (c *CubbyClient) Move(src, dst string) error {
+	return c.copyRequest(METHOD_MOVE, src, dst)
+}
+
+// BulkDelete deletes up to BULK_DELETE_LIMIT keys matching the filter (or in
+// a dry run, lists them). If the result is truncated, more keys match.
+func (c *CubbyClient) BulkDelete(filter *BulkDeleteFilter, dryRun bool) (*BulkDeleteResult, error) {
+	request, err := c.NewRequest(http.MethodDelete, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if filter.Prefix != "" {
+		query.Set("prefix", filter.Prefix)
+	}
+	if filter.OlderThan > 0 {
+		query.Set("older-than", filter.OlderThan.String())
+	}
+	if filter.ContentType != "" {
+		query.Set("content-type", filter.ContentType)
+	}
+	if dryRun {
+		query.Set("dry-run", "")
+	}
+	request.URL.RawQuery = query.Encode()
+	resp, err := c.validate(c.httpClient.Do(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result BulkDeleteResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Undelete restores a deleted key from the trash.
+func (c *CubbyClient) Undelete(key string) error {
+	request, err := c.NewRequest(http.MethodPost, "_trash/"+key, nil)
+	if err != nil {
+		return err
+	}
+	request.URL.RawQuery = "restore"
+	_, err = c.validate(c.httpClient.Do(request))
+	return err
+}
+
+// WatchResult describes the outcome of a single long-poll watch request.
+type WatchResult struct {
+	Changed bool
+	Deleted bool
+	Value   string
+	ETag    string
+}
+
+// Watch blocks until the key changes relative to since (an ETag or a
+// timestamp, or empty to wait for the next change), or until the timeout
+// elapses, in which case the result is marked as unchanged.
+func (c *CubbyClient) Watch(key, since string, timeout time.Duration) (*WatchResult, error) {
+	request, err := c.NewRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("watch", "")
+	query.Set("timeout", timeout.String())
+	if since != "" {
+		query.Set("since", since)
+	}
+	request.URL.RawQuery = query.Encode()
+
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return &WatchResult{}, nil
+	case http.StatusNotFound:
+		return &WatchResult{Changed: true, Deleted: true}, nil
+	case http.StatusOK:
+		bodyBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &WatchResult{Changed: true, Value: string(bodyBytes), ETag: resp.Header.Get("ETag")}, nil
+	default:
+		return nil, fmt.Errorf("request failed with status code %v", resp.StatusCode)
+	}
+}
+
+func (c *CubbyClient) lockRequest(method, name string, query url.Values, token string) (*Lease, error) {
+	request, err := c.NewRequest(method, "_locks/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.URL.RawQuery = query.Encode()
+	if token != "" {
+		request.Header.Set(LOCK_TOKEN_HEADER, token)
+	}
+
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var lease Lease
+		if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+			return nil, err
+		}
+		return &lease, nil
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusConflict:
+		if _, renew := query["renew"]; method == http.MethodPost && !renew {
+			return nil, ErrLockHeld
+		}
+		return nil, ErrLockNotHeld
+	default:
+		return nil, fmt.Errorf("request failed with status code %v", resp.StatusCode)
+	}
+}
+
+// AcquireLock tries to take the named lock for ttl, returning ErrLockHeld if
+// somebody else holds it.
+func (c *CubbyClient) AcquireLock(name string, ttl time.Duration) (*Lease, error) {
+	return c.lockRequest(http.MethodPost, name, url.Values{"ttl": {ttl.String()}}, "")
+}
+
+// RenewLock extends a held lease, returning ErrLockNotHeld if it was lost.
+func (c *CubbyClient) RenewLock(lease *Lease, ttl time.Duration) (*Lease, error) {
+	return c.lockRequest(http.MethodPost, lease.Name, url.Values{"ttl": {ttl.String()}, "renew": {""}}, lease.Token)
+}
+
+func (c *CubbyClient) ReleaseLock(lease *Lease) error {
+	_, err := c.lockRequest(http.MethodDelete, lease.Name, url.Values{}, lease.Token)
+	return err
+}
+
+// ErrBatchTooLarge is returned when a batch is larger than the server accepts,
+// which is twice its max object size.
+var ErrBatchTooLarge = errors.New("batch is larger than the server accepts")
+
+// Batch collects operations to be executed atomically with Commit. If any
+// operation fails (eg. a check doesn't hold), none of them take effect.
+type Batch struct {
+	client *CubbyClient
+	ops    []BatchOp
+}
+
+func (c *CubbyClient) Batch() *Batch {
+	return &Batch{client: c}
+}
+
+func (b *Batch) Get(key string) *Batch {
+	b.ops = append(b.ops, BatchOp{Op: "get", Key: key})
+	return b
+}
+
+// Put stores value at key with the given content type (which may be empty),
+// encrypting it first if encryption is enabled.
+func (b *Batch) Put(key, value, contentType string) *Batch {
+	b.ops = append(b.ops, BatchOp{
+		Op:          "put",
+		Key:         key,
+		Value:       base64.StdEncoding.EncodeToString([]byte(value)),
+		Encoding:    BASE64_ENCODING,
+		ContentType: contentType,
+	})
+	return b
+}
+
+func (b *Batch) Delete(key string) *Batch {
+	b.ops = append(b.ops, BatchOp{Op: "delete", Key: key})
+	return b
+}
+
+// Check requires the value at key to have the given ETag.
+func (b *Batch) Check(key, etag string) *Batch {
+	b.ops = append(b.ops, BatchOp{Op: "check", Key: key, ETag: etag})
+	return b
+}
+
+// CheckExists requires key to exist (or not).
+func (b *Batch) CheckExists(key string, exists bool) *Batch {
+	b.ops = append(b.ops, BatchOp{Op: "check", Key: key, Exists: &exists})
+	return b
+}
+
+// Commit sends the batch, returning one result per operation. Get results are
+// decoded (and decrypted) so that Value always holds the raw value.
+func (b *Batch) Commit() ([]BatchResult, error) {
+	ops := make([]BatchOp, len(b.ops))
+	copy(ops, b.ops)
+	for i, op := range ops {
+		if op.Op != "put" || b.client.secret == nil {
+			continue
+		}
+		value, _ := op.decodeValue()
+		encrypted, err := encryptE2E(b.client.secret, value, op.ContentType)
+		if err != nil {
+			return nil, err
+		}
+		ops[i].Value = base64.StdEncoding.EncodeToString(encrypted)
+		ops[i].ContentType = ENCRYPTED_CONTENT_TYPE
+	}
+
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	request, err := b.client.NewRequest(http.MethodPost, "_batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return nil, fmt.Errorf("%w (%d bytes encoded)", ErrBatchTooLarge, len(body))
+	}
+	if resp.StatusCode != http.StatusOK {
+		var batchErr BatchError
+		if json.NewDecoder(resp.Body).Decode(&batchErr) != nil || batchErr.Message == "" {
+			return nil, fmt.Errorf("request failed with status code %v", resp.StatusCode)
+		}
+		batchErr.Status = resp.StatusCode
+		return nil, &batchErr
+	}
+
+	var results []BatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	for i, result := range results {
+		if result.Op != "get" || !result.Found {
+			continue
+		}
+		value := []byte(result.Value)
+		if result.Encoding == BASE64_ENCODING {
+			if value, err = base64.StdEncoding.DecodeString(result.Value); err != nil {
+				return nil, err
+			}
+		}
+		if result.ContentType == ENCRYPTED_CONTENT_TYPE {
+			if b.client.secret == nil {
+				return nil, ErrNoPassphrase
+			}
+			if value, results[i].ContentType, err = decryptE2E(b.client.secret, value); err != nil {
+				return nil, err
+			}
+		}
+		results[i].Value = string(value)
+		results[i].Encoding = ""
+	}
+	return results, nil
+}
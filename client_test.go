@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient runs the server behind handler, which can wrap the server's
+// own handler, and returns a client for it as user u.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *CubbyClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	t.Setenv("CUBBY_USERNAME", "u")
+	t.Setenv("CUBBY_PASSWORD", "p")
+	client, err := NewCubbyClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestPutObjectWithoutResumableUploads(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusMethodNotAllowed} {
+		c := newTestServer(t)
+		c.maxObjectSize = 2 * RESUMABLE_THRESHOLD
+		client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/_uploads") {
+				http.Error(w, "Not here", status)
+				return
+			}
+			c.Handler(w, r)
+		})
+
+		value := strings.Repeat("x", RESUMABLE_THRESHOLD+1)
+		if err := client.PutObject("large", value, "text/plain"); err != nil {
+			t.Fatalf("PutObject with uploads returning %d: %v", status, err)
+		}
+		if got, err := client.Get("large"); err != nil || got != value {
+			t.Errorf("value after falling back to a POST has %d bytes, %v", len(got), err)
+		}
+	}
+}
+
+func TestResumablePutRetries(t *testing.T) {
+	uploadRetryDelay = time.Millisecond
+	t.Cleanup(func() { uploadRetryDelay = time.Second })
+
+	c := newTestServer(t)
+	c.maxObjectSize = 2 * RESUMABLE_THRESHOLD
+	var patches, failPatches, failHeads atomic.Int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPatch:
+			patches.Add(1)
+			if failPatches.Add(-1) >= 0 {
+				http.Error(w, "Try again", http.StatusServiceUnavailable)
+				return
+			}
+		case r.Method == http.MethodHead && failHeads.Add(-1) >= 0:
+			http.Error(w, "Try again", http.StatusServiceUnavailable)
+			return
+		}
+		c.Handler(w, r)
+	})
+	value := strings.Repeat("x", RESUMABLE_THRESHOLD+1)
+
+	// a failed chunk is resent once the server has reported its offset
+	failPatches.Store(1)
+	failHeads.Store(2)
+	if err := client.PutObject("flaky", value, ""); err != nil {
+		t.Fatalf("PutObject with a failed chunk: %v", err)
+	}
+	if got, err := client.Get("flaky"); err != nil || got != value {
+		t.Errorf("value after retrying has %d bytes, %v", len(got), err)
+	}
+
+	// if the offset never comes back, nothing is resent from a stale offset
+	patches.Store(0)
+	failPatches.Store(1)
+	failHeads.Store(UPLOAD_RETRIES + 1)
+	if err := client.PutObject("stuck", value, ""); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("PutObject without upload offsets returned %v", err)
+	}
+	if n := patches.Load(); n != 1 {
+		t.Errorf("sent %d chunks without knowing the upload offset, want 1", n)
+	}
+}
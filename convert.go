@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Structured formats that cubby can convert between.
+const (
+	JSON_FORMAT   = "json"
+	CSV_FORMAT    = "csv"
+	NDJSON_FORMAT = "ndjson"
+)
+
+// formatOf returns the convertible format of a content type, or an empty
+// string if it isn't one.
+func formatOf(contentType string) string {
+	switch mediaType(contentType) {
+	case "application/json":
+		return JSON_FORMAT
+	case "text/csv":
+		return CSV_FORMAT
+	case "application/x-ndjson", "application/jsonl":
+		return NDJSON_FORMAT
+	}
+	return ""
+}
+
+// canConvert returns true if values of type from can be converted to type to.
+func canConvert(from, to string) bool {
+	fromFormat, toFormat := formatOf(from), formatOf(to)
+	return fromFormat != "" && toFormat != "" && fromFormat != toFormat
+}
+
+// ConvertFormat converts data between JSON, CSV (with a header row, as an
+// array of objects) and line-delimited JSON.
+func ConvertFormat(data []byte, from, to string) ([]byte, error) {
+	records, err := decodeRecords(formatOf(from), data)
+	if err != nil {
+		return nil, err
+	}
+	return encodeRecords(formatOf(to), records)
+}
+
+// decodeRecords parses data into a list of records. A JSON document that
+// isn't an array is treated as a single record.
+func decodeRecords(format string, data []byte) ([]any, error) {
+	switch format {
+	case JSON_FORMAT:
+		doc, err := decodeJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		if records, ok := doc.([]any); ok {
+			return records, nil
+		}
+		return []any{doc}, nil
+
+	case NDJSON_FORMAT:
+		records := []any{}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			record, err := decodeJSON(scanner.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			records = append(records, record)
+		}
+		return records, scanner.Err()
+
+	case CSV_FORMAT:
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		records := []any{}
+		if len(rows) == 0 {
+			return records, nil
+		}
+		header := rows[0]
+		for _, row := range rows[1:] {
+			record := map[string]any{}
+			for i, column := range header {
+				if i < len(row) {
+					record[column] = row[i]
+				}
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+func encodeRecords(format string, records []any) ([]byte, error) {
+	switch format {
+	case JSON_FORMAT:
+		return encodeJSON(records)
+
+	case NDJSON_FORMAT:
+		var buf bytes.Buffer
+		for _, record := range records {
+			line, err := encodeJSON(record)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), nil
+
+	case CSV_FORMAT:
+		// columns are the union of all record keys, in order of first
+		// appearance (keys within a record are sorted, since JSON objects
+		// are unordered)
+		var columns []string
+		seen := map[string]bool{}
+		for _, record := range records {
+			object, ok := record.(map[string]any)
+			if !ok {
+				return nil, errors.New("CSV conversion requires an array of objects")
+			}
+			keys := make([]string, 0, len(object))
+			for k := range object {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if !seen[k] {
+					seen[k] = true
+					columns = append(columns, k)
+				}
+			}
+		}
+
+		var buf bytes.Buffer
+		writer := csv.NewWriter(&buf)
+		writer.Write(columns)
+		for _, record := range records {
+			object := record.(map[string]any)
+			row := make([]string, len(columns))
+			for i, column := range columns {
+				cell, err := csvCell(object[column])
+				if err != nil {
+					return nil, err
+				}
+				row[i] = cell
+			}
+			writer.Write(row)
+		}
+		writer.Flush()
+		return buf.Bytes(), writer.Error()
+	}
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+// csvCell renders a JSON value as a CSV cell, encoding nested values as JSON.
+func csvCell(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	default:
+		encoded, err := encodeJSON(v)
+		return string(encoded), err
+	}
+}
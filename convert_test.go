@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestConvertFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		from string
+		to   string
+		want string
+	}{
+		{"json to csv", `[{"b":1,"a":"x"},{"a":"y","c":true}]`, "application/json", "text/csv", "a,b,c\nx,1,\ny,,true\n"},
+		{"json object to csv", `{"a":1}`, "application/json", "text/csv", "a\n1\n"},
+		{"nested values to csv", `[{"a":{"b":[1,2]},"c":null}]`, "application/json", "text/csv", "a,c\n\"{\"\"b\"\":[1,2]}\",\n"},
+		{"csv to json", "a,b\nx,1\ny,2\n", "text/csv", "application/json", `[{"a":"x","b":"1"},{"a":"y","b":"2"}]`},
+		{"empty csv to json", "", "text/csv", "application/json", `[]`},
+		{"json to ndjson", `[{"a":1},2]`, "application/json", "application/x-ndjson", "{\"a\":1}\n2\n"},
+		{"ndjson to json", "{\"a\":1}\n\n{\"a\":2.50}\n", "application/jsonl", "application/json; charset=utf-8", `[{"a":1},{"a":2.50}]`},
+		{"csv to ndjson", "a\n<b>\n", "text/csv", "application/x-ndjson", "{\"a\":\"<b>\"}\n"},
+		{"quoted csv cells", "a,b\n\"x, y\",\"line\nbreak\"\n", "text/csv", "application/json", `[{"a":"x, y","b":"line\nbreak"}]`},
+		{"csv header only", "a,b\n", "text/csv", "application/json", `[]`},
+		{"csv without trailing newline", "a\n1", "text/csv", "application/json", `[{"a":"1"}]`},
+		{"json cells needing quotes", `[{"a":"x,y","b":"say \"hi\""}]`, "application/json", "text/csv", "a,b\n\"x,y\",\"say \"\"hi\"\"\"\n"},
+		{"empty json array to csv", `[]`, "application/json", "text/csv", "\n"},
+		{"large numbers kept exact", `[{"n":9007199254740993}]`, "application/json", "text/csv", "n\n9007199254740993\n"},
+		{"ndjson without trailing newline", "1\n2", "application/x-ndjson", "application/json", `[1,2]`},
+		{"json scalar to ndjson", `"x"`, "application/json", "application/x-ndjson", "\"x\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ConvertFormat([]byte(tt.data), tt.from, tt.to)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("ConvertFormat = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertFormatErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		from string
+		to   string
+	}{
+		{"invalid json", `[{"a":`, "application/json", "text/csv"},
+		{"non-object records", `[1,2]`, "application/json", "text/csv"},
+		{"invalid ndjson line", "{\"a\":1}\nnope\n", "application/x-ndjson", "application/json"},
+		{"ragged csv", "a,b\n1\n", "text/csv", "application/json"},
+		{"unterminated csv quote", "a\n\"x\n", "text/csv", "application/json"},
+		{"scalar to csv", `1`, "application/json", "text/csv"},
+		{"unsupported format", `{}`, "application/json", "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := ConvertFormat([]byte(tt.data), tt.from, tt.to); err == nil {
+				t.Errorf("ConvertFormat = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestCanConvert(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{"application/json", "text/csv", true},
+		{"text/csv; charset=utf-8", "application/x-ndjson", true},
+		{"application/jsonl", "application/json", true},
+		{"application/json", "application/json", false},
+		{"application/x-ndjson", "application/jsonl", false},
+		{"text/plain", "application/json", false},
+		{"application/json", "*/*", false},
+	}
+	for _, tt := range tests {
+		if got := canConvert(tt.from, tt.to); got != tt.want {
+			t.Errorf("canConvert(%q, %q) = %t, want %t", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	METHOD_COPY        = "COPY"
+	METHOD_MOVE        = "MOVE"
+	DESTINATION_HEADER = "Destination"
+	OVERWRITE_HEADER   = "Overwrite"
+)
+
+// CopyError aborts a copy or move, rolling back any keys already copied.
+type CopyError struct {
+	Status  int
+	Message string
+}
+
+func (e *CopyError) Error() string {
+	return e.Message
+}
+
+// CopyResult pairs a source key with the key it was copied or moved to.
+type CopyResult struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// destinationKey extracts the destination key from the Destination header,
+// which may be an absolute URL (as WebDAV clients send) or just a path.
+func destinationKey(r *http.Request) (string, error) {
+	destination := r.Header.Get(DESTINATION_HEADER)
+	if destination == "" {
+		return "", errors.New("Destination header required")
+	}
+	parsed, err := url.Parse(destination)
+	if err != nil {
+		return "", errors.New("Invalid Destination header")
+	}
+	key := strings.TrimPrefix(parsed.Path, "/")
+	if key == "" || strings.HasPrefix(key, "_") {
+		return "", errors.New("Invalid destination key")
+	}
+	return key, nil
+}
+
+// CopyKey copies the value and metadata (including its ACLs and update time)
+// at src to dst, deleting src afterwards if move is set. The user needs read
+// access to src, write access to dst, and for moves write access to src too.
+// It returns whether dst was newly created.
+func (c *CubbyServer) CopyKey(src, dst string, move, overwrite bool, user User, tx *bolt.Tx) (bool, []*ChangeEvent, error) {
+	metadata, err := c.GetMetadata(src, tx)
+	if err != nil {
+		return false, nil, err
+	}
+	if metadata.Empty() {
+		return false, nil, &CopyError{http.StatusNotFound, "Source key not found: " + src}
+	}
+	// auth check: reader allowlist on the source
+	if !user.InGroup(metadata.Readers) {
+		return false, nil, &CopyError{http.StatusUnauthorized, "Unauthorized Reader"}
+	}
+	// auth check: writer allowlist on the source, since moves delete it
+	if move && !user.InGroup(metadata.Writers) {
+		return false, nil, &CopyError{http.StatusUnauthorized, "Unauthorized Writer"}
+	}
+
+	existing, err := c.GetMetadata(dst, tx)
+	if err != nil {
+		return false, nil, err
+	}
+	created := existing.Empty()
+	if !created {
+		if !overwrite {
+			return false, nil, &CopyError{http.StatusPreconditionFailed, "Destination exists: " + dst}
+		}
+		// auth check: writer allowlist on the destination
+		if !user.InGroup(existing.Writers) {
+			return false, nil, &CopyError{http.StatusUnauthorized, "Unauthorized Overwrite"}
+		}
+		// the overwritten value can be restored like a deleted one
+		if err := c.keepInTrash(dst, existing, user.Name(), tx); err != nil {
+			return false, nil, err
+		}
+	}
+
+	value, err := c.Get(src, tx)
+	if err != nil {
+		return false, nil, err
+	}
+	copied := *metadata
+	putEvent, err := c.CommitPut(dst, value, &copied, tx)
+	if err != nil {
+		return false, nil, err
+	}
+	events := []*ChangeEvent{putEvent}
+
+	if move {
+		deleteEvent, err := c.CommitDelete(src, metadata, tx)
+		if err != nil {
+			return false, nil, err
+		}
+		events = append(events, deleteEvent)
+	}
+	return created, events, nil
+}
+
+// CopyHandler serves the WebDAV style COPY and MOVE methods, eg.
+//
+//	MOVE /drafts/post.md  Destination: /posts/post.md
+//
+// Keys ending in a slash copy or move every key under that prefix, all or
+// nothing. Existing destinations are overwritten unless the request has an
+// "Overwrite: F" header, in which case a 412 is returned.
+func (c *CubbyServer) CopyHandler(w http.ResponseWriter, r *http.Request, key string, user User) {
+	// auth check: disallow public writes
+	if _, ok := user.(*AnonymousUser); ok {
+		log.Println("Unauthorized copy attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized Writer", http.StatusUnauthorized)
+		return
+	}
+
+	move := r.Method == METHOD_MOVE
+	overwrite := !strings.EqualFold(r.Header.Get(OVERWRITE_HEADER), "F")
+	dst, err := destinationKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefix := strings.HasSuffix(key, "/")
+	if key == "" || prefix != strings.HasSuffix(dst, "/") {
+		http.Error(w, "Source and destination must both be keys or both be prefixes (ending in /)", http.StatusBadRequest)
+		return
+	}
+	if key == dst || (prefix && strings.HasPrefix(dst, key)) {
+		http.Error(w, "Destination overlaps with the source", http.StatusForbidden)
+		return
+	}
+
+	var created bool
+	var results []CopyResult
+	var events []*ChangeEvent
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		if !prefix {
+			var err error
+			created, events, err = c.CopyKey(key, dst, move, overwrite, user, tx)
+			return err
+		}
+
+		results = []CopyResult{}
+		for _, src := range c.ListPrefix(key, tx) {
+			target := dst + strings.TrimPrefix(src, key)
+			_, keyEvents, err := c.CopyKey(src, target, move, overwrite, user, tx)
+			if err != nil {
+				return err
+			}
+			events = append(events, keyEvents...)
+			results = append(results, CopyResult{From: src, To: target})
+		}
+		if len(results) == 0 {
+			return &CopyError{http.StatusNotFound, "No keys found under prefix: " + key}
+		}
+		return nil
+	})
+
+	var copyErr *CopyError
+	if errors.As(err, &copyErr) {
+		if copyErr.Status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		}
+		http.Error(w, copyErr.Message, copyErr.Status)
+		return
+	} else if writeSchemaError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Error copying %s to %s: %v", key, dst, err)
+		http.Error(w, "Could not copy data", http.StatusInternalServerError)
+		return
+	}
+
+	for _, event := range events {
+		c.publish(event)
+	}
+	log.Printf("%s %s to %s", r.Method, key, dst)
+
+	if prefix {
+		writeJSON(w, http.StatusOK, results)
+	} else if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCopyOverwriteKeepsDestinationInTrash(t *testing.T) {
+	c := newTestServer(t)
+	serve(c, http.MethodPut, "/src", []byte("new"))
+	serve(c, http.MethodPut, "/dst", []byte("old"))
+
+	for _, method := range []string{METHOD_COPY, METHOD_MOVE} {
+		w := serveWithHeaders(c, method, "/src", http.Header{DESTINATION_HEADER: {"/dst"}}, nil)
+		if w.Code != http.StatusNoContent && w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d %s", method, w.Code, w.Body)
+		}
+		// free the destination again, so that it can be restored
+		serveWithHeaders(c, METHOD_MOVE, "/dst", http.Header{DESTINATION_HEADER: {"/moved-" + method}}, nil)
+		if w := serve(c, http.MethodPost, "/_trash/dst?restore", nil); w.Code != http.StatusOK {
+			t.Fatalf("restoring after %s returned %d %s", method, w.Code, w.Body)
+		}
+		if w := serve(c, http.MethodGet, "/dst", nil); w.Body.String() != "old" {
+			t.Errorf("restored value after %s = %q", method, w.Body)
+		}
+		serve(c, http.MethodPut, "/src", []byte("new"))
+	}
+}
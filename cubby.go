@@ -1,12 +1,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -20,6 +28,9 @@ func main() {
 	servePort := serveCmd.Int("port", 8383, "port to serve on")
 	serveFile := serveCmd.String("path", "cubby.db", "filepath to store cubby data at")
 	serveMaxSize := serveCmd.Int("max", 10, "max cubby object size in MB")
+	serveKeyFile := serveCmd.String("keyfile", "", "file containing the master encryption key (defaults to $"+MASTER_KEY_ENV+")")
+	serveRetention := serveCmd.Duration("retention", DEFAULT_TRASH_RETENTION, "how long deleted values are kept in the trash (0 disables the trash)")
+	serveS3Port := serveCmd.Int("s3port", 0, "port to serve the S3 compatible API on (0 disables it)")
 
 	listUserCmd := flag.NewFlagSet("listusers", flag.ExitOnError)
 	listUserDbFile := listUserCmd.String("path", "cubby.db", "filepath where cubby data is stored")
@@ -34,19 +45,88 @@ func main() {
 	removeUserDbFile := removeUserCmd.String("path", "cubby.db", "filepath where cubby data is stored")
 	removeUserName := removeUserCmd.String("name", "", "username to remove")
 
+	accessKeyCmd := flag.NewFlagSet("accesskey", flag.ExitOnError)
+	accessKeyDbFile := accessKeyCmd.String("path", "cubby.db", "filepath where cubby data is stored")
+	accessKeyName := accessKeyCmd.String("name", "", "username to create an S3 access key for (or to list the keys of)")
+	accessKeyList := accessKeyCmd.Bool("list", false, "list access keys instead of creating one")
+	accessKeyRevoke := accessKeyCmd.String("revoke", "", "access key ID to revoke")
+
+	rekeyCmd := flag.NewFlagSet("rekey", flag.ExitOnError)
+	rekeyDbFile := rekeyCmd.String("path", "cubby.db", "filepath where cubby data is stored")
+	rekeyKeyFile := rekeyCmd.String("keyfile", "", "file containing the current master encryption key (defaults to $"+MASTER_KEY_ENV+")")
+	rekeyNewKeyFile := rekeyCmd.String("newkeyfile", "", "file containing the new master encryption key")
+
 	getCmd := flag.NewFlagSet("get", flag.ExitOnError)
 	getAddr := getCmd.String("addr", DEFAULT_ADDR, "cubby server address")
 	getKey := getCmd.String("key", "", "key to get")
+	getPath := getCmd.String("path", "", "JSON path selecting part of a JSON value (eg. $.a.b[0] or a.b.0)")
+	getKeyFile := getCmd.String("keyfile", "", "file containing the end-to-end decryption secret (defaults to $"+PASSPHRASE_ENV+")")
+
+	statCmd := flag.NewFlagSet("stat", flag.ExitOnError)
+	statAddr := statCmd.String("addr", DEFAULT_ADDR, "cubby server address")
+	statKey := statCmd.String("key", "", "key to describe")
 
 	putCmd := flag.NewFlagSet("put", flag.ExitOnError)
 	putAddr := putCmd.String("addr", DEFAULT_ADDR, "cubby server address")
 	putKey := putCmd.String("key", "", "key to put")
 	putValue := putCmd.String("value", "", "value to put")
+	putFile := putCmd.String("file", "", "file to upload as the value (large files are uploaded resumably)")
+	putContentType := putCmd.String("type", "", "content type of the value")
+	putEncrypt := putCmd.Bool("encrypt", false, "encrypt the value client side before uploading")
+	putKeyFile := putCmd.String("keyfile", "", "file containing the end-to-end encryption secret (defaults to $"+PASSPHRASE_ENV+")")
+	putIncr := putCmd.Int64("incr", 0, "atomically increment the integer value by this amount")
+	putDecr := putCmd.Int64("decr", 0, "atomically decrement the integer value by this amount")
+	putCas := putCmd.String("cas", "", "only put the value if the current value equals this")
+
+	watchCmd := flag.NewFlagSet("watch", flag.ExitOnError)
+	watchAddr := watchCmd.String("addr", DEFAULT_ADDR, "cubby server address")
+	watchKey := watchCmd.String("key", "", "key to watch")
+	watchSince := watchCmd.String("since", "", "ETag or timestamp to watch for changes from (defaults to now)")
+	watchTimeout := watchCmd.Duration("timeout", DEFAULT_WATCH_TIMEOUT, "how long each poll waits for a change")
+	watchExec := watchCmd.String("exec", "", "shell command to run on each change (receives the new value on stdin)")
+
+	searchCmd := flag.NewFlagSet("search", flag.ExitOnError)
+	searchAddr := searchCmd.String("addr", DEFAULT_ADDR, "cubby server address")
+	searchQuery := searchCmd.String("q", "", "search query")
+	searchLimit := searchCmd.Int("limit", DEFAULT_SEARCH_LIMIT, "maximum number of results")
+
+	lockCmd := flag.NewFlagSet("lock", flag.ExitOnError)
+	lockAddr := lockCmd.String("addr", DEFAULT_ADDR, "cubby server address")
+	lockName := lockCmd.String("name", "", "name of the lock to hold while running the command (given after --)")
+	lockTTL := lockCmd.Duration("ttl", DEFAULT_LOCK_TTL, "lease duration, renewed while the command runs")
+	lockWait := lockCmd.Duration("wait", 0, "how long to wait for the lock if it is held")
+
+	cpCmd := flag.NewFlagSet("cp", flag.ExitOnError)
+	cpAddr := cpCmd.String("addr", DEFAULT_ADDR, "cubby server address")
+	cpFrom := cpCmd.String("from", "", "key (or prefix ending in /) to copy")
+	cpTo := cpCmd.String("to", "", "key (or prefix ending in /) to copy to")
+
+	mvCmd := flag.NewFlagSet("mv", flag.ExitOnError)
+	mvAddr := mvCmd.String("addr", DEFAULT_ADDR, "cubby server address")
+	mvFrom := mvCmd.String("from", "", "key (or prefix ending in /) to move")
+	mvTo := mvCmd.String("to", "", "key (or prefix ending in /) to move to")
 
 	removeCmd := flag.NewFlagSet("remove", flag.ExitOnError)
 	removeAddr := removeCmd.String("addr", DEFAULT_ADDR, "cubby server address")
 	removeKey := removeCmd.String("key", "", "key to remove")
 
+	rmCmd := flag.NewFlagSet("rm", flag.ExitOnError)
+	rmAddr := rmCmd.String("addr", DEFAULT_ADDR, "cubby server address")
+	rmPrefix := rmCmd.String("prefix", "", "delete keys starting with this prefix")
+	rmOlderThan := rmCmd.Duration("older-than", 0, "only delete keys last updated longer ago than this")
+	rmContentType := rmCmd.String("type", "", "only delete keys with this content type")
+	rmDryRun := rmCmd.Bool("dry-run", false, "list the keys that would be deleted without deleting them")
+
+	undeleteCmd := flag.NewFlagSet("undelete", flag.ExitOnError)
+	undeleteAddr := undeleteCmd.String("addr", DEFAULT_ADDR, "cubby server address")
+	undeleteKey := undeleteCmd.String("key", "", "deleted key to restore from the trash")
+
+	deployCmd := flag.NewFlagSet("deploy", flag.ExitOnError)
+	deployAddr := deployCmd.String("addr", DEFAULT_ADDR, "cubby server address")
+	deployDir := deployCmd.String("dir", "", "directory to upload")
+	deployPrefix := deployCmd.String("prefix", "", "key prefix (ending in /) to upload the directory to")
+	deployPrune := deployCmd.Bool("prune", false, "also delete keys under the prefix that aren't in the directory")
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 
@@ -62,18 +142,51 @@ func main() {
 		fmt.Fprint(os.Stderr, " removeuser:\n")
 		removeUserCmd.PrintDefaults()
 
+		fmt.Fprint(os.Stderr, " accesskey:\n")
+		accessKeyCmd.PrintDefaults()
+
+		fmt.Fprint(os.Stderr, " rekey:\n")
+		rekeyCmd.PrintDefaults()
+
 		fmt.Fprint(os.Stderr, " get:\n")
 		getCmd.PrintDefaults()
 
+		fmt.Fprint(os.Stderr, " stat:\n")
+		statCmd.PrintDefaults()
+
 		fmt.Fprint(os.Stderr, " put:\n")
 		putCmd.PrintDefaults()
 
+		fmt.Fprint(os.Stderr, " watch:\n")
+		watchCmd.PrintDefaults()
+
+		fmt.Fprint(os.Stderr, " search:\n")
+		searchCmd.PrintDefaults()
+
+		fmt.Fprint(os.Stderr, " lock:\n")
+		lockCmd.PrintDefaults()
+
+		fmt.Fprint(os.Stderr, " cp:\n")
+		cpCmd.PrintDefaults()
+
+		fmt.Fprint(os.Stderr, " mv:\n")
+		mvCmd.PrintDefaults()
+
 		fmt.Fprint(os.Stderr, " remove:\n")
 		removeCmd.PrintDefaults()
+
+		fmt.Fprint(os.Stderr, " rm:\n")
+		rmCmd.PrintDefaults()
+
+		fmt.Fprint(os.Stderr, " undelete:\n")
+		undeleteCmd.PrintDefaults()
+
+		fmt.Fprint(os.Stderr, " deploy:\n")
+		deployCmd.PrintDefaults()
 	}
 
 	if len(os.Args) < 2 {
-		fmt.Println("Please specify subcommand (serve, listusers, adduser, removeuser, get, put, remove)")
+		fmt.Println("Please specify subcommand (serve, listusers, adduser, removeuser, accesskey, rekey, get, stat, put, watch, search, lock, cp, mv, remove, rm, undelete, deploy)")
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -81,7 +194,7 @@ func main() {
 	switch os.Args[1] {
 	case "serve":
 		serveCmd.Parse(os.Args[2:])
-		startServer(*servePort, *serveFile, *serveMaxSize)
+		startServer(*servePort, *serveS3Port, *serveFile, *serveMaxSize, *serveKeyFile, *serveRetention)
 	case "listusers":
 		listUserCmd.Parse(os.Args[2:])
 		cubbyServer := adminServer(*listUserDbFile)
@@ -108,18 +221,150 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+	case "accesskey":
+		accessKeyCmd.Parse(os.Args[2:])
+		cubbyServer := adminServer(*accessKeyDbFile)
+		switch {
+		case *accessKeyRevoke != "":
+			if err := cubbyServer.RevokeAccessKey(*accessKeyRevoke); err != nil {
+				log.Fatal(err)
+			}
+		case *accessKeyList:
+			keys := cubbyServer.ListAccessKeys(*accessKeyName)
+			if len(keys) == 0 {
+				fmt.Println("No access keys found")
+			}
+			for _, key := range keys {
+				fmt.Printf("- %s (%s, created %s)\n", key.ID, key.Username, key.CreatedAt.Format(time.RFC3339))
+			}
+		default:
+			key, err := cubbyServer.CreateAccessKey(*accessKeyName)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Access key ID:     %s\n", key.ID)
+			fmt.Printf("Secret access key: %s\n", key.Secret)
+		}
+	case "rekey":
+		rekeyCmd.Parse(os.Args[2:])
+		if *rekeyNewKeyFile == "" {
+			log.Fatal("Please specify the new master key via -newkeyfile")
+		}
+		newKey, err := LoadMasterKey(*rekeyNewKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cubbyServer := adminServer(*rekeyDbFile)
+		currentKey, err := LoadMasterKey(*rekeyKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cubbyServer.SetMasterKey(currentKey)
+		if err := cubbyServer.Rekey(newKey); err != nil {
+			log.Fatal(err)
+		}
 	case "get":
 		getCmd.Parse(os.Args[2:])
 		client := initClient(*getAddr)
-		value, err := client.Get(*getKey)
+		secret, err := LoadClientSecret(*getKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client.EnableEncryption(secret)
+		var value string
+		if *getPath != "" {
+			value, err = client.GetPath(*getKey, *getPath)
+		} else {
+			value, err = client.Get(*getKey)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
 		log.Println(value)
+	case "stat":
+		statCmd.Parse(os.Args[2:])
+		client := initClient(*statAddr)
+		stat, err := client.Stat(*statKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printStat(stat)
 	case "put":
 		putCmd.Parse(os.Args[2:])
 		client := initClient(*putAddr)
-		if err := client.Put(*putKey, *putValue); err != nil {
+		if *putIncr != 0 || *putDecr != 0 {
+			value, err := client.Increment(*putKey, *putIncr-*putDecr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(value)
+			break
+		}
+		if flagSet(putCmd, "cas") {
+			swapped, err := client.CompareAndSwap(*putKey, *putCas, *putValue, *putContentType)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !swapped {
+				log.Fatal("Current value does not match, not swapped")
+			}
+			break
+		}
+		if *putEncrypt {
+			secret, err := LoadClientSecret(*putKeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if secret == nil {
+				log.Fatal("Please specify an encryption secret via -keyfile or $" + PASSPHRASE_ENV)
+			}
+			client.EnableEncryption(secret)
+		}
+		value, contentType := *putValue, *putContentType
+		if *putFile != "" {
+			data, err := os.ReadFile(*putFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			value = string(data)
+			if contentType == "" {
+				contentType = mime.TypeByExtension(filepath.Ext(*putFile))
+			}
+		}
+		if err := client.PutObject(*putKey, value, contentType); err != nil {
+			log.Fatal(err)
+		}
+	case "watch":
+		watchCmd.Parse(os.Args[2:])
+		client := initClient(*watchAddr)
+		watch(client, *watchKey, *watchSince, *watchTimeout, *watchExec)
+	case "search":
+		searchCmd.Parse(os.Args[2:])
+		client := initClient(*searchAddr)
+		results, err := client.Search(*searchQuery, *searchLimit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, result := range results {
+			fmt.Printf("%s\n    %s\n", result.Key, result.Snippet)
+		}
+	case "lock":
+		lockCmd.Parse(os.Args[2:])
+		if *lockName == "" || lockCmd.NArg() == 0 {
+			log.Fatal("Please specify a lock name and a command, eg. cubby lock -name backup -- ./backup.sh")
+		}
+		client := initClient(*lockAddr)
+		os.Exit(runLocked(client, *lockName, *lockTTL, *lockWait, lockCmd.Args()))
+	case "cp":
+		cpCmd.Parse(os.Args[2:])
+		client := initClient(*cpAddr)
+		if err := client.Copy(*cpFrom, *cpTo); err != nil {
+			log.Fatal(err)
+		}
+	case "mv":
+		mvCmd.Parse(os.Args[2:])
+		client := initClient(*mvAddr)
+		if err := client.Move(*mvFrom, *mvTo); err != nil {
 			log.Fatal(err)
 		}
 	case "remove":
@@ -128,23 +373,81 @@ func main() {
 		if err := client.Remove(*removeKey); err != nil {
 			log.Fatal(err)
 		}
+	case "rm":
+		rmCmd.Parse(os.Args[2:])
+		client := initClient(*rmAddr)
+		filter := &BulkDeleteFilter{Prefix: *rmPrefix, OlderThan: *rmOlderThan, ContentType: *rmContentType}
+		bulkDelete(client, filter, *rmDryRun)
+	case "undelete":
+		undeleteCmd.Parse(os.Args[2:])
+		client := initClient(*undeleteAddr)
+		if err := client.Undelete(*undeleteKey); err != nil {
+			log.Fatal(err)
+		}
+	case "deploy":
+		deployCmd.Parse(os.Args[2:])
+		if *deployDir == "" || !strings.HasSuffix(*deployPrefix, "/") {
+			log.Fatal("Please specify a directory and a prefix ending in /, eg. cubby deploy -dir ./public -prefix site/")
+		}
+		client := initClient(*deployAddr)
+		deploy(client, *deployDir, *deployPrefix, *deployPrune)
 	}
 }
 
+// flagSet returns true if the named flag was explicitly passed.
+func flagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func adminServer(dbPath string) *CubbyServer {
 	cubby, err := NewCubbyServer(dbPath, 1) // maxObjectSize doesn't matter here
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// pick up the master key from the environment so that admin operations
+	// (eg. adding users) are encrypted at rest as well
+	masterKey, err := LoadMasterKey("")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cubby.SetMasterKey(masterKey)
 	return cubby
 }
 
-func startServer(port int, dbPath string, maxObjectSizeMB int) {
+func startServer(port, s3Port int, dbPath string, maxObjectSizeMB int, keyFile string, trashRetention time.Duration) {
+	masterKey, err := LoadMasterKey(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	cubby, err := NewCubbyServer(dbPath, maxObjectSizeMB)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer cubby.Close()
+	cubby.SetMasterKey(masterKey)
+	cubby.StartWebhooks()
+	cubby.StartTrash(trashRetention)
+	cubby.StartUploads()
+	cubby.StartLocks()
+	if err := cubby.EnsureSearchIndex(); err != nil {
+		log.Fatal(err)
+	}
+
+	if s3Port != 0 {
+		go func() {
+			s3Addr := ":" + strconv.Itoa(s3Port)
+			log.Printf("Starting S3 API on %s", s3Addr)
+			log.Fatal(http.ListenAndServe(s3Addr, http.HandlerFunc(cubby.S3Handler)))
+		}()
+	}
 
 	http.HandleFunc("/", cubby.Handler)
 	addr := ":" + strconv.Itoa(port)
@@ -152,6 +455,117 @@ func startServer(port int, dbPath string, maxObjectSizeMB int) {
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
 
+func printStat(stat *KeyStat) {
+	fmt.Printf("Key:          %s\n", stat.Key)
+	fmt.Printf("Content-Type: %s\n", stat.ContentType)
+	fmt.Printf("Size:         %d\n", stat.Size)
+	fmt.Printf("ETag:         %s\n", stat.ETag)
+	fmt.Printf("Updated:      %s\n", stat.UpdatedAt.Format(time.RFC3339))
+	fmt.Printf("Readers:      %s\n", stat.Readers)
+	fmt.Printf("Writers:      %s\n", stat.Writers)
+	if len(stat.Tags) > 0 {
+		fmt.Printf("Tags:         %s\n", strings.Join(stat.Tags, ", "))
+	}
+	names := make([]string, 0, len(stat.Meta))
+	for name := range stat.Meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("Meta %s: %s\n", name, stat.Meta[name])
+	}
+}
+
+// bulkDelete deletes keys matching the filter in batches of up to
+// BULK_DELETE_LIMIT, printing each deleted key.
+func bulkDelete(client *CubbyClient, filter *BulkDeleteFilter, dryRun bool) {
+	// skipped keys still match, so every batch reports them again
+	skipped := map[string]bool{}
+	for {
+		result, err := client.BulkDelete(filter, dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range result.Deleted {
+			fmt.Println(key)
+		}
+		for _, key := range result.Skipped {
+			if !skipped[key] {
+				skipped[key] = true
+				log.Printf("Skipped %s (not allowed to delete)", key)
+			}
+		}
+		if !result.Truncated || dryRun {
+			if result.Truncated {
+				log.Printf("More than %d keys match", BULK_DELETE_LIMIT)
+			}
+			return
+		}
+	}
+}
+
+// deploy uploads every file under dir to prefix in a single batch, so that
+// visitors never see a half deployed site.
+func deploy(client *CubbyClient, dir, prefix string, prune bool) {
+	batch := client.Batch()
+	deployed := map[string]bool{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		batch.Put(key, string(data), contentType)
+		deployed[key] = true
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(deployed) == 0 {
+		log.Fatalf("No files found in %s", dir)
+	}
+
+	removed := 0
+	if prune {
+		listings, err := client.ListKeys(prefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, listing := range listings {
+			if !deployed[listing.Key] {
+				batch.Delete(listing.Key)
+				removed++
+			}
+		}
+	}
+	if len(deployed)+removed > MAX_BATCH_OPS {
+		log.Fatalf("Too many files to deploy at once (%d, the limit is %d)", len(deployed)+removed, MAX_BATCH_OPS)
+	}
+
+	if _, err := batch.Commit(); errors.Is(err, ErrBatchTooLarge) {
+		log.Fatalf("Site is too large to deploy at once: %v. Deploy its subdirectories separately, or raise the server's -max object size", err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Deployed %d files to %s", len(deployed), prefix)
+	if prune {
+		fmt.Printf(" (removed %d)", removed)
+	}
+	fmt.Println()
+}
+
 func initClient(serverAddr string) *CubbyClient {
 	client, err := NewCubbyClient(serverAddr)
 	if err != nil {
@@ -159,3 +573,112 @@ func initClient(serverAddr string) *CubbyClient {
 	}
 	return client
 }
+
+// watch long-polls the key forever, printing each new value (or running
+// command with the new value on stdin) whenever it changes.
+func watch(client *CubbyClient, key, since string, timeout time.Duration, command string) {
+	for {
+		result, err := client.Watch(key, since, timeout)
+		if err != nil {
+			log.Printf("Error watching key %s: %v", key, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if !result.Changed {
+			continue
+		}
+
+		if result.Deleted {
+			// watch for the key to be recreated
+			since = time.Now().UTC().Format(time.RFC3339Nano)
+			log.Printf("Key %s was deleted", key)
+		} else {
+			since = result.ETag
+		}
+
+		if command == "" {
+			if !result.Deleted {
+				fmt.Println(result.Value)
+			}
+			continue
+		}
+
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = strings.NewReader(result.Value)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), "CUBBY_KEY="+key, "CUBBY_ETAG="+result.ETag, "CUBBY_DELETED="+strconv.FormatBool(result.Deleted))
+		if err := cmd.Run(); err != nil {
+			log.Printf("Error running command: %v", err)
+		}
+	}
+}
+
+// runLocked runs args while holding the named lock, renewing the lease in the
+// background. If the lease is lost the command is killed, since mutual
+// exclusion can no longer be guaranteed. It returns the command's exit code.
+func runLocked(client *CubbyClient, name string, ttl, wait time.Duration, args []string) int {
+	deadline := time.Now().Add(wait)
+	lease, err := client.AcquireLock(name, ttl)
+	for errors.Is(err, ErrLockHeld) && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		lease, err = client.AcquireLock(name, ttl)
+	}
+	if err != nil {
+		log.Printf("Unable to acquire lock %s: %v", name, err)
+		return 1
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Printf("Error starting command: %v", err)
+		client.ReleaseLock(lease)
+		return 1
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renewed, err := client.RenewLock(lease, ttl)
+				if errors.Is(err, ErrLockNotHeld) {
+					log.Printf("Lost lock %s, killing command", name)
+					cmd.Process.Kill()
+					return
+				} else if err != nil {
+					// transient errors are retried on the next tick, while
+					// the lease is still valid
+					log.Printf("Error renewing lock %s: %v", name, err)
+					continue
+				}
+				lease = renewed
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	close(done)
+	<-stopped
+	if releaseErr := client.ReleaseLock(lease); releaseErr != nil {
+		log.Printf("Error releasing lock %s: %v", name, releaseErr)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		log.Printf("Error running command: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,905 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	DAV_PREFIX               = "/_dav/"
+	DAV_DIRS_BUCKET          = "dav_dirs"
+	DAV_LOCK_PREFIX          = "dav:"
+	DAV_DEFAULT_LOCK_TIMEOUT = 10 * time.Minute
+	DAV_ALLOWED_METHODS      = "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE, LOCK, UNLOCK"
+	STATUS_LOCKED            = 423
+)
+
+// DavError aborts a WebDAV write, rolling back its transaction.
+type DavError struct {
+	Status  int
+	Message string
+}
+
+func (e *DavError) Error() string {
+	return e.Message
+}
+
+// davResource is a file (ie. a key) or a collection (a prefix ending in a
+// slash, which exists if there are keys under it or it was made with MKCOL).
+type davResource struct {
+	Key      string
+	Dir      bool
+	Metadata *CubbyMetadata
+	Size     int
+	ETag     string
+	ModTime  time.Time
+}
+
+func isDavPath(p string) bool {
+	return p == strings.TrimSuffix(DAV_PREFIX, "/") || strings.HasPrefix(p, DAV_PREFIX)
+}
+
+func davHref(key string) string {
+	return DAV_PREFIX + (&url.URL{Path: key}).EscapedPath()
+}
+
+// davDestination extracts the key from a COPY or MOVE Destination header,
+// which must point inside the WebDAV endpoint.
+func davDestination(r *http.Request) (string, error) {
+	parsed, err := url.Parse(r.Header.Get(DESTINATION_HEADER))
+	if err != nil || !strings.HasPrefix(parsed.Path, DAV_PREFIX) {
+		return "", errors.New("Invalid Destination header")
+	}
+	return strings.TrimPrefix(parsed.Path, DAV_PREFIX), nil
+}
+
+// davWritable rejects keys that couldn't be read back over HTTP because they
+// clash with cubby's own routes.
+func davWritable(key string) bool {
+	return key != "" && !strings.HasPrefix(key, "_")
+}
+
+// hasKeysUnder reports whether any key starts with prefix.
+func (c *CubbyServer) hasKeysUnder(prefix string, tx *bolt.Tx) bool {
+	k, _ := tx.Bucket([]byte(c.dataBucket)).Cursor().Seek([]byte(prefix))
+	return k != nil && strings.HasPrefix(string(k), prefix)
+}
+
+func (c *CubbyServer) davDirs(prefix string, tx *bolt.Tx) map[string]time.Time {
+	dirs := map[string]time.Time{}
+	cursor := tx.Bucket([]byte(DAV_DIRS_BUCKET)).Cursor()
+	for k, v := cursor.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = cursor.Next() {
+		// a collection exists even if its creation time can't be read
+		var created time.Time
+		if value, err := c.unseal(v); err == nil {
+			created, _ = time.Parse(time.RFC3339Nano, string(value))
+		}
+		dirs[string(k)] = created
+	}
+	return dirs
+}
+
+// putDavDir records the collection marker (a key ending in a slash) with its
+// creation time.
+func (c *CubbyServer) putDavDir(marker string, created time.Time, tx *bolt.Tx) error {
+	sealed, err := c.seal([]byte(created.UTC().Format(time.RFC3339Nano)))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(DAV_DIRS_BUCKET)).Put([]byte(marker), sealed)
+}
+
+// davStat looks up the file or collection at key, which may end in a slash
+// for collections. It returns nil if neither exists, and an error only if a
+// file exists but can't be read.
+func (c *CubbyServer) davStat(key string, tx *bolt.Tx) (*davResource, error) {
+	if !strings.HasSuffix(key, "/") {
+		metadata, err := c.GetMetadata(key, tx)
+		if err != nil {
+			return nil, err
+		}
+		if !metadata.Empty() {
+			return c.davFile(key, metadata, tx)
+		}
+		if key != "" {
+			key += "/"
+		}
+	}
+	if key == "" || key == "/" {
+		return &davResource{Key: "", Dir: true}, nil
+	}
+	dirs := c.davDirs(key, tx)
+	if created, ok := dirs[key]; ok {
+		return &davResource{Key: key, Dir: true, ModTime: created}, nil
+	}
+	if len(dirs) > 0 || c.hasKeysUnder(key, tx) {
+		return &davResource{Key: key, Dir: true}, nil
+	}
+	return nil, nil
+}
+
+// davFile describes a stored value from its metadata, only reading the value
+// if it was written before its size and ETag were recorded.
+func (c *CubbyServer) davFile(key string, metadata *CubbyMetadata, tx *bolt.Tx) (*davResource, error) {
+	file := &davResource{Key: key, Metadata: metadata, Size: metadata.Size, ETag: metadata.ETag, ModTime: metadata.UpdatedAt}
+	if file.ETag == "" {
+		data, err := c.Get(key, tx)
+		if err != nil {
+			return nil, err
+		}
+		file.Size, file.ETag = len(data), ETag(data)
+	}
+	return file, nil
+}
+
+// davChildren lists the readable files and the collections directly inside a
+// collection.
+func (c *CubbyServer) davChildren(dir string, user User, tx *bolt.Tx) []*davResource {
+	var children []*davResource
+	seen := map[string]*davResource{}
+	addDir := func(name string, created time.Time) {
+		if child, ok := seen[name]; ok {
+			if !created.IsZero() {
+				child.ModTime = created
+			}
+			return
+		}
+		seen[name] = &davResource{Key: dir + name, Dir: true, ModTime: created}
+		children = append(children, seen[name])
+	}
+
+	for _, key := range c.ListPrefix(dir, tx) {
+		rest := strings.TrimPrefix(key, dir)
+		metadata, err := c.GetMetadata(key, tx)
+		// auth check: reader allowlist
+		if err != nil || metadata.Empty() || !user.InGroup(metadata.Readers) {
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			addDir(rest[:i+1], time.Time{})
+			continue
+		}
+		if child, err := c.davFile(key, metadata, tx); err == nil {
+			children = append(children, child)
+		}
+	}
+	for marker, created := range c.davDirs(dir, tx) {
+		if rest := strings.TrimPrefix(marker, dir); rest != "" {
+			name, _, _ := strings.Cut(rest, "/")
+			addDir(name+"/", created)
+		}
+	}
+	return children
+}
+
+// davParentExists checks that the collection a new resource goes in exists,
+// as WebDAV requires.
+func (c *CubbyServer) davParentExists(key string, tx *bolt.Tx) bool {
+	parent := path.Dir(strings.TrimSuffix(key, "/"))
+	if parent == "." {
+		return true
+	}
+	// collections have no stored value, so there's nothing to fail to read
+	resource, _ := c.davStat(parent+"/", tx)
+	return resource != nil
+}
+
+// davLockNames lists the locks covering key: its own and its collections'.
+func davLockNames(key string) []string {
+	names := []string{DAV_LOCK_PREFIX + key}
+	dir := strings.TrimSuffix(key, "/")
+	for dir != "" {
+		if i := strings.LastIndex(dir, "/"); i >= 0 {
+			dir = dir[:i]
+			names = append(names, DAV_LOCK_PREFIX+dir+"/")
+		} else {
+			dir = ""
+			names = append(names, DAV_LOCK_PREFIX)
+		}
+	}
+	return names
+}
+
+// davLockToken formats a lease token as the URI that WebDAV clients see.
+func davLockToken(token string) string {
+	if len(token) != 32 {
+		return "urn:uuid:" + token
+	}
+	return fmt.Sprintf("urn:uuid:%s-%s-%s-%s-%s", token[:8], token[8:12], token[12:16], token[16:20], token[20:])
+}
+
+// submittedLockTokens collects the lease tokens in a request's If (or for
+// UNLOCK, Lock-Token) header.
+func submittedLockTokens(r *http.Request) map[string]bool {
+	tokens := map[string]bool{}
+	header := r.Header.Get("If") + r.Header.Get("Lock-Token")
+	for {
+		start := strings.Index(header, "<urn:uuid:")
+		if start < 0 {
+			return tokens
+		}
+		header = header[start+len("<urn:uuid:"):]
+		end := strings.Index(header, ">")
+		if end < 0 {
+			return tokens
+		}
+		tokens[strings.ReplaceAll(header[:end], "-", "")] = true
+		header = header[end:]
+	}
+}
+
+// davLocksUnder lists the locks held on anything inside the collection key.
+func davLocksUnder(key string, tx *bolt.Tx) []string {
+	if key != "" && !strings.HasSuffix(key, "/") {
+		return nil
+	}
+	var names []string
+	prefix := DAV_LOCK_PREFIX + key
+	cursor := tx.Bucket([]byte(LOCKS_BUCKET)).Cursor()
+	for k, _ := cursor.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = cursor.Next() {
+		if string(k) != prefix {
+			names = append(names, string(k))
+		}
+	}
+	return names
+}
+
+// davDropLocks releases the locks on key and anything inside it, once it's
+// gone.
+func davDropLocks(key string, tx *bolt.Tx) error {
+	locks := tx.Bucket([]byte(LOCKS_BUCKET))
+	for _, name := range append(davLocksUnder(key, tx), DAV_LOCK_PREFIX+key) {
+		if err := locks.Delete([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// davCheckLocks fails with 423 if key (or for collections, anything inside
+// it) is locked and the request doesn't submit the lock's token.
+func (c *CubbyServer) davCheckLocks(key string, r *http.Request, tx *bolt.Tx) error {
+	tokens := submittedLockTokens(r)
+	names := append(davLockNames(key), davLocksUnder(key, tx)...)
+	for _, name := range names {
+		if lease := c.getLease(name, tx); lease != nil && !lease.Expired() && !tokens[lease.Token] {
+			return &DavError{STATUS_LOCKED, "Resource is locked"}
+		}
+	}
+	return nil
+}
+
+func (c *CubbyServer) davActiveLock(key string, tx *bolt.Tx) *Lease {
+	for _, name := range davLockNames(key) {
+		if lease := c.getLease(name, tx); lease != nil && !lease.Expired() {
+			return lease
+		}
+	}
+	return nil
+}
+
+// DavHandler serves cubby over WebDAV at /_dav/, so that it can be mounted as
+// a drive. Slashes in keys are treated as directories, collections made with
+// MKCOL exist even while empty, and LOCK/UNLOCK are backed by the locks API
+// (as locks named "dav:<key>"). Clients must authenticate, and the usual
+// reader/writer groups apply.
+func (c *CubbyServer) DavHandler(w http.ResponseWriter, r *http.Request, user User) {
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", DAV_ALLOWED_METHODS)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// auth check: disallow public access, so that clients prompt for
+	// credentials up front
+	if _, ok := user.(*AnonymousUser); ok {
+		log.Println("Unauthorized WebDAV attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, DAV_PREFIX), strings.TrimSuffix(DAV_PREFIX, "/"))
+	var err error
+	switch r.Method {
+	case "PROPFIND":
+		err = c.davPropfind(w, r, key, user)
+	case http.MethodGet, http.MethodHead:
+		err = c.davGet(w, r, key, user)
+	case http.MethodPut:
+		err = c.davPut(w, r, key, user)
+	case http.MethodDelete:
+		err = c.davDelete(w, r, key, user)
+	case "MKCOL":
+		err = c.davMkcol(w, r, key, user)
+	case METHOD_COPY, METHOD_MOVE:
+		err = c.davCopy(w, r, key, user)
+	case "LOCK":
+		err = c.davLock(w, r, key, user)
+	case "UNLOCK":
+		err = c.davUnlock(w, r, key)
+	default:
+		w.Header().Set("Allow", DAV_ALLOWED_METHODS)
+		err = &DavError{http.StatusMethodNotAllowed, "Method not allowed"}
+	}
+
+	var davErr *DavError
+	var copyErr *CopyError
+	if errors.As(err, &davErr) {
+		http.Error(w, davErr.Message, davErr.Status)
+	} else if errors.As(err, &copyErr) {
+		// a WebDAV client can't do anything with a 401 once authenticated
+		if copyErr.Status == http.StatusUnauthorized {
+			copyErr.Status = http.StatusForbidden
+		}
+		http.Error(w, copyErr.Message, copyErr.Status)
+	} else if writeSchemaError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Error handling WebDAV %s %s: %v", r.Method, key, err)
+		http.Error(w, "Could not complete request", http.StatusInternalServerError)
+	}
+}
+
+// davCommit runs a WebDAV write, publishing its events afterwards.
+func (c *CubbyServer) davCommit(fn func(tx *bolt.Tx) ([]*ChangeEvent, error)) error {
+	var events []*ChangeEvent
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		events, err = fn(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		c.publish(event)
+	}
+	return nil
+}
+
+// davProperty is a property requested by PROPFIND.
+type davProperty struct {
+	XMLName xml.Name
+}
+
+func parsePropfind(body io.Reader) ([]xml.Name, error) {
+	var request struct {
+		Prop *struct {
+			Props []davProperty `xml:",any"`
+		} `xml:"DAV: prop"`
+	}
+	if err := xml.NewDecoder(body).Decode(&request); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if request.Prop == nil {
+		// allprop (and propname, which is treated the same)
+		return nil, nil
+	}
+	names := []xml.Name{}
+	for _, prop := range request.Prop.Props {
+		names = append(names, prop.XMLName)
+	}
+	return names, nil
+}
+
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func davLockDiscovery(lease *Lease) string {
+	if lease == nil {
+		return "<D:lockdiscovery/>"
+	}
+	timeout := int(time.Until(lease.ExpiresAt).Seconds())
+	return "<D:lockdiscovery><D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>" +
+		"<D:depth>infinity</D:depth><D:owner>" + escapeXML(lease.Owner) + "</D:owner>" +
+		"<D:timeout>Second-" + strconv.Itoa(max(timeout, 0)) + "</D:timeout>" +
+		"<D:locktoken><D:href>" + davLockToken(lease.Token) + "</D:href></D:locktoken>" +
+		"<D:lockroot><D:href>" + escapeXML(davHref(strings.TrimPrefix(lease.Name, DAV_LOCK_PREFIX))) + "</D:href></D:lockroot>" +
+		"</D:activelock></D:lockdiscovery>"
+}
+
+// davProps renders a resource's properties, or just the requested ones (with
+// any it doesn't have listed as not found).
+func (c *CubbyServer) davProps(resource *davResource, requested []xml.Name, tx *bolt.Tx) string {
+	name := path.Base(strings.TrimSuffix(resource.Key, "/"))
+	if resource.Key == "" {
+		name = "/"
+	}
+	props := map[string]string{
+		"displayname":   "<D:displayname>" + escapeXML(name) + "</D:displayname>",
+		"resourcetype":  "<D:resourcetype/>",
+		"supportedlock": "<D:supportedlock><D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry></D:supportedlock>",
+		"lockdiscovery": davLockDiscovery(c.davActiveLock(resource.Key, tx)),
+	}
+	if resource.Dir {
+		props["resourcetype"] = "<D:resourcetype><D:collection/></D:resourcetype>"
+	} else {
+		contentType := resource.Metadata.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		props["getcontentlength"] = "<D:getcontentlength>" + strconv.Itoa(resource.Size) + "</D:getcontentlength>"
+		props["getcontenttype"] = "<D:getcontenttype>" + escapeXML(contentType) + "</D:getcontenttype>"
+		props["getetag"] = "<D:getetag>" + escapeXML(resource.ETag) + "</D:getetag>"
+	}
+	if !resource.ModTime.IsZero() {
+		props["getlastmodified"] = "<D:getlastmodified>" + resource.ModTime.UTC().Format(http.TimeFormat) + "</D:getlastmodified>"
+	}
+
+	var found, missing strings.Builder
+	if requested == nil {
+		for _, prop := range []string{"displayname", "resourcetype", "getcontentlength", "getcontenttype", "getetag", "getlastmodified", "supportedlock", "lockdiscovery"} {
+			found.WriteString(props[prop])
+		}
+	}
+	for _, prop := range requested {
+		if value, ok := props[prop.Local]; ok && prop.Space == "DAV:" {
+			found.WriteString(value)
+		} else {
+			fmt.Fprintf(&missing, `<R:%s xmlns:R="%s"/>`, prop.Local, escapeXML(prop.Space))
+		}
+	}
+
+	response := "<D:response><D:href>" + escapeXML(davHref(resource.Key)) + "</D:href>"
+	if found.Len() > 0 || missing.Len() == 0 {
+		response += "<D:propstat><D:prop>" + found.String() + "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>"
+	}
+	if missing.Len() > 0 {
+		response += "<D:propstat><D:prop>" + missing.String() + "</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>"
+	}
+	return response + "</D:response>"
+}
+
+func (c *CubbyServer) davPropfind(w http.ResponseWriter, r *http.Request, key string, user User) error {
+	requested, err := parsePropfind(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return &DavError{http.StatusBadRequest, "Invalid PROPFIND body"}
+	}
+
+	var body strings.Builder
+	err = c.db.View(func(tx *bolt.Tx) error {
+		resource, err := c.davStat(key, tx)
+		if err != nil {
+			return err
+		}
+		if resource == nil {
+			return &DavError{http.StatusNotFound, "Not found"}
+		}
+		// auth check: reader allowlist
+		if !resource.Dir && !user.InGroup(resource.Metadata.Readers) {
+			return &DavError{http.StatusForbidden, "Unauthorized Reader"}
+		}
+
+		body.WriteString(c.davProps(resource, requested, tx))
+		// infinite depth is treated as 1, which is all clients need to browse
+		if resource.Dir && r.Header.Get("Depth") != "0" {
+			for _, child := range c.davChildren(resource.Key, user, tx) {
+				body.WriteString(c.davProps(child, requested, tx))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprint(w, xml.Header+`<D:multistatus xmlns:D="DAV:">`+body.String()+"</D:multistatus>")
+	return nil
+}
+
+func (c *CubbyServer) davGet(w http.ResponseWriter, r *http.Request, key string, user User) error {
+	var resource *davResource
+	var data []byte
+	var children []*davResource
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		resource, err = c.davStat(key, tx)
+		if resource != nil && resource.Dir {
+			children = c.davChildren(resource.Key, user, tx)
+		} else if resource != nil {
+			data, err = c.Get(key, tx)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if resource == nil {
+		return &DavError{http.StatusNotFound, "Not found"}
+	}
+
+	if resource.Dir {
+		// a plain listing for browsers
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<ul>\n", html.EscapeString(davHref(resource.Key)))
+		for _, child := range children {
+			name := strings.TrimPrefix(child.Key, resource.Key)
+			fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(davHref(child.Key)), html.EscapeString(name))
+		}
+		fmt.Fprint(w, "</ul>\n")
+		return nil
+	}
+
+	// auth check: reader allowlist
+	if !user.InGroup(resource.Metadata.Readers) {
+		return &DavError{http.StatusForbidden, "Unauthorized Reader"}
+	}
+	w.Header().Set("Content-Type", resource.Metadata.ContentType)
+	w.Header().Set("ETag", resource.ETag)
+	// handles ranges, conditional requests and HEAD
+	http.ServeContent(w, r, "", resource.ModTime, bytes.NewReader(data))
+	return nil
+}
+
+func (c *CubbyServer) davPut(w http.ResponseWriter, r *http.Request, key string, user User) error {
+	if !davWritable(key) || strings.HasSuffix(key, "/") {
+		return &DavError{http.StatusForbidden, "Invalid key"}
+	}
+	var body bytes.Buffer
+	r.Body = http.MaxBytesReader(w, r.Body, c.maxObjectSize)
+	if _, err := body.ReadFrom(r.Body); err != nil {
+		return &DavError{http.StatusRequestEntityTooLarge, "Value exceeds the maximum object size"}
+	}
+
+	// WebDAV clients rarely know better than the file extension
+	contentType := r.Header.Get("Content-Type")
+	if byExtension := mime.TypeByExtension(path.Ext(key)); byExtension != "" && (contentType == "" || contentType == "application/octet-stream") {
+		contentType = byExtension
+	}
+
+	created := false
+	err := c.davCommit(func(tx *bolt.Tx) ([]*ChangeEvent, error) {
+		if err := c.davCheckLocks(key, r, tx); err != nil {
+			return nil, err
+		}
+		if dir, _ := c.davStat(key+"/", tx); dir != nil {
+			return nil, &DavError{http.StatusMethodNotAllowed, "A collection exists at this path"}
+		}
+		if !c.davParentExists(key, tx) {
+			return nil, &DavError{http.StatusConflict, "Parent collection does not exist"}
+		}
+
+		metadata, err := c.GetMetadata(key, tx)
+		if err != nil {
+			return nil, err
+		}
+		created = metadata.Empty()
+		// auth check: writer allowlist
+		if !metadata.Empty() && !user.InGroup(metadata.Writers) {
+			return nil, &DavError{http.StatusForbidden, "Unauthorized Overwrite"}
+		}
+		metadata.UpdateReaders(UnknownGroup)
+		metadata.UpdateWriters(UnknownGroup)
+		metadata.SetContentType(contentType)
+		metadata.MarkUpdated()
+		event, err := c.CommitPut(key, body.Bytes(), metadata, tx)
+		return []*ChangeEvent{event}, err
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", ETag(body.Bytes()))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return nil
+}
+
+// davRemove moves a file, or every key in a collection, to the trash, and
+// forgets the collections made by MKCOL inside it. The user must be able to
+// delete all of it.
+func (c *CubbyServer) davRemove(resource *davResource, user User, tx *bolt.Tx) ([]*ChangeEvent, error) {
+	if !resource.Dir {
+		// auth check: writer allowlist
+		if !user.InGroup(resource.Metadata.Writers) {
+			return nil, &DavError{http.StatusForbidden, "Unauthorized Writer"}
+		}
+		event, err := c.CommitTrash(resource.Key, resource.Metadata, user.Name(), tx)
+		if err != nil {
+			return nil, err
+		}
+		return []*ChangeEvent{event}, davDropLocks(resource.Key, tx)
+	}
+
+	var events []*ChangeEvent
+	for _, key := range c.ListPrefix(resource.Key, tx) {
+		metadata, err := c.GetMetadata(key, tx)
+		if err != nil {
+			return nil, err
+		}
+		// auth check: writer allowlist
+		if !user.InGroup(metadata.Writers) {
+			return nil, &DavError{http.StatusForbidden, "Unauthorized Writer: " + key}
+		}
+		event, err := c.CommitTrash(key, metadata, user.Name(), tx)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	dirs := tx.Bucket([]byte(DAV_DIRS_BUCKET))
+	for marker := range c.davDirs(resource.Key, tx) {
+		if err := dirs.Delete([]byte(marker)); err != nil {
+			return nil, err
+		}
+	}
+	return events, davDropLocks(resource.Key, tx)
+}
+
+func (c *CubbyServer) davDelete(w http.ResponseWriter, r *http.Request, key string, user User) error {
+	if key == "" {
+		return &DavError{http.StatusForbidden, "Cannot delete the root collection"}
+	}
+	err := c.davCommit(func(tx *bolt.Tx) ([]*ChangeEvent, error) {
+		resource, err := c.davStat(key, tx)
+		if err != nil {
+			return nil, err
+		}
+		if resource == nil {
+			return nil, &DavError{http.StatusNotFound, "Not found"}
+		}
+		if err := c.davCheckLocks(resource.Key, r, tx); err != nil {
+			return nil, err
+		}
+		return c.davRemove(resource, user, tx)
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (c *CubbyServer) davMkcol(w http.ResponseWriter, r *http.Request, key string, user User) error {
+	if r.ContentLength > 0 {
+		return &DavError{http.StatusUnsupportedMediaType, "MKCOL bodies are not supported"}
+	}
+	key = strings.TrimSuffix(key, "/")
+	if !davWritable(key) {
+		return &DavError{http.StatusForbidden, "Invalid collection name"}
+	}
+	err := c.davCommit(func(tx *bolt.Tx) ([]*ChangeEvent, error) {
+		if err := c.davCheckLocks(key+"/", r, tx); err != nil {
+			return nil, err
+		}
+		existing, err := c.davStat(key, tx)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, &DavError{http.StatusMethodNotAllowed, "Resource already exists"}
+		}
+		if !c.davParentExists(key, tx) {
+			return nil, &DavError{http.StatusConflict, "Parent collection does not exist"}
+		}
+		return nil, c.putDavDir(key+"/", time.Now(), tx)
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (c *CubbyServer) davCopy(w http.ResponseWriter, r *http.Request, key string, user User) error {
+	move := r.Method == METHOD_MOVE
+	overwrite := !strings.EqualFold(r.Header.Get(OVERWRITE_HEADER), "F")
+	dst, err := davDestination(r)
+	if err != nil {
+		return &DavError{http.StatusBadRequest, err.Error()}
+	}
+	if !davWritable(strings.TrimSuffix(dst, "/")) {
+		return &DavError{http.StatusForbidden, "Invalid destination"}
+	}
+
+	created := false
+	err = c.davCommit(func(tx *bolt.Tx) ([]*ChangeEvent, error) {
+		resource, err := c.davStat(key, tx)
+		if err != nil {
+			return nil, err
+		}
+		if resource == nil {
+			return nil, &DavError{http.StatusNotFound, "Not found"}
+		}
+		if resource.Dir {
+			dst = strings.TrimSuffix(dst, "/") + "/"
+		} else {
+			dst = strings.TrimSuffix(dst, "/")
+		}
+		if resource.Key == "" || dst == resource.Key || resource.Dir && strings.HasPrefix(dst, resource.Key) {
+			return nil, &DavError{http.StatusForbidden, "Destination overlaps with the source"}
+		}
+		if move {
+			if err := c.davCheckLocks(resource.Key, r, tx); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.davCheckLocks(dst, r, tx); err != nil {
+			return nil, err
+		}
+		if !c.davParentExists(dst, tx) {
+			return nil, &DavError{http.StatusConflict, "Parent collection does not exist"}
+		}
+
+		// an existing destination is replaced entirely, as WebDAV requires
+		var events []*ChangeEvent
+		existing, err := c.davStat(dst, tx)
+		if err == nil && existing == nil {
+			existing, err = c.davStat(strings.TrimSuffix(dst, "/"), tx)
+		}
+		if err != nil {
+			return nil, err
+		}
+		created = existing == nil
+		if existing != nil {
+			if !overwrite {
+				return nil, &DavError{http.StatusPreconditionFailed, "Destination exists"}
+			}
+			removed, err := c.davRemove(existing, user, tx)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, removed...)
+		}
+
+		if move {
+			if err := davDropLocks(resource.Key, tx); err != nil {
+				return nil, err
+			}
+		}
+		if !resource.Dir {
+			_, copied, err := c.CopyKey(resource.Key, dst, move, true, user, tx)
+			return append(events, copied...), err
+		}
+		for _, src := range c.ListPrefix(resource.Key, tx) {
+			_, copied, err := c.CopyKey(src, dst+strings.TrimPrefix(src, resource.Key), move, true, user, tx)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, copied...)
+		}
+		if err := c.putDavDir(dst, time.Now(), tx); err != nil {
+			return nil, err
+		}
+		dirs := tx.Bucket([]byte(DAV_DIRS_BUCKET))
+		for marker, created := range c.davDirs(resource.Key, tx) {
+			err := c.putDavDir(dst+strings.TrimPrefix(marker, resource.Key), created, tx)
+			if err == nil && move {
+				err = dirs.Delete([]byte(marker))
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return events, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("WebDAV %s %s to %s", r.Method, key, dst)
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return nil
+}
+
+// davLockTimeout parses a Timeout header like "Second-600, Infinite".
+func davLockTimeout(r *http.Request) time.Duration {
+	for _, option := range strings.Split(r.Header.Get("Timeout"), ",") {
+		if seconds, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(option), "Second-")); err == nil && seconds > 0 {
+			return min(time.Duration(seconds)*time.Second, MAX_LOCK_TTL)
+		}
+	}
+	return DAV_DEFAULT_LOCK_TIMEOUT
+}
+
+func (c *CubbyServer) davLock(w http.ResponseWriter, r *http.Request, key string, user User) error {
+	var resource *davResource
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		resource, err = c.davStat(key, tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if resource != nil {
+		key = resource.Key
+	} else if !davWritable(key) {
+		return &DavError{http.StatusForbidden, "Invalid key"}
+	}
+	name := DAV_LOCK_PREFIX + key
+
+	// a refresh is identified by the If header
+	refresh := r.ContentLength <= 0 && r.Header.Get("If") != ""
+	var lease *Lease
+	if refresh {
+		err = ErrLockNotHeld
+		for token := range submittedLockTokens(r) {
+			if lease, err = c.RenewLock(name, token, davLockTimeout(r)); err == nil {
+				break
+			}
+		}
+		if errors.Is(err, ErrLockNotHeld) {
+			return &DavError{http.StatusPreconditionFailed, "Lock token does not match"}
+		}
+	} else {
+		// new locks also need to be clear of locks on their collections,
+		// checked in the same transaction that takes the lock
+		err = c.db.Update(func(tx *bolt.Tx) error {
+			if err := c.davCheckLocks(key, r, tx); err != nil {
+				return err
+			}
+			var err error
+			lease, err = c.acquireLock(name, user.Name(), davLockTimeout(r), tx)
+			return err
+		})
+		if errors.Is(err, ErrLockHeld) {
+			return &DavError{STATUS_LOCKED, "Resource is locked"}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !refresh {
+		w.Header().Set("Lock-Token", "<"+davLockToken(lease.Token)+">")
+		log.Printf("WebDAV lock %s acquired by %s", key, user.Name())
+	}
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, xml.Header+`<D:prop xmlns:D="DAV:">`+davLockDiscovery(lease)+"</D:prop>")
+	return nil
+}
+
+func (c *CubbyServer) davUnlock(w http.ResponseWriter, r *http.Request, key string) error {
+	var resource *davResource
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		resource, err = c.davStat(key, tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if resource != nil {
+		key = resource.Key
+	}
+	for token := range submittedLockTokens(r) {
+		if err := c.ReleaseLock(DAV_LOCK_PREFIX+key, token); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+	return &DavError{http.StatusConflict, "Lock token does not match"}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestDavFilesUseRecordedSizeAndETag(t *testing.T) {
+	c := newTestServer(t)
+	serve(c, http.MethodPut, "/docs/recorded.txt", []byte("hello"))
+	serve(c, http.MethodPut, "/docs/legacy.txt", []byte("hi"))
+	c.db.Update(func(tx *bolt.Tx) error {
+		// the value changing behind the metadata's back shows whether it's read
+		if err := tx.Bucket([]byte(c.dataBucket)).Put([]byte("docs/recorded.txt"), []byte("changed!")); err != nil {
+			t.Fatal(err)
+		}
+		metadata, err := c.GetMetadata("docs/legacy.txt", tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata.Size, metadata.ETag = 0, ""
+		return c.PutMetadata("docs/legacy.txt", metadata, tx)
+	})
+
+	want := map[string]*davResource{
+		"docs/recorded.txt": {Size: 5, ETag: ETag([]byte("hello"))},
+		"docs/legacy.txt":   {Size: 2, ETag: ETag([]byte("hi"))},
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		for key, expected := range want {
+			file, err := c.davStat(key, tx)
+			if err != nil || file.Size != expected.Size || file.ETag != expected.ETag {
+				t.Errorf("davStat(%s) = %+v, %v", key, file, err)
+			}
+		}
+		children := c.davChildren("docs/", c.FetchUser("u", "p"), tx)
+		if len(children) != len(want) {
+			t.Fatalf("davChildren returned %d children", len(children))
+		}
+		for _, child := range children {
+			if expected := want[child.Key]; child.Size != expected.Size || child.ETag != expected.ETag {
+				t.Errorf("child %s = %+v", child.Key, child)
+			}
+		}
+		return nil
+	})
+}
+
+func TestDavLockConflicts(t *testing.T) {
+	c := newTestServer(t)
+	serve(c, http.MethodPut, "/docs/a.txt", []byte("a"))
+	lockInfo := []byte(`<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`)
+
+	w := serve(c, "LOCK", "/_dav/docs/", lockInfo)
+	if w.Code != http.StatusOK || w.Header().Get("Lock-Token") == "" {
+		t.Fatalf("locking the collection returned %d %q", w.Code, w.Header().Get("Lock-Token"))
+	}
+	for _, target := range []string{"/_dav/docs/", "/_dav/docs/a.txt", "/_dav/"} {
+		w := serve(c, "LOCK", target, lockInfo)
+		if w.Code != STATUS_LOCKED || w.Header().Get("Lock-Token") != "" {
+			t.Errorf("locking %s returned %d %q", target, w.Code, w.Header().Get("Lock-Token"))
+		}
+	}
+}
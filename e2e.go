@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ENCRYPTED_CONTENT_TYPE = "application/x-cubby-encrypted"
+	PASSPHRASE_ENV         = "CUBBY_PASSPHRASE"
+	E2E_MAGIC              = "cubby:e2e:v1\n"
+	e2eSaltSize            = 16
+)
+
+var ErrNoPassphrase = errors.New("value is end-to-end encrypted; a passphrase or key file is required")
+
+// LoadClientSecret reads the end-to-end encryption secret from keyFile if
+// specified, and otherwise from the CUBBY_PASSPHRASE environment variable.
+func LoadClientSecret(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return os.ReadFile(keyFile)
+	}
+	if passphrase := os.Getenv(PASSPHRASE_ENV); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+func deriveE2EKey(secret, salt []byte) ([]byte, error) {
+	return scrypt.Key(secret, salt, 1<<15, 8, 1, MASTER_KEY_SIZE)
+}
+
+// encryptE2E produces a self-contained ciphertext of the form
+//
+//	magic + salt + nonce + AES-GCM(key, "Content-Type: <type>\n\n" + value)
+//
+// so that the server never sees the value or its original content type.
+func encryptE2E(secret []byte, value []byte, contentType string) ([]byte, error) {
+	salt := make([]byte, e2eSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := deriveE2EKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext bytes.Buffer
+	fmt.Fprintf(&plaintext, "Content-Type: %s\n\n", contentType)
+	plaintext.Write(value)
+
+	sealed, err := gcmSeal(key, plaintext.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 0, len(E2E_MAGIC)+len(salt)+len(sealed))
+	ciphertext = append(ciphertext, E2E_MAGIC...)
+	ciphertext = append(ciphertext, salt...)
+	return append(ciphertext, sealed...), nil
+}
+
+// decryptE2E reverses encryptE2E, returning the value and its original
+// content type.
+func decryptE2E(secret []byte, ciphertext []byte) ([]byte, string, error) {
+	if !bytes.HasPrefix(ciphertext, []byte(E2E_MAGIC)) || len(ciphertext) < len(E2E_MAGIC)+e2eSaltSize {
+		return nil, "", errors.New("malformed end-to-end encrypted value")
+	}
+	body := ciphertext[len(E2E_MAGIC):]
+
+	key, err := deriveE2EKey(secret, body[:e2eSaltSize])
+	if err != nil {
+		return nil, "", err
+	}
+	plaintext, err := gcmOpen(key, body[e2eSaltSize:])
+	if err != nil {
+		return nil, "", errors.New("unable to decrypt value (wrong passphrase or key file?)")
+	}
+
+	header, value, found := bytes.Cut(plaintext, []byte("\n\n"))
+	if !found || !bytes.HasPrefix(header, []byte("Content-Type:")) {
+		return nil, "", errors.New("malformed end-to-end encrypted header")
+	}
+	contentType := strings.TrimSpace(strings.TrimPrefix(string(header), "Content-Type:"))
+	return value, contentType, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	MASTER_KEY_ENV  = "CUBBY_MASTER_KEY"
+	MASTER_KEY_SIZE = 32
+	ENVELOPE_PREFIX = "cubby:enc:v1:"
+	// PLAIN_PREFIX flags plaintext values that would otherwise be mistaken
+	// for an envelope (or for another flagged value), so that the prefix of a
+	// stored value always says whether it is sealed.
+	PLAIN_PREFIX = "cubby:raw:"
+	// STORAGE_FORMAT is recorded in the settings bucket once plaintext values
+	// are stored flagged. Databases without it are migrated on startup.
+	STORAGE_FORMAT     = 1
+	SETTINGS_BUCKET    = "settings"
+	STORAGE_FORMAT_KEY = "storage_format"
+)
+
+// Envelope layout (after ENVELOPE_PREFIX):
+//
+//	wrapped data key: nonce (12 bytes) + AES-GCM(master key, data key) (32+16 bytes)
+//	payload:          nonce (12 bytes) + AES-GCM(data key, plaintext)
+//
+// Every sealed value gets its own randomly generated data key, so rotating
+// the master key only requires re-wrapping the data keys.
+const (
+	gcmNonceSize   = 12
+	wrappedKeySize = gcmNonceSize + MASTER_KEY_SIZE + 16
+)
+
+var ErrNoMasterKey = errors.New("value is encrypted but no master key is configured")
+
+// ParseMasterKey decodes a 256 bit master key from its base64 or hex encoding.
+func ParseMasterKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == MASTER_KEY_SIZE {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == MASTER_KEY_SIZE {
+		return key, nil
+	}
+	return nil, fmt.Errorf("master key must be %d bytes, encoded as base64 or hex", MASTER_KEY_SIZE)
+}
+
+// LoadMasterKey reads the master key from keyFile if specified, and otherwise
+// from the CUBBY_MASTER_KEY environment variable. A nil key is returned if
+// neither is set, meaning that encryption at rest is disabled.
+func LoadMasterKey(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		contents, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return ParseMasterKey(string(contents))
+	}
+
+	if encoded := os.Getenv(MASTER_KEY_ENV); encoded != "" {
+		return ParseMasterKey(encoded)
+	}
+	return nil, nil
+}
+
+func isEnvelope(stored []byte) bool {
+	return bytes.HasPrefix(stored, []byte(ENVELOPE_PREFIX))
+}
+
+// flagPlain stores a plaintext value as is, unless it starts with one of the
+// prefixes that mark stored values, in which case it's flagged as plaintext.
+func flagPlain(value []byte) []byte {
+	if !isEnvelope(value) && !bytes.HasPrefix(value, []byte(PLAIN_PREFIX)) {
+		return value
+	}
+	return append([]byte(PLAIN_PREFIX), value...)
+}
+
+// unflagPlain reverses flagPlain on a stored value that isn't an envelope.
+func unflagPlain(stored []byte) []byte {
+	return bytes.TrimPrefix(stored, []byte(PLAIN_PREFIX))
+}
+
+// migrateStorageFormat flags the stored plaintext values of a database from
+// before STORAGE_FORMAT that start with PLAIN_PREFIX, since unflagPlain would
+// otherwise strip it on read.
+func (c *CubbyServer) migrateStorageFormat(tx *bolt.Tx) error {
+	settings := tx.Bucket([]byte(SETTINGS_BUCKET))
+	if format, _ := strconv.Atoi(string(settings.Get([]byte(STORAGE_FORMAT_KEY)))); format >= STORAGE_FORMAT {
+		return nil
+	}
+
+	flagged := 0
+	for _, bucketName := range c.sealedBuckets() {
+		b := tx.Bucket([]byte(bucketName))
+
+		// collect entries first, since modifying a bucket while iterating
+		// over it invalidates the cursor
+		var keys, values [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if bytes.HasPrefix(v, []byte(PLAIN_PREFIX)) {
+				keys = append(keys, append([]byte{}, k...))
+				values = append(values, append([]byte(PLAIN_PREFIX), v...))
+			}
+			return nil
+		})
+
+		for i, k := range keys {
+			if err := b.Put(k, values[i]); err != nil {
+				return err
+			}
+			flagged++
+		}
+	}
+	if flagged > 0 {
+		c.log.Printf("Flagged %d plaintext values for storage format %d", flagged, STORAGE_FORMAT)
+	}
+	return settings.Put([]byte(STORAGE_FORMAT_KEY), []byte(strconv.Itoa(STORAGE_FORMAT)))
+}
+
+func gcmSeal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func gcmOpen(key, sealed []byte) ([]byte, error) {
+	if len(sealed) < gcmNonceSize {
+		return nil, errors.New("sealed value too short")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, sealed[:gcmNonceSize], sealed[gcmNonceSize:], nil)
+}
+
+func sealEnvelope(masterKey, plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, MASTER_KEY_SIZE)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := gcmSeal(masterKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := gcmSeal(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 0, len(ENVELOPE_PREFIX)+len(wrappedKey)+len(payload))
+	envelope = append(envelope, ENVELOPE_PREFIX...)
+	envelope = append(envelope, wrappedKey...)
+	return append(envelope, payload...), nil
+}
+
+func splitEnvelope(envelope []byte) (wrappedKey []byte, payload []byte, err error) {
+	body := envelope[len(ENVELOPE_PREFIX):]
+	if len(body) < wrappedKeySize {
+		return nil, nil, errors.New("malformed encryption envelope")
+	}
+	return body[:wrappedKeySize], body[wrappedKeySize:], nil
+}
+
+func openEnvelope(masterKey, envelope []byte) ([]byte, error) {
+	wrappedKey, payload, err := splitEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := gcmOpen(masterKey, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key: %v", err)
+	}
+	return gcmOpen(dataKey, payload)
+}
+
+// rewrapEnvelope re-encrypts the envelope's data key under newKey, leaving
+// the (potentially large) payload untouched.
+func rewrapEnvelope(oldKey, newKey, envelope []byte) ([]byte, error) {
+	wrappedKey, payload, err := splitEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := gcmOpen(oldKey, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key: %v", err)
+	}
+	rewrappedKey, err := gcmSeal(newKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrapped := make([]byte, 0, len(envelope))
+	rewrapped = append(rewrapped, ENVELOPE_PREFIX...)
+	rewrapped = append(rewrapped, rewrappedKey...)
+	return append(rewrapped, payload...), nil
+}
+
+// SetMasterKey enables encryption at rest for all subsequent writes. Passing
+// a nil key disables it; previously encrypted values then become unreadable.
+func (c *CubbyServer) SetMasterKey(key []byte) {
+	c.masterKey = key
+	// sites cached without the key may have been unreadable
+	c.invalidateSites()
+	if key != nil {
+		c.log.Println("Encryption at rest enabled")
+	}
+}
+
+// seal encrypts a value for storage if a master key is configured, and
+// otherwise returns it unchanged (flagged if need be).
+func (c *CubbyServer) seal(value []byte) ([]byte, error) {
+	if c.masterKey == nil {
+		return flagPlain(value), nil
+	}
+	return sealEnvelope(c.masterKey, value)
+}
+
+// unseal decrypts a stored value. Values written before encryption was
+// enabled are passed through as is.
+func (c *CubbyServer) unseal(stored []byte) ([]byte, error) {
+	if !isEnvelope(stored) {
+		return unflagPlain(stored), nil
+	}
+	if c.masterKey == nil {
+		return nil, ErrNoMasterKey
+	}
+	return openEnvelope(c.masterKey, stored)
+}
+
+// sealedBuckets lists the buckets whose values are encrypted at rest.
+func (c *CubbyServer) sealedBuckets() []string {
+	return []string{c.dataBucket, c.metaBucket, c.usersBucket, WEBHOOKS_BUCKET, TRASH_BUCKET,
+		SEARCH_DOCS_BUCKET, SEARCH_TERMS_BUCKET, SEARCH_STATS_BUCKET, UPLOADS_BUCKET, UPLOAD_CHUNKS_BUCKET, ACCESS_KEYS_BUCKET, SITES_BUCKET,
+		LOCKS_BUCKET, SCHEMAS_BUCKET, DAV_DIRS_BUCKET, EVENTS_BUCKET,
+		WEBHOOK_DELIVERIES_BUCKET, WEBHOOK_RETRIES_BUCKET}
+}
+
+// Rekey rotates the master key to newKey in a single transaction. Values that
+// are already encrypted have their data keys re-wrapped, and plaintext values
+// (eg. written before encryption was enabled) are encrypted from scratch.
+func (c *CubbyServer) Rekey(newKey []byte) error {
+	if newKey == nil {
+		return errors.New("a new master key is required")
+	}
+
+	rekeyed := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range c.sealedBuckets() {
+			b := tx.Bucket([]byte(bucketName))
+
+			// collect entries first, since modifying a bucket while iterating
+			// over it invalidates the cursor
+			var keys, values [][]byte
+			b.ForEach(func(k, v []byte) error {
+				if v != nil {
+					keys = append(keys, append([]byte{}, k...))
+					values = append(values, append([]byte{}, v...))
+				}
+				return nil
+			})
+
+			for i, k := range keys {
+				var value []byte
+				var err error
+				if isEnvelope(values[i]) {
+					if c.masterKey == nil {
+						return ErrNoMasterKey
+					}
+					value, err = rewrapEnvelope(c.masterKey, newKey, values[i])
+				} else {
+					value, err = sealEnvelope(newKey, unflagPlain(values[i]))
+				}
+				if err != nil {
+					return fmt.Errorf("rekey %s/%s: %v", bucketName, k, err)
+				}
+
+				if err := b.Put(k, value); err != nil {
+					return err
+				}
+				rekeyed++
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		c.log.Printf("Error rotating master key: %v", err)
+		return err
+	}
+
+	c.masterKey = newKey
+	c.log.Printf("Successfully rotated master key for %d values", rekeyed)
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestParseMasterKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, MASTER_KEY_SIZE)
+	tests := []struct {
+		name    string
+		encoded string
+		ok      bool
+	}{
+		{"base64", base64.StdEncoding.EncodeToString(key), true},
+		{"hex", hex.EncodeToString(key), true},
+		{"surrounding whitespace", " " + hex.EncodeToString(key) + "\n", true},
+		{"too short", base64.StdEncoding.EncodeToString(key[:16]), false},
+		{"not encoded", "correct horse battery staple", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseMasterKey(tt.encoded)
+			if tt.ok && (err != nil || !bytes.Equal(parsed, key)) {
+				t.Errorf("ParseMasterKey = %x, %v", parsed, err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("ParseMasterKey accepted an invalid key")
+			}
+		})
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	values := []string{
+		"",
+		"plain value",
+		ENVELOPE_PREFIX,
+		ENVELOPE_PREFIX + "not really encrypted",
+		PLAIN_PREFIX + "looks flagged",
+		PLAIN_PREFIX + ENVELOPE_PREFIX,
+	}
+	for _, masterKey := range [][]byte{nil, bytes.Repeat([]byte{3}, MASTER_KEY_SIZE)} {
+		c := &CubbyServer{masterKey: masterKey}
+		for _, value := range values {
+			sealed, err := c.seal([]byte(value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if masterKey != nil && !isEnvelope(sealed) {
+				t.Errorf("%q was stored unencrypted with a master key", value)
+			}
+			if masterKey == nil && isEnvelope(sealed) {
+				t.Errorf("%q would be mistaken for an envelope", value)
+			}
+			unsealed, err := c.unseal(sealed)
+			if err != nil || string(unsealed) != value {
+				t.Errorf("round trip of %q (key %t) = %q, %v", value, masterKey != nil, unsealed, err)
+			}
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	c := newTestServer(t)
+	plain := ENVELOPE_PREFIX + "written before encryption was enabled"
+	if err := c.PutAtomic("plain", plain); err != nil {
+		t.Fatal(err)
+	}
+	oldKey := bytes.Repeat([]byte{1}, MASTER_KEY_SIZE)
+	if err := c.Rekey(oldKey); err != nil {
+		t.Fatalf("encrypting existing plaintext: %v", err)
+	}
+	if err := c.PutAtomic("sealed", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := bytes.Repeat([]byte{2}, MASTER_KEY_SIZE)
+	if err := c.Rekey(newKey); err != nil {
+		t.Fatalf("rotating the master key: %v", err)
+	}
+	for key, want := range map[string]string{"plain": plain, "sealed": "secret"} {
+		if got, err := c.GetAtomic(key); err != nil || got != want {
+			t.Errorf("%s after rekey = %q, %v", key, got, err)
+		}
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		if stored := tx.Bucket([]byte(c.dataBucket)).Get([]byte("sealed")); !isEnvelope(stored) {
+			t.Error("value is not encrypted after rekey")
+		}
+		return nil
+	})
+
+	c.SetMasterKey(oldKey)
+	if _, err := c.GetAtomic("sealed"); err == nil {
+		t.Error("old master key still decrypts after rekey")
+	}
+}
+
+func TestSealedBucketsAreEncrypted(t *testing.T) {
+	c := newTestServer(t)
+	if err := c.Rekey(bytes.Repeat([]byte{4}, MASTER_KEY_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	serveWithHeaders(c, http.MethodPut, "/docs/config", http.Header{"Content-Type": {"application/json"}}, []byte(`{"a":1}`))
+	serve(c, "MKCOL", "/_dav/docs/empty/", nil)
+	if _, err := c.AcquireLock("deploy", "u", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	c.db.Update(func(tx *bolt.Tx) error {
+		return c.PutSchemaBinding(&SchemaBinding{Pattern: "docs/*", Schema: "schemas/doc"}, tx)
+	})
+
+	c.db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range c.sealedBuckets() {
+			tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+				if v != nil && !isEnvelope(v) {
+					t.Errorf("%s entry %q is stored unencrypted", bucket, k)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	for _, bucket := range []string{LOCKS_BUCKET, SCHEMAS_BUCKET, DAV_DIRS_BUCKET, EVENTS_BUCKET} {
+		c.db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte(bucket)).Stats().KeyN == 0 {
+				t.Errorf("nothing was written to %s", bucket)
+			}
+			return nil
+		})
+	}
+	if lease, err := c.AcquireLock("deploy", "a", time.Minute); err != ErrLockHeld || lease.Owner != "u" {
+		t.Errorf("sealed lease reads back as %+v, %v", lease, err)
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		if binding := c.SchemaFor("docs/x", tx); binding == nil || binding.Schema != "schemas/doc" {
+			t.Errorf("sealed schema binding reads back as %+v", binding)
+		}
+		if dirs := c.davDirs("docs/", tx); dirs["docs/empty/"].IsZero() {
+			t.Errorf("sealed collection reads back as %v", dirs)
+		}
+		if events := c.EventsSince(0, tx); len(events) != 1 || events[0].ETag != ETag([]byte(`{"a":1}`)) {
+			t.Errorf("sealed events read back as %+v", events)
+		}
+		return nil
+	})
+}
+
+func TestMigrateStorageFormat(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cubby.db")
+	c, err := NewCubbyServer(filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// simulate a database from before the storage format was recorded
+	c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(c.dataBucket)).Put([]byte("legacy"), []byte(PLAIN_PREFIX+"written before")); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(SETTINGS_BUCKET)).Delete([]byte(STORAGE_FORMAT_KEY))
+	})
+	c.Close()
+
+	// migrating must happen exactly once
+	for i := 0; i < 2; i++ {
+		c, err = NewCubbyServer(filename, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.GetAtomic("legacy"); err != nil || got != PLAIN_PREFIX+"written before" {
+			t.Errorf("legacy value after migrating = %q, %v", got, err)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	EVENTS_BUCKET        = "events"
+	EVENT_LOG_SIZE       = 1000
+	EVENT_BUFFER_SIZE    = 64
+	EVENT_KEEPALIVE      = 30 * time.Second
+	PUT_EVENT            = "put"
+	DELETE_EVENT         = "delete"
+	LAST_EVENT_ID_HEADER = "Last-Event-ID"
+)
+
+// ChangeEvent describes a committed write to a cubby.
+type ChangeEvent struct {
+	ID          uint64    `json:"id"`
+	Type        string    `json:"type"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"contentType,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	ETag        string    `json:"etag,omitempty"`
+	// Readers is kept so that events can be filtered by what a subscriber is
+	// allowed to read, but is not exposed to them.
+	Readers Group `json:"-"`
+}
+
+func NewPutEvent(key string, metadata *CubbyMetadata) *ChangeEvent {
+	return &ChangeEvent{
+		Type:        PUT_EVENT,
+		Key:         key,
+		ContentType: metadata.ContentType,
+		UpdatedAt:   metadata.UpdatedAt,
+		ETag:        metadata.ETag,
+		Readers:     metadata.Readers,
+	}
+}
+
+func NewDeleteEvent(key string, metadata *CubbyMetadata) *ChangeEvent {
+	return &ChangeEvent{
+		Type:      DELETE_EVENT,
+		Key:       key,
+		UpdatedAt: time.Now(),
+		Readers:   metadata.Readers,
+	}
+}
+
+// VisibleTo returns true if the event concerns a key under prefix that the
+// given user is allowed to read.
+func (e *ChangeEvent) VisibleTo(user User, prefix string) bool {
+	return strings.HasPrefix(e.Key, prefix) && user.InGroup(e.Readers)
+}
+
+// EventBroker fans committed change events out to in-process subscribers.
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan *ChangeEvent]struct{}
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[chan *ChangeEvent]struct{})}
+}
+
+func (b *EventBroker) Subscribe() chan *ChangeEvent {
+	ch := make(chan *ChangeEvent, EVENT_BUFFER_SIZE)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *EventBroker) Unsubscribe(ch chan *ChangeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish delivers the event to every subscriber without blocking. A
+// subscriber that has fallen too far behind is disconnected (its channel is
+// closed), and is expected to resume from the event log.
+func (b *EventBroker) Publish(event *ChangeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func eventKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// appendToLog stores value under the bucket's next sequence number, dropping
+// the oldest entry once the log holds more than size entries. It returns the
+// ID assigned to the new entry.
+func appendToLog(b *bolt.Bucket, size uint64, encode func(id uint64) ([]byte, error)) (uint64, error) {
+	id, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	value, err := encode(id)
+	if err != nil {
+		return 0, err
+	}
+	if err := b.Put(eventKey(id), value); err != nil {
+		return 0, err
+	}
+
+	if id > size {
+		return id, b.Delete(eventKey(id - size))
+	}
+	return id, nil
+}
+
+// recordEvent assigns the event the next ID and appends it (sealed) to the
+// event log, dropping the oldest entry once the log exceeds EVENT_LOG_SIZE.
+func (c *CubbyServer) recordEvent(event *ChangeEvent, tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(EVENTS_BUCKET))
+	_, err := appendToLog(b, EVENT_LOG_SIZE, func(id uint64) ([]byte, error) {
+		event.ID = id
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(event); err != nil {
+			c.log.Printf("Error encoding event for key: %s", event.Key)
+			return nil, err
+		}
+		return c.seal(buf.Bytes())
+	})
+	return err
+}
+
+// EventsSince returns the logged events with an ID greater than lastID, in
+// order. Events that have already been pruned from the log are skipped.
+func (c *CubbyServer) EventsSince(lastID uint64, tx *bolt.Tx) []*ChangeEvent {
+	b := tx.Bucket([]byte(EVENTS_BUCKET))
+	cursor := b.Cursor()
+
+	events := []*ChangeEvent{}
+	for k, v := cursor.Seek(eventKey(lastID + 1)); k != nil; k, v = cursor.Next() {
+		value, err := c.unseal(v)
+		if err != nil {
+			c.log.Printf("Error decrypting event %d: %v", binary.BigEndian.Uint64(k), err)
+			continue
+		}
+		var event ChangeEvent
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&event); err != nil {
+			c.log.Printf("Error decoding event %d: %v", binary.BigEndian.Uint64(k), err)
+			continue
+		}
+		events = append(events, &event)
+	}
+	return events
+}
+
+// publish notifies subscribers of a committed event. It is a no-op for nil
+// events, so that callers can unconditionally publish after a transaction.
+func (c *CubbyServer) publish(event *ChangeEvent) {
+	if event != nil {
+		c.events.Publish(event)
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event *ChangeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// EventsHandler streams change events for keys under the requested prefix as
+// Server-Sent Events. Clients may resume a stream by sending the last event ID
+// they saw, either via the Last-Event-ID header or a lastEventId parameter.
+func (c *CubbyServer) EventsHandler(w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Events can only be streamed via GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	lastEventID := r.Header.Get(LAST_EVENT_ID_HEADER)
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid last event ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// subscribe before reading the backlog so that no events are missed in
+	// between; duplicates are skipped based on their ID
+	ch := c.events.Subscribe()
+	defer c.events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if lastEventID != "" {
+		var backlog []*ChangeEvent
+		c.db.View(func(tx *bolt.Tx) error {
+			backlog = c.EventsSince(lastID, tx)
+			return nil
+		})
+		for _, event := range backlog {
+			lastID = event.ID
+			if event.VisibleTo(user, prefix) {
+				if err := writeSSE(w, event); err != nil {
+					return
+				}
+			}
+		}
+	}
+	flusher.Flush()
+	log.Printf("Streaming events with prefix %q to %s", prefix, user.Name())
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				// dropped for falling behind; the client will reconnect and
+				// resume from its last event ID
+				return
+			}
+			// concurrent writers may publish slightly out of order, so only
+			// skip events that were already sent as part of the backlog
+			if event.ID <= lastID || !event.VisibleTo(user, prefix) {
+				continue
+			}
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
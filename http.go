@@ -3,34 +3,59 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
 )
 
+// ALLOWED_METHODS lists the methods that can be used on keys.
+const ALLOWED_METHODS = "GET, HEAD, POST, PUT, PATCH, DELETE, COPY, MOVE, OPTIONS"
+
 func (c *CubbyServer) Handler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", ALLOWED_METHODS)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Destination, Overwrite, Upload-Offset, Upload-Length")
 
-	if r.Method == http.MethodOptions {
+	if r.Method == http.MethodOptions && !isDavPath(r.URL.Path) {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	if r.URL.Path == "" || r.URL.Path == "/" {
+	// virtual hosts serve their site to readers, while still accepting API
+	// writes (eg. to remove a site bound to the wrong host) and reserved routes
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !strings.HasPrefix(r.URL.Path, "/_") {
+		if site := c.SiteForHost(r.Host); site != nil {
+			username, password, _ := r.BasicAuth()
+			c.SiteHandler(w, r, site, strings.TrimPrefix(r.URL.Path, "/"), c.FetchUser(username, password))
+			return
+		}
+	}
+
+	if (r.URL.Path == "" || r.URL.Path == "/") && r.Method != http.MethodDelete && !isMultipartUpload(r) {
 		log.Println("Serving index page")
-		// index page shows a list of occupied cubbies (ie. active keys)
+		// index page shows a list of occupied cubbies (ie. active keys),
+		// optionally filtered by tag
+		tag := r.URL.Query().Get("tag")
+		username, password, _ := r.BasicAuth()
+		keys, tags := c.TaggedKeys(tag, c.FetchUser(username, password))
 		tmplData := struct {
 			Keys         []string
+			Tag          string
+			Tags         []string
 			Version      string
 			ShortVersion string
 		}{
-			Keys:         c.ListAtomic(),
+			Keys:         keys,
+			Tag:          tag,
+			Tags:         tags,
 			Version:      c.Version(),
 			ShortVersion: c.Version()[:7],
 		}
@@ -111,9 +136,86 @@ func (c *CubbyServer) Handler(w http.ResponseWriter, r *http.Request) {
 	}
 	user := c.FetchUser(username, password)
 
+	if r.URL.Path == "/_events" {
+		c.EventsHandler(w, r, user)
+		return
+	}
+
+	if r.URL.Path == "/_webhooks" || strings.HasPrefix(r.URL.Path, "/_webhooks/") {
+		c.WebhooksHandler(w, r, user)
+		return
+	}
+
+	if isDavPath(r.URL.Path) {
+		c.DavHandler(w, r, user)
+		return
+	}
+
+	if r.URL.Path == "/_trash" || strings.HasPrefix(r.URL.Path, "/_trash/") {
+		c.TrashHandler(w, r, user)
+		return
+	}
+
+	if r.URL.Path == "/_keys" {
+		c.KeysHandler(w, r, user)
+		return
+	}
+
+	if r.URL.Path == "/_search" {
+		c.SearchHandler(w, r, user)
+		return
+	}
+
+	if r.URL.Path == "/_uploads" || strings.HasPrefix(r.URL.Path, "/_uploads/") {
+		c.UploadsHandler(w, r, user)
+		return
+	}
+
+	if r.URL.Path == "/_batch" {
+		c.BatchHandler(w, r, user)
+		return
+	}
+
+	if r.URL.Path == "/_schemas" || strings.HasPrefix(r.URL.Path, "/_schemas/") {
+		c.SchemasHandler(w, r, user)
+		return
+	}
+
+	if r.URL.Path == "/_sites" || strings.HasPrefix(r.URL.Path, "/_sites/") {
+		c.SitesHandler(w, r, user)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/_locks/") {
+		c.LocksHandler(w, r, user)
+		return
+	}
+
+	if _, watch := r.URL.Query()["watch"]; watch && r.Method == http.MethodGet {
+		c.WatchHandler(w, r, key, user)
+		return
+	}
+
+	// keys under a site's prefix are served as a website, though ?meta still
+	// inspects them as cubbies
+	if _, meta := r.URL.Query()["meta"]; !meta && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if site := c.SiteForKey(key); site != nil {
+			if key+"/" == site.Prefix {
+				http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			} else {
+				c.SiteHandler(w, r, site, strings.TrimPrefix(key, site.Prefix), user)
+			}
+			return
+		}
+	}
+
 	if r.Method == http.MethodGet {
 		c.db.View(func(tx *bolt.Tx) error {
-			metadata := c.GetMetadata(key, tx)
+			metadata, err := c.GetMetadata(key, tx)
+			if err != nil {
+				writeReadError(w, key, err)
+				return nil
+			}
 			log.Printf("Fetched metadata for key %s: %s", key, metadata)
 
 			// auth check: reader allowlist
@@ -124,65 +226,68 @@ func (c *CubbyServer) Handler(w http.ResponseWriter, r *http.Request) {
 				return nil
 			}
 
-			data := c.Get(key, tx)
+			data, err := c.Get(key, tx)
+			if err != nil {
+				writeReadError(w, key, err)
+				return nil
+			}
 
 			if len(data) == 0 && metadata.Empty() {
 				log.Printf("Key %s not found", key)
 				http.NotFound(w, r)
+			} else if _, meta := r.URL.Query()["meta"]; meta {
+				writeJSON(w, http.StatusOK, NewKeyStat(key, metadata, data))
+			} else if path, ok := r.URL.Query()["path"]; ok {
+				serveJSONPath(w, r, metadata, data, path[0])
 			} else if _, raw := r.URL.Query()["raw"]; !raw && acceptsHTML(r) && hasTheme(metadata.ContentType) {
+				w.Header().Set("Vary", "Accept")
 				c.serveThemedView(w, key, metadata, data)
+			} else if target, ok := negotiateFormat(r, metadata.ContentType); !ok {
+				http.Error(w, "No conversion to the requested format available", http.StatusNotAcceptable)
+			} else if target != "" {
+				serveConverted(w, metadata, data, target)
 			} else {
-				w.Header().Set("Content-Type", metadata.ContentType)
-				w.Header().Set("Last-Modified", metadata.UpdatedAt.Format(time.RFC1123))
-				w.Write(data)
+				w.Header().Set("Vary", "Accept")
+				writeValue(w, metadata, data)
 			}
 			return nil
 		})
-	} else if r.Method == http.MethodPost {
-		// auth check: disallow public writes
-		if _, ok := user.(*AnonymousUser); ok {
-			log.Println("Unauthorized write attempt")
-			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-			http.Error(w, "Unauthorized Writer", http.StatusUnauthorized)
-			return
-		}
-
-		var b bytes.Buffer
-		r.Body = http.MaxBytesReader(w, r.Body, c.maxObjectSize)
-		_, err := b.ReadFrom(r.Body)
-		if err != nil {
-			log.Printf("Error reading uploaded data: %v", err)
-			http.Error(w, "Could not read data", http.StatusInternalServerError)
-			return
-		}
-
-		err = c.db.Update(func(tx *bolt.Tx) error {
-			metadata := c.GetMetadata(key, tx)
+	} else if r.Method == http.MethodHead {
+		c.db.View(func(tx *bolt.Tx) error {
+			metadata, err := c.GetMetadata(key, tx)
+			if err != nil {
+				log.Printf("Error reading key %s: %v", key, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return nil
+			}
 
-			// auth check: writer allowlist
-			if !metadata.Empty() && !user.InGroup(metadata.Writers) {
-				log.Println("Unauthorized overwrite attempt")
+			// auth check: reader allowlist
+			if !user.InGroup(metadata.Readers) {
 				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-				http.Error(w, "Unauthorized Overwrite", http.StatusUnauthorized)
+				w.WriteHeader(http.StatusUnauthorized)
 				return nil
 			}
 
-			err := c.Put(key, b.Bytes(), tx)
+			data, err := c.Get(key, tx)
 			if err != nil {
-				return err
+				log.Printf("Error reading key %s: %v", key, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return nil
 			}
-
-			metadata.UpdateReaders(StringToGroup(r.Header.Get(CUBBY_READER_HEADER)))
-			metadata.UpdateWriters(StringToGroup(r.Header.Get(CUBBY_WRITER_HEADER)))
-			metadata.SetContentType(r.Header.Get("Content-Type"))
-			metadata.MarkUpdated()
-			return c.PutMetadata(key, metadata, tx)
+			if len(data) == 0 && metadata.Empty() {
+				w.WriteHeader(http.StatusNotFound)
+				return nil
+			}
+			writeValueHeaders(w, metadata, data)
+			w.WriteHeader(http.StatusOK)
+			return nil
 		})
-		if err != nil {
-			log.Printf("Error persisting data: %v", err)
-			http.Error(w, "Could not persist data", http.StatusInternalServerError)
-			return
-		}
+	} else if isMultipartUpload(r) {
+		c.UploadHandler(w, r, key, user)
+	} else if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch {
+		c.handleWrite(w, r, key, user)
+	} else if r.Method == METHOD_COPY || r.Method == METHOD_MOVE {
+		c.CopyHandler(w, r, key, user)
 	} else if r.Method == http.MethodDelete {
 		// auth check: disallow public deletes
 		if _, ok := user.(*AnonymousUser); ok {
@@ -192,8 +297,22 @@ func (c *CubbyServer) Handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if key == "" {
+			c.BulkDeleteHandler(w, r, user)
+			return
+		}
+
+		var event *ChangeEvent
 		err := c.db.Update(func(tx *bolt.Tx) error {
-			metadata := c.GetMetadata(key, tx)
+			metadata, err := c.GetMetadata(key, tx)
+			if err != nil {
+				return err
+			}
+			if metadata.Empty() {
+				log.Printf("Key %s not found", key)
+				http.NotFound(w, r)
+				return nil
+			}
 
 			// auth check: writer allowlist
 			if !user.InGroup(metadata.Writers) {
@@ -203,23 +322,241 @@ func (c *CubbyServer) Handler(w http.ResponseWriter, r *http.Request) {
 				return nil
 			}
 
-			err := c.Remove(key, tx)
-			if err != nil {
-				return err
-			}
-			return c.RemoveMetadata(key, tx)
+			event, err = c.CommitTrash(key, metadata, user.Name(), tx)
+			return err
 		})
 
 		if err != nil {
-			http.NotFound(w, r)
+			log.Printf("Error deleting data: %v", err)
+			http.Error(w, "Could not delete data", http.StatusInternalServerError)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+		if event != nil {
+			c.publish(event)
+			w.WriteHeader(http.StatusNoContent)
+		}
 	} else {
 		log.Printf("Invalid action for key: %s", key)
-		fmt.Fprintf(w, "Invalid action for key: %s", key)
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", ALLOWED_METHODS)
+		http.Error(w, fmt.Sprintf("Invalid action for key: %s", key), http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWrite applies the requested value operation (by default replacing the
+// value with the request body) within a single transaction.
+func (c *CubbyServer) handleWrite(w http.ResponseWriter, r *http.Request, key string, user User) {
+	// auth check: disallow public writes
+	if _, ok := user.(*AnonymousUser); ok {
+		log.Println("Unauthorized write attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized Writer", http.StatusUnauthorized)
+		return
+	}
+
+	op, err := ParseValueOperation(r)
+	var opErr *OperationError
+	if errors.As(err, &opErr) {
+		http.Error(w, opErr.Message, opErr.Status)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+
+	var b bytes.Buffer
+	r.Body = http.MaxBytesReader(w, r.Body, c.maxObjectSize)
+	_, err = b.ReadFrom(r.Body)
+	if err != nil {
+		log.Printf("Error reading uploaded data: %v", err)
+		http.Error(w, "Could not read data", http.StatusInternalServerError)
+		return
+	}
+
+	var event *ChangeEvent
+	var value []byte
+	written, created := false, false
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		// a value that can't be read (eg. encrypted with another master key)
+		// aborts the write rather than being treated as empty and overwritten
+		metadata, err := c.GetMetadata(key, tx)
+		if err != nil {
+			return err
+		}
+		created = metadata.Empty()
+
+		// auth check: writer allowlist
+		if !metadata.Empty() && !user.InGroup(metadata.Writers) {
+			log.Println("Unauthorized overwrite attempt")
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			http.Error(w, "Unauthorized Overwrite", http.StatusUnauthorized)
+			return nil
+		}
+
+		if op.RequiresJSON {
+			if metadata.Empty() {
+				http.NotFound(w, r)
+				return nil
+			}
+			if !isJSON(metadata.ContentType) {
+				http.Error(w, "Cubby does not hold JSON", http.StatusConflict)
+				return nil
+			}
+		}
+
+		current, err := c.Get(key, tx)
+		if err != nil {
+			return err
+		}
+		if opErr := CheckPreconditions(r, metadata, current); opErr != nil {
+			http.Error(w, opErr.Message, opErr.Status)
+			return nil
+		}
+
+		value, err = op.Apply(current, b.Bytes())
+		if errors.As(err, &opErr) {
+			http.Error(w, opErr.Message, opErr.Status)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if int64(len(value)) > c.maxObjectSize {
+			http.Error(w, "Value exceeds the maximum object size", http.StatusRequestEntityTooLarge)
+			return nil
+		}
+
+		metadata.UpdateReaders(StringToGroup(r.Header.Get(CUBBY_READER_HEADER)))
+		metadata.UpdateWriters(StringToGroup(r.Header.Get(CUBBY_WRITER_HEADER)))
+		if err := metadata.UpdateUserMetadata(r.Header); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		contentType := r.Header.Get("Content-Type")
+		if op.BodyIsPatch {
+			contentType = ""
+		}
+		if op.Replaces || contentType != "" {
+			metadata.SetContentType(contentType)
+		} else if metadata.ContentType == "" {
+			metadata.SetContentType(op.DefaultContentType)
+		}
+		metadata.MarkUpdated()
+
+		event, err = c.CommitPut(key, value, metadata, tx)
+		written = err == nil
+		return err
+	})
+	if writeSchemaError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Error persisting data: %v", err)
+		http.Error(w, "Could not persist data", http.StatusInternalServerError)
+		return
+	}
+	c.publish(event)
+
+	if written {
+		// 201 for new keys, and 204 for replaced ones unless the operation
+		// returns the new value
+		w.Header().Set("ETag", ETag(value))
+		status := http.StatusNoContent
+		if op.ReturnsValue {
+			status = http.StatusOK
+		}
+		if created {
+			w.Header().Set("Location", (&url.URL{Path: "/" + key}).EscapedPath())
+			status = http.StatusCreated
+		}
+		w.WriteHeader(status)
+		if op.ReturnsValue {
+			w.Write(value)
+		}
+	}
+}
+
+// serveJSONPath responds with the sub-document of a JSON cubby selected by
+// path.
+func serveJSONPath(w http.ResponseWriter, r *http.Request, metadata *CubbyMetadata, data []byte, path string) {
+	if !isJSON(metadata.ContentType) {
+		http.Error(w, "Cubby does not hold JSON", http.StatusConflict)
+		return
+	}
+	segments, err := ParseJSONPath(path)
+	if err != nil {
+		http.Error(w, "Invalid path: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		http.Error(w, "Stored value is not valid JSON", http.StatusConflict)
+		return
+	}
+
+	selected, found := EvalJSONPath(doc, segments)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	value, err := encodeJSON(selected)
+	if err != nil {
+		http.Error(w, "Unable to encode result", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", metadata.UpdatedAt.Format(time.RFC1123))
+	w.Header().Set("ETag", ETag(value))
+	w.Write(value)
+}
+
+// serveConverted responds with the value converted to the target format.
+func serveConverted(w http.ResponseWriter, metadata *CubbyMetadata, data []byte, target string) {
+	converted, err := ConvertFormat(data, metadata.ContentType, target)
+	if err != nil {
+		log.Printf("Unable to convert %s to %s: %v", metadata.ContentType, target, err)
+		http.Error(w, "Unable to convert value: "+err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Type", target)
+	w.Header().Set("Last-Modified", metadata.UpdatedAt.Format(time.RFC1123))
+	w.Header().Set("ETag", ETag(converted))
+	metadata.WriteUserHeaders(w.Header())
+	w.Write(converted)
+}
+
+// writeReadError responds with 500 when a stored value exists but can't be
+// read, eg. because it was encrypted with a different master key.
+func writeReadError(w http.ResponseWriter, key string, err error) {
+	log.Printf("Error reading key %s: %v", key, err)
+	http.Error(w, "Could not read data", http.StatusInternalServerError)
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+// writeValue writes a raw cubby value along with its metadata headers.
+func writeValue(w http.ResponseWriter, metadata *CubbyMetadata, data []byte) {
+	writeValueHeaders(w, metadata, data)
+	w.Write(data)
+}
+
+// writeValueHeaders sets the headers describing a raw cubby value, so that
+// HEAD requests can inspect it without downloading it.
+func writeValueHeaders(w http.ResponseWriter, metadata *CubbyMetadata, data []byte) {
+	w.Header().Set("Content-Type", metadata.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Last-Modified", metadata.UpdatedAt.Format(time.RFC1123))
+	w.Header().Set("ETag", ETag(data))
+	w.Header().Set(CUBBY_READER_HEADER, metadata.Readers.String())
+	w.Header().Set(CUBBY_WRITER_HEADER, metadata.Writers.String())
+	metadata.WriteUserHeaders(w.Header())
 }
 
 func (c *CubbyServer) serveThemedView(w http.ResponseWriter, key string, metadata *CubbyMetadata, data []byte) {
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	MERGE_PATCH_CONTENT_TYPE = "application/merge-patch+json"
+	JSON_PATCH_CONTENT_TYPE  = "application/json-patch+json"
+)
+
+var (
+	// ErrPatchConflict means the patch is well formed but can't be applied to
+	// the current document (eg. a failed test or a missing path).
+	ErrPatchConflict = errors.New("patch conflict")
+	// ErrInvalidPatch means the patch document itself is malformed.
+	ErrInvalidPatch = errors.New("invalid patch")
+)
+
+// decodeJSON parses a single JSON document, keeping numbers as json.Number so
+// that large integers survive a round trip.
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON document")
+	}
+	return doc, nil
+}
+
+// encodeJSON serializes a decoded JSON document without escaping HTML
+// characters, since cubby values are not necessarily embedded in HTML.
+func encodeJSON(doc any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// MergePatch applies an RFC 7396 JSON merge patch to target.
+func MergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for k, v := range patchObject {
+		if v == nil {
+			delete(targetObject, k)
+		} else {
+			targetObject[k] = MergePatch(targetObject[k], v)
+		}
+	}
+	return targetObject
+}
+
+// PatchOp is a single RFC 6902 JSON Patch operation.
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"` // kept raw, so that null is still a value
+}
+
+func patchError(kind error, format string, args ...any) error {
+	return fmt.Errorf("%w: %s", kind, fmt.Sprintf(format, args...))
+}
+
+// ParseJSONPointer splits an RFC 6901 JSON pointer into its reference tokens.
+func ParseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, patchError(ErrInvalidPatch, "JSON pointer must start with '/': %s", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, patchError(ErrPatchConflict, "invalid array index: %s", token)
+	}
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if index > max {
+		return 0, patchError(ErrPatchConflict, "array index out of bounds: %s", token)
+	}
+	return index, nil
+}
+
+// pointerGet returns the value that tokens refer to within doc.
+func pointerGet(doc any, tokens []string) (any, error) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]any:
+			child, ok := node[token]
+			if !ok {
+				return nil, patchError(ErrPatchConflict, "path not found: %s", token)
+			}
+			doc = child
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, patchError(ErrPatchConflict, "cannot traverse into a scalar at: %s", token)
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate walks to the parent of the location that tokens refer to and
+// calls update with it and the final token, returning the (possibly new)
+// document. Arrays may be reallocated, so parents are rewritten on the way
+// back up.
+func pointerUpdate(doc any, tokens []string, update func(parent any, token string) (any, error)) (any, error) {
+	if len(tokens) == 1 {
+		return update(doc, tokens[0])
+	}
+
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[tokens[0]]
+		if !ok {
+			return nil, patchError(ErrPatchConflict, "path not found: %s", tokens[0])
+		}
+		updated, err := pointerUpdate(child, tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[tokens[0]] = updated
+		return node, nil
+	case []any:
+		index, err := arrayIndex(tokens[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := pointerUpdate(node[index], tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = updated
+		return node, nil
+	default:
+		return nil, patchError(ErrPatchConflict, "cannot traverse into a scalar at: %s", tokens[0])
+	}
+}
+
+func pointerAdd(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, tokens, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+		case []any:
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		default:
+			return nil, patchError(ErrPatchConflict, "cannot add to a scalar at: %s", token)
+		}
+	})
+}
+
+func pointerRemove(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return nil, patchError(ErrPatchConflict, "cannot remove the whole document")
+	}
+	return pointerUpdate(doc, tokens, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			if _, ok := node[token]; !ok {
+				return nil, patchError(ErrPatchConflict, "path not found: %s", token)
+			}
+			delete(node, token)
+			return node, nil
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:index], node[index+1:]...), nil
+		default:
+			return nil, patchError(ErrPatchConflict, "cannot remove from a scalar at: %s", token)
+		}
+	})
+}
+
+func pointerReplace(doc any, tokens []string, value any) (any, error) {
+	if _, err := pointerGet(doc, tokens); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, tokens, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			node[index] = value
+			return node, nil
+		default:
+			return nil, patchError(ErrPatchConflict, "cannot replace within a scalar at: %s", token)
+		}
+	})
+}
+
+// jsonEqual compares two decoded JSON values, treating numbers by value.
+func jsonEqual(a, b any) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aErr := av.Float64()
+		bf, bErr := bv.Float64()
+		return aErr == nil && bErr == nil && af == bf
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			other, ok := bv[k]
+			if !ok || !jsonEqual(v, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		bv, ok := b.([]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func deepCopyJSON(value any) (any, error) {
+	encoded, err := encodeJSON(value)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(encoded)
+}
+
+// ApplyJSONPatch applies a list of RFC 6902 operations to doc. Either all
+// operations succeed, or an error wrapping ErrInvalidPatch or
+// ErrPatchConflict is returned.
+func ApplyJSONPatch(doc any, ops []PatchOp) (any, error) {
+	for i, op := range ops {
+		path, err := ParseJSONPointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		var value any
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, patchError(ErrInvalidPatch, "operation %d (%s) requires a value", i, op.Op)
+			}
+			value, err = decodeJSON(op.Value)
+			if err != nil {
+				return nil, patchError(ErrInvalidPatch, "operation %d has an invalid value", i)
+			}
+		}
+
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, path, value)
+		case "remove":
+			doc, err = pointerRemove(doc, path)
+		case "replace":
+			doc, err = pointerReplace(doc, path, value)
+		case "move", "copy":
+			var from []string
+			from, err = ParseJSONPointer(op.From)
+			if err != nil {
+				return nil, err
+			}
+			if op.Op == "move" && strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, patchError(ErrInvalidPatch, "operation %d moves a value into its own child", i)
+			}
+			var source any
+			source, err = pointerGet(doc, from)
+			if err != nil {
+				break
+			}
+			if op.Op == "move" {
+				doc, err = pointerRemove(doc, from)
+			} else {
+				source, err = deepCopyJSON(source)
+			}
+			if err == nil {
+				doc, err = pointerAdd(doc, path, source)
+			}
+		case "test":
+			var actual any
+			actual, err = pointerGet(doc, path)
+			if err == nil && !jsonEqual(actual, value) {
+				err = patchError(ErrPatchConflict, "test failed at %s", op.Path)
+			}
+		default:
+			return nil, patchError(ErrInvalidPatch, "operation %d has unknown op: %q", i, op.Op)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
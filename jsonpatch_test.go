@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func mustDecodeJSON(t *testing.T, data string) any {
+	t.Helper()
+	doc, err := decodeJSON([]byte(data))
+	if err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	return doc
+}
+
+func TestMergePatch(t *testing.T) {
+	// from RFC 7396, appendix A
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		got, err := encodeJSON(MergePatch(mustDecodeJSON(t, tt.target), mustDecodeJSON(t, tt.patch)))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("MergePatch(%s, %s) = %s, %v, want %s", tt.target, tt.patch, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseJSONPointer(t *testing.T) {
+	tests := []struct {
+		pointer string
+		want    []string
+	}{
+		{"", []string{}},
+		{"/", []string{""}},
+		{"/a/0", []string{"a", "0"}},
+		{"/a~1b/m~0n", []string{"a/b", "m~n"}},
+		{"/~01", []string{"~1"}},
+	}
+	for _, tt := range tests {
+		if got, err := ParseJSONPointer(tt.pointer); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseJSONPointer(%q) = %q, %v, want %q", tt.pointer, got, err, tt.want)
+		}
+	}
+	if _, err := ParseJSONPointer("a/b"); !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("pointer without a leading slash returned %v", err)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+		err   error
+	}{
+		{"add member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, nil},
+		{"add array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, nil},
+		{"add to end", `[1,2]`, `[{"op":"add","path":"/-","value":3}]`, `[1,2,3]`, nil},
+		{"add null", `{"a":1}`, `[{"op":"add","path":"/b","value":null}]`, `{"a":1,"b":null}`, nil},
+		{"replace with null", `{"a":1}`, `[{"op":"replace","path":"/a","value":null}]`, `{"a":null}`, nil},
+		{"test null", `{"a":null}`, `[{"op":"test","path":"/a","value":null}]`, `{"a":null}`, nil},
+		{"add whole document", `{"a":1}`, `[{"op":"add","path":"","value":[1]}]`, `[1]`, nil},
+		{"add nested", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`, nil},
+		{"add escaped", `{}`, `[{"op":"add","path":"/a~1b","value":1}]`, `{"a/b":1}`, nil},
+		{"remove member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, nil},
+		{"remove array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, nil},
+		{"replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, nil},
+		{"move member", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+		{"move array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, nil},
+		{"copy is deep", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`, nil},
+		{"test passes", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`, nil},
+		{"test object order", `{"a":{"x":1,"y":[true,null]}}`, `[{"op":"test","path":"/a","value":{"y":[true,null],"x":1}}]`, `{"a":{"x":1,"y":[true,null]}}`, nil},
+		{"large integer", `{"n":9007199254740993}`, `[{"op":"add","path":"/m","value":1}]`, `{"m":1,"n":9007199254740993}`, nil},
+		{"empty patch", `{"a":1}`, `[]`, `{"a":1}`, nil},
+		{"replace whole document", `{"a":1}`, `[{"op":"replace","path":"","value":"x"}]`, `"x"`, nil},
+		{"add replaces member", `{"a":1}`, `[{"op":"add","path":"/a","value":2}]`, `{"a":2}`, nil},
+		{"dash is a member name in objects", `{}`, `[{"op":"add","path":"/-","value":1}]`, `{"-":1}`, nil},
+		{"empty member name", `{}`, `[{"op":"add","path":"/","value":1}]`, `{"":1}`, nil},
+		{"remove last element", `[1,2,3]`, `[{"op":"remove","path":"/2"}]`, `[1,2]`, nil},
+		{"move to same location", `{"a":1}`, `[{"op":"move","from":"/a","path":"/a"}]`, `{"a":1}`, nil},
+		{"ops see earlier results", `{}`, `[{"op":"add","path":"/a","value":[]},{"op":"add","path":"/a/-","value":1},{"op":"test","path":"/a/0","value":1}]`, `{"a":[1]}`, nil},
+
+		{"test fails", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, "", ErrPatchConflict},
+		{"test type mismatch", `{"a":"1"}`, `[{"op":"test","path":"/a","value":1}]`, "", ErrPatchConflict},
+		{"add to missing parent", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, "", ErrPatchConflict},
+		{"add out of bounds", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`, "", ErrPatchConflict},
+		{"leading zero index", `{"foo":["a","b"]}`, `[{"op":"remove","path":"/foo/01"}]`, "", ErrPatchConflict},
+		{"remove out of bounds", `[1]`, `[{"op":"remove","path":"/1"}]`, "", ErrPatchConflict},
+		{"remove end marker", `[1]`, `[{"op":"remove","path":"/-"}]`, "", ErrPatchConflict},
+		{"negative index", `[1]`, `[{"op":"replace","path":"/-1","value":2}]`, "", ErrPatchConflict},
+		{"test missing", `{}`, `[{"op":"test","path":"/a","value":1}]`, "", ErrPatchConflict},
+		{"test missing null", `{}`, `[{"op":"test","path":"/a","value":null}]`, "", ErrPatchConflict},
+		{"copy missing", `{}`, `[{"op":"copy","from":"/a","path":"/b"}]`, "", ErrPatchConflict},
+		{"later op fails", `{"a":1}`, `[{"op":"remove","path":"/a"},{"op":"remove","path":"/a"}]`, "", ErrPatchConflict},
+		{"remove missing", `{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, "", ErrPatchConflict},
+		{"replace missing", `{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`, "", ErrPatchConflict},
+		{"traverse scalar", `{"foo":"bar"}`, `[{"op":"replace","path":"/foo/x","value":1}]`, "", ErrPatchConflict},
+		{"unknown op", `{}`, `[{"op":"frob","path":"/a"}]`, "", ErrInvalidPatch},
+		{"missing value", `{}`, `[{"op":"add","path":"/a"}]`, "", ErrInvalidPatch},
+		{"missing from", `{"a":1}`, `[{"op":"move","path":"/b"}]`, "", ErrInvalidPatch},
+		{"invalid path", `{}`, `[{"op":"add","path":"a","value":1}]`, "", ErrInvalidPatch},
+		{"move into own child", `{"a":{"b":{}}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`, "", ErrInvalidPatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []PatchOp
+			if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+				t.Fatal(err)
+			}
+			doc, err := ApplyJSONPatch(mustDecodeJSON(t, tt.doc), ops)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("ApplyJSONPatch returned %v, want %v", err, tt.err)
+				}
+				return
+			}
+			got, encodeErr := encodeJSON(doc)
+			if err != nil || encodeErr != nil || string(got) != tt.want {
+				t.Errorf("ApplyJSONPatch = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PathSegment is a single step of a JSON path: either an object member name
+// or an array index.
+type PathSegment struct {
+	Name    string
+	Index   int
+	IsIndex bool
+}
+
+// ParseJSONPath parses a simple JSONPath expression such as $.a.b[0] or
+// $['a key'][-1], or a plain dotted path such as a.b.0. Negative indices count
+// from the end of an array. Wildcards, filters and slices are not supported.
+func ParseJSONPath(expr string) ([]PathSegment, error) {
+	expr = strings.TrimSpace(expr)
+	expr = strings.TrimPrefix(expr, "$")
+	segments := []PathSegment{}
+
+	for i := 0; i < len(expr); {
+		switch expr[i] {
+		case '.':
+			i++
+			end := i
+			for end < len(expr) && expr[end] != '.' && expr[end] != '[' {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("empty member name at offset %d", i)
+			}
+			segments = append(segments, dottedSegment(expr[i:end]))
+			i = end
+		case '[':
+			end := strings.IndexByte(expr[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated bracket at offset %d", i)
+			}
+			inner := strings.TrimSpace(expr[i+1 : i+end])
+			i += end + 1
+
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, PathSegment{Name: inner[1 : len(inner)-1]})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("unsupported bracket expression: [%s]", inner)
+			}
+			segments = append(segments, PathSegment{Index: index, IsIndex: true})
+		default:
+			if i != 0 {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", expr[i], i)
+			}
+			// plain dotted path without a leading $
+			expr = "." + expr
+		}
+	}
+	return segments, nil
+}
+
+// dottedSegment is a member name that may also be used as an array index,
+// so that plain dotted paths like a.b.0 work.
+func dottedSegment(name string) PathSegment {
+	if index, err := strconv.Atoi(name); err == nil {
+		return PathSegment{Name: name, Index: index, IsIndex: true}
+	}
+	return PathSegment{Name: name}
+}
+
+// EvalJSONPath returns the part of a decoded JSON document that the path
+// selects, and whether it exists.
+func EvalJSONPath(doc any, segments []PathSegment) (any, bool) {
+	for _, segment := range segments {
+		switch node := doc.(type) {
+		case map[string]any:
+			name := segment.Name
+			if segment.IsIndex && name == "" {
+				return nil, false
+			}
+			child, ok := node[name]
+			if !ok {
+				return nil, false
+			}
+			doc = child
+		case []any:
+			if !segment.IsIndex {
+				return nil, false
+			}
+			index := segment.Index
+			if index < 0 {
+				index += len(node)
+			}
+			if index < 0 || index >= len(node) {
+				return nil, false
+			}
+			doc = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
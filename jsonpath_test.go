@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []PathSegment
+	}{
+		{"$", []PathSegment{}},
+		{"", []PathSegment{}},
+		{"$.a.b", []PathSegment{{Name: "a"}, {Name: "b"}}},
+		{"a.b", []PathSegment{{Name: "a"}, {Name: "b"}}},
+		{" $.a ", []PathSegment{{Name: "a"}}},
+		{"$.a[0]", []PathSegment{{Name: "a"}, {Index: 0, IsIndex: true}}},
+		{"$.a[-1]", []PathSegment{{Name: "a"}, {Index: -1, IsIndex: true}}},
+		{"a.0", []PathSegment{{Name: "a"}, {Name: "0", Index: 0, IsIndex: true}}},
+		{"$['a key'][\"b.c\"]", []PathSegment{{Name: "a key"}, {Name: "b.c"}}},
+		{"[1][2]", []PathSegment{{Index: 1, IsIndex: true}, {Index: 2, IsIndex: true}}},
+		{"$[ 'a' ][ 2 ]", []PathSegment{{Name: "a"}, {Index: 2, IsIndex: true}}},
+		{"$['']", []PathSegment{{Name: ""}}},
+		{"$['a.b']", []PathSegment{{Name: "a.b"}}},
+		{"$.a-1.-2", []PathSegment{{Name: "a-1"}, {Name: "-2", Index: -2, IsIndex: true}}},
+	}
+	for _, tt := range tests {
+		if got, err := ParseJSONPath(tt.expr); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseJSONPath(%q) = %+v, %v, want %+v", tt.expr, got, err, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"$.a..b", "$.", "$[0", "$[*]", "$.a[1:2]", "$.a b[0]x", "$[]", "$['a]", "$['a\"]", "$.a."} {
+		if got, err := ParseJSONPath(expr); err == nil {
+			t.Errorf("ParseJSONPath(%q) = %+v, want an error", expr, got)
+		}
+	}
+}
+
+func TestEvalJSONPath(t *testing.T) {
+	doc := mustDecodeJSON(t, `{"a":{"b":[10,{"c":"d"},30]},"0":"zero","a key":true,"n":null,"":[[1,2]]}`)
+	tests := []struct {
+		expr  string
+		want  string
+		found bool
+	}{
+		{"$", `{"":[[1,2]],"0":"zero","a":{"b":[10,{"c":"d"},30]},"a key":true,"n":null}`, true},
+		{"$.a.b[1]", `{"c":"d"}`, true},
+		{"$[''][0][-1]", `2`, true},
+		{"$.a.b[1].c", `"d"`, true},
+		{"a.b.1.c", `"d"`, true},
+		{"$.a.b[-1]", `30`, true},
+		{"$.a.b[-3]", `10`, true},
+		{"$['a key']", `true`, true},
+		{"$.0", `"zero"`, true},
+		{"$.n", `null`, true},
+		{"$.missing", "", false},
+		{"$.a.b[3]", "", false},
+		{"$.a.b[-4]", "", false},
+		{"$.a.b.c", "", false},
+		{"$.a[0]", "", false},
+		{"$['a key'].x", "", false},
+		{"$[0]", "", false},
+		{"$.n.x", "", false},
+		{"$[''][0][2]", "", false},
+	}
+	for _, tt := range tests {
+		segments, err := ParseJSONPath(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseJSONPath(%q): %v", tt.expr, err)
+		}
+		value, found := EvalJSONPath(doc, segments)
+		if found != tt.found {
+			t.Errorf("EvalJSONPath(%q) found = %t, want %t", tt.expr, found, tt.found)
+			continue
+		}
+		if !found {
+			continue
+		}
+		if got, err := encodeJSON(value); err != nil || string(got) != tt.want {
+			t.Errorf("EvalJSONPath(%q) = %s, %v, want %s", tt.expr, got, err, tt.want)
+		}
+	}
+}
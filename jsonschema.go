@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SchemaValidator validates decoded JSON documents against a JSON Schema. It
+// supports the commonly used subset of draft 7 / 2020-12: type, enum, const,
+// object, array, string and numeric constraints, the allOf/anyOf/oneOf/not
+// combinators, and local $refs (eg. #/$defs/thing).
+type SchemaValidator struct {
+	root any
+}
+
+func NewSchemaValidator(schema []byte) (*SchemaValidator, error) {
+	root, err := decodeJSON(schema)
+	if err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %v", err)
+	}
+	switch root.(type) {
+	case map[string]any, bool:
+		return &SchemaValidator{root: root}, nil
+	}
+	return nil, fmt.Errorf("schema must be an object or a boolean")
+}
+
+// Validate returns a readable list of validation errors, which is empty if
+// the document is valid.
+func (v *SchemaValidator) Validate(doc any) []string {
+	errs := []string{}
+	v.validate(v.root, doc, "$", &errs, 0)
+	return errs
+}
+
+func jsonTypeOf(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+func typeMatches(expected string, value any) bool {
+	actual := jsonTypeOf(value)
+	return expected == actual || (expected == "number" && actual == "integer")
+}
+
+func numberOf(value any) (float64, bool) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func childPath(path string, name string) string {
+	if name != "" && strings.IndexFunc(name, func(r rune) bool {
+		return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) < 0 {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
+
+func (v *SchemaValidator) resolveRef(ref string) (any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local $refs are supported: %s", ref)
+	}
+	tokens, err := ParseJSONPointer(ref[1:])
+	if err != nil {
+		return nil, err
+	}
+	return pointerGet(v.root, tokens)
+}
+
+func (v *SchemaValidator) validate(schema any, value any, path string, errs *[]string, depth int) {
+	fail := func(format string, args ...any) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if depth > 64 {
+		fail("schema nesting too deep (recursive $ref?)")
+		return
+	}
+
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			fail("no value is allowed here")
+		}
+		return
+	case map[string]any:
+		schema = s
+	default:
+		return
+	}
+	s := schema.(map[string]any)
+
+	if ref, ok := s["$ref"].(string); ok {
+		resolved, err := v.resolveRef(ref)
+		if err != nil {
+			fail("invalid $ref %s: %v", ref, err)
+			return
+		}
+		v.validate(resolved, value, path, errs, depth+1)
+	}
+
+	// type
+	switch t := s["type"].(type) {
+	case string:
+		if !typeMatches(t, value) {
+			fail("expected %s, got %s", t, jsonTypeOf(value))
+			return
+		}
+	case []any:
+		matched := false
+		names := []string{}
+		for _, candidate := range t {
+			if name, ok := candidate.(string); ok {
+				names = append(names, name)
+				matched = matched || typeMatches(name, value)
+			}
+		}
+		if !matched {
+			fail("expected one of %s, got %s", strings.Join(names, ", "), jsonTypeOf(value))
+			return
+		}
+	}
+
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, candidate := range enum {
+			if jsonEqual(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			allowed, _ := encodeJSON(enum)
+			fail("must be one of %s", allowed)
+		}
+	}
+	if constant, ok := s["const"]; ok && !jsonEqual(constant, value) {
+		expected, _ := encodeJSON(constant)
+		fail("must equal %s", expected)
+	}
+
+	switch val := value.(type) {
+	case map[string]any:
+		v.validateObject(s, val, path, errs, depth)
+	case []any:
+		v.validateArray(s, val, path, errs, depth)
+	case string:
+		length := utf8.RuneCountInString(val)
+		if min, ok := numberOf(s["minLength"]); ok && float64(length) < min {
+			fail("must be at least %v characters long", min)
+		}
+		if max, ok := numberOf(s["maxLength"]); ok && float64(length) > max {
+			fail("must be at most %v characters long", max)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				fail("schema has an invalid pattern: %s", pattern)
+			} else if !re.MatchString(val) {
+				fail("must match pattern %s", pattern)
+			}
+		}
+	case json.Number:
+		n, _ := numberOf(val)
+		if min, ok := numberOf(s["minimum"]); ok && n < min {
+			fail("must be >= %v", min)
+		}
+		if max, ok := numberOf(s["maximum"]); ok && n > max {
+			fail("must be <= %v", max)
+		}
+		if min, ok := numberOf(s["exclusiveMinimum"]); ok && n <= min {
+			fail("must be > %v", min)
+		}
+		if max, ok := numberOf(s["exclusiveMaximum"]); ok && n >= max {
+			fail("must be < %v", max)
+		}
+		if multiple, ok := numberOf(s["multipleOf"]); ok && multiple > 0 {
+			if q := n / multiple; math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("must be a multiple of %v", multiple)
+			}
+		}
+	}
+
+	// combinators
+	if allOf, ok := s["allOf"].([]any); ok {
+		for _, sub := range allOf {
+			v.validate(sub, value, path, errs, depth+1)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		if v.countMatching(anyOf, value, path, depth) == 0 {
+			fail("must match at least one of the anyOf schemas")
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		if matches := v.countMatching(oneOf, value, path, depth); matches != 1 {
+			fail("must match exactly one of the oneOf schemas (matched %d)", matches)
+		}
+	}
+	if not, ok := s["not"]; ok {
+		if v.countMatching([]any{not}, value, path, depth) == 1 {
+			fail("must not match the \"not\" schema")
+		}
+	}
+}
+
+func (v *SchemaValidator) countMatching(schemas []any, value any, path string, depth int) int {
+	matches := 0
+	for _, sub := range schemas {
+		subErrs := []string{}
+		v.validate(sub, value, path, &subErrs, depth+1)
+		if len(subErrs) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func (v *SchemaValidator) validateObject(s map[string]any, object map[string]any, path string, errs *[]string, depth int) {
+	fail := func(format string, args ...any) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if required, ok := s["required"].([]any); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := object[name]; !present {
+					fail("missing required property %q", name)
+				}
+			}
+		}
+	}
+	if min, ok := numberOf(s["minProperties"]); ok && float64(len(object)) < min {
+		fail("must have at least %v properties", min)
+	}
+	if max, ok := numberOf(s["maxProperties"]); ok && float64(len(object)) > max {
+		fail("must have at most %v properties", max)
+	}
+
+	// validate properties in a stable order so that errors are reproducible
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	properties, _ := s["properties"].(map[string]any)
+	additional, hasAdditional := s["additionalProperties"]
+	for _, name := range names {
+		if propertySchema, ok := properties[name]; ok {
+			v.validate(propertySchema, object[name], childPath(path, name), errs, depth+1)
+		} else if hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				fail("unexpected property %q", name)
+			} else {
+				v.validate(additional, object[name], childPath(path, name), errs, depth+1)
+			}
+		}
+	}
+}
+
+func (v *SchemaValidator) validateArray(s map[string]any, array []any, path string, errs *[]string, depth int) {
+	fail := func(format string, args ...any) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if min, ok := numberOf(s["minItems"]); ok && float64(len(array)) < min {
+		fail("must have at least %v items", min)
+	}
+	if max, ok := numberOf(s["maxItems"]); ok && float64(len(array)) > max {
+		fail("must have at most %v items", max)
+	}
+	if unique, ok := s["uniqueItems"].(bool); ok && unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if jsonEqual(array[i], array[j]) {
+					fail("items %d and %d are not unique", i, j)
+				}
+			}
+		}
+	}
+
+	// prefixItems (2020-12) or an items array (draft 7) validate positionally
+	tuple, _ := s["prefixItems"].([]any)
+	items := s["items"]
+	if itemsTuple, ok := items.([]any); ok {
+		tuple = itemsTuple
+		items = s["additionalItems"]
+	}
+	for i, item := range array {
+		itemPath := path + "[" + strconv.Itoa(i) + "]"
+		if i < len(tuple) {
+			v.validate(tuple[i], item, itemPath, errs, depth+1)
+		} else if items != nil {
+			v.validate(items, item, itemPath, errs, depth+1)
+		}
+	}
+}
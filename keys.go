@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// KeyListing describes a key without its value.
+type KeyListing struct {
+	Key         string            `json:"key"`
+	ContentType string            `json:"contentType"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+	Tags        []string          `json:"tags,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+// KeyStat describes a key and its value, without the value itself.
+type KeyStat struct {
+	KeyListing
+	Size    int    `json:"size"`
+	ETag    string `json:"etag"`
+	Readers string `json:"readers"`
+	Writers string `json:"writers"`
+}
+
+func NewKeyStat(key string, metadata *CubbyMetadata, data []byte) *KeyStat {
+	return &KeyStat{
+		KeyListing: KeyListing{
+			Key:         key,
+			ContentType: metadata.ContentType,
+			UpdatedAt:   metadata.UpdatedAt,
+			Tags:        metadata.Tags,
+			Meta:        metadata.Meta,
+		},
+		Size:    len(data),
+		ETag:    ETag(data),
+		Readers: metadata.Readers.String(),
+		Writers: metadata.Writers.String(),
+	}
+}
+
+// ListKeys returns the keys under prefix that carry all of the given tags and
+// that the user is allowed to read.
+func (c *CubbyServer) ListKeys(prefix string, tags []string, user User, tx *bolt.Tx) []KeyListing {
+	listings := []KeyListing{}
+	for _, key := range c.ListPrefix(prefix, tx) {
+		metadata, err := c.GetMetadata(key, tx)
+		// auth check: reader allowlist
+		if err != nil || metadata.Empty() || !user.InGroup(metadata.Readers) || !hasTags(metadata, tags) {
+			continue
+		}
+		listings = append(listings, KeyListing{
+			Key:         key,
+			ContentType: metadata.ContentType,
+			UpdatedAt:   metadata.UpdatedAt,
+			Tags:        metadata.Tags,
+			Meta:        metadata.Meta,
+		})
+	}
+	return listings
+}
+
+func hasTags(metadata *CubbyMetadata, tags []string) bool {
+	for _, tag := range tags {
+		if !metadata.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// TaggedKeys returns the keys carrying the tag (or all keys if tag is empty),
+// along with every tag in use, for the index page. Only the tags of keys that
+// the user can read are considered.
+func (c *CubbyServer) TaggedKeys(tag string, user User) ([]string, []string) {
+	keys := []string{}
+	seen := map[string]bool{}
+	c.db.View(func(tx *bolt.Tx) error {
+		for _, key := range c.List(tx) {
+			metadata, err := c.GetMetadata(key, tx)
+			if err != nil {
+				continue
+			}
+			// auth check: reader allowlist
+			readable := user.InGroup(metadata.Readers)
+			if readable {
+				for _, t := range metadata.Tags {
+					seen[t] = true
+				}
+			}
+			if tag == "" || readable && metadata.HasTag(tag) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+
+	allTags := make([]string, 0, len(seen))
+	for t := range seen {
+		allTags = append(allTags, t)
+	}
+	sort.Strings(allTags)
+	return keys, allTags
+}
+
+// KeysHandler serves GET /_keys?prefix=...&tag=..., listing the keys (and
+// their metadata) that the requester can read. Multiple tags must all match.
+func (c *CubbyServer) KeysHandler(w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid listing action", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var listings []KeyListing
+	c.db.View(func(tx *bolt.Tx) error {
+		listings = c.ListKeys(r.URL.Query().Get("prefix"), r.URL.Query()["tag"], user, tx)
+		return nil
+	})
+	writeJSON(w, http.StatusOK, listings)
+}
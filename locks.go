@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	LOCKS_BUCKET        = "locks"
+	DEFAULT_LOCK_TTL    = 30 * time.Second
+	MAX_LOCK_TTL        = 24 * time.Hour
+	LOCK_TOKEN_HEADER   = "X-Cubby-Lock-Token"
+	LOCK_PURGE_INTERVAL = time.Hour
+)
+
+var (
+	ErrLockHeld    = errors.New("lock is held by another owner")
+	ErrLockNotHeld = errors.New("lock is not held with this token")
+)
+
+// Lease is a time limited claim on a named lock. Whoever holds the token may
+// renew or release the lease until it expires.
+type Lease struct {
+	Name      string    `json:"name"`
+	Token     string    `json:"token,omitempty"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (l *Lease) Expired() bool {
+	return !time.Now().Before(l.ExpiresAt)
+}
+
+func (c *CubbyServer) getLease(name string, tx *bolt.Tx) *Lease {
+	var lease Lease
+	if !c.getSealedGob(LOCKS_BUCKET, []byte(name), &lease, tx) {
+		return nil
+	}
+	return &lease
+}
+
+func (c *CubbyServer) putLease(lease *Lease, tx *bolt.Tx) error {
+	return c.putSealedGob(LOCKS_BUCKET, []byte(lease.Name), lease, tx)
+}
+
+// AcquireLock grants a new lease on the named lock if it is free or its
+// current lease has expired. Bolt serializes Update transactions, so at most
+// one caller can win. If the lock is held, the current lease is returned along
+// with ErrLockHeld.
+func (c *CubbyServer) AcquireLock(name, owner string, ttl time.Duration) (*Lease, error) {
+	var lease *Lease
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		lease, err = c.acquireLock(name, owner, ttl, tx)
+		return err
+	})
+	return lease, err
+}
+
+func (c *CubbyServer) acquireLock(name, owner string, ttl time.Duration, tx *bolt.Tx) (*Lease, error) {
+	if current := c.getLease(name, tx); current != nil && !current.Expired() {
+		return current, ErrLockHeld
+	}
+
+	lease := &Lease{
+		Name:      name,
+		Token:     randomHex(16),
+		Owner:     owner,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	return lease, c.putLease(lease, tx)
+}
+
+// RenewLock extends an unexpired lease held with the given token.
+func (c *CubbyServer) RenewLock(name, token string, ttl time.Duration) (*Lease, error) {
+	var lease *Lease
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		lease = c.getLease(name, tx)
+		if lease == nil || lease.Expired() || lease.Token != token {
+			return ErrLockNotHeld
+		}
+		lease.ExpiresAt = time.Now().Add(ttl)
+		return c.putLease(lease, tx)
+	})
+	return lease, err
+}
+
+// ReleaseLock frees a lock held with the given token.
+func (c *CubbyServer) ReleaseLock(name, token string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		lease := c.getLease(name, tx)
+		if lease == nil || lease.Expired() || lease.Token != token {
+			return ErrLockNotHeld
+		}
+		return tx.Bucket([]byte(LOCKS_BUCKET)).Delete([]byte(name))
+	})
+}
+
+// PurgeLocks removes leases that expired before cutoff, which would otherwise
+// pile up as lock names come and go.
+func (c *CubbyServer) PurgeLocks(cutoff time.Time) (int, error) {
+	purged := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		var expired []string
+		tx.Bucket([]byte(LOCKS_BUCKET)).ForEach(func(k, v []byte) error {
+			if lease := c.getLease(string(k), tx); lease != nil && lease.ExpiresAt.Before(cutoff) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+		for _, name := range expired {
+			if err := tx.Bucket([]byte(LOCKS_BUCKET)).Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+	return purged, err
+}
+
+// StartLocks periodically garbage collects expired leases.
+func (c *CubbyServer) StartLocks() {
+	go func() {
+		for {
+			purged, err := c.PurgeLocks(time.Now())
+			if err != nil {
+				c.log.Printf("Error purging locks: %v", err)
+			} else if purged > 0 {
+				c.log.Printf("Purged %d expired locks", purged)
+			}
+			time.Sleep(LOCK_PURGE_INTERVAL)
+		}
+	}()
+}
+
+func lockToken(r *http.Request) string {
+	if token := r.Header.Get(LOCK_TOKEN_HEADER); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// LocksHandler exposes the lock API:
+//
+//	POST   /_locks/<name>?ttl=30s        acquire (409 if held)
+//	POST   /_locks/<name>?renew&ttl=30s  renew a held lease
+//	DELETE /_locks/<name>                release a held lease
+//	GET    /_locks/<name>                show the current holder
+//
+// Renewing and releasing require the lease token, either via the
+// X-Cubby-Lock-Token header or a token parameter.
+func (c *CubbyServer) LocksHandler(w http.ResponseWriter, r *http.Request, user User) {
+	// auth check: disallow public locking
+	if _, ok := user.(*AnonymousUser); ok {
+		log.Println("Unauthorized lock attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized Locker", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/_locks/")
+	if name == "" {
+		http.Error(w, "Lock name required", http.StatusBadRequest)
+		return
+	}
+	// WebDAV locks can be inspected, but only taken and released via WebDAV
+	if strings.HasPrefix(name, DAV_LOCK_PREFIX) && r.Method != http.MethodGet {
+		http.Error(w, "Lock names starting with "+DAV_LOCK_PREFIX+" are reserved for WebDAV", http.StatusForbidden)
+		return
+	}
+
+	ttl := DEFAULT_LOCK_TTL
+	if ttlParam := r.URL.Query().Get("ttl"); ttlParam != "" {
+		var err error
+		ttl, err = time.ParseDuration(ttlParam)
+		if err != nil || ttl <= 0 || ttl > MAX_LOCK_TTL {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var lease *Lease
+		c.db.View(func(tx *bolt.Tx) error {
+			lease = c.getLease(name, tx)
+			return nil
+		})
+		if lease == nil || lease.Expired() {
+			http.NotFound(w, r)
+			return
+		}
+		lease.Token = ""
+		writeJSON(w, http.StatusOK, lease)
+
+	case http.MethodPost:
+		if _, renew := r.URL.Query()["renew"]; renew {
+			lease, err := c.RenewLock(name, lockToken(r), ttl)
+			if errors.Is(err, ErrLockNotHeld) {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else if err != nil {
+				log.Printf("Error renewing lock %s: %v", name, err)
+				http.Error(w, "Could not renew lock", http.StatusInternalServerError)
+			} else {
+				writeJSON(w, http.StatusOK, lease)
+			}
+			return
+		}
+
+		lease, err := c.AcquireLock(name, user.Name(), ttl)
+		if errors.Is(err, ErrLockHeld) {
+			lease.Token = ""
+			writeJSON(w, http.StatusConflict, lease)
+		} else if err != nil {
+			log.Printf("Error acquiring lock %s: %v", name, err)
+			http.Error(w, "Could not acquire lock", http.StatusInternalServerError)
+		} else {
+			log.Printf("Lock %s acquired by %s", name, user.Name())
+			writeJSON(w, http.StatusCreated, lease)
+		}
+
+	case http.MethodDelete:
+		err := c.ReleaseLock(name, lockToken(r))
+		if errors.Is(err, ErrLockNotHeld) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else if err != nil {
+			log.Printf("Error releasing lock %s: %v", name, err)
+			http.Error(w, "Could not release lock", http.StatusInternalServerError)
+		} else {
+			log.Printf("Lock %s released by %s", name, user.Name())
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		http.Error(w, "Invalid lock action", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestPurgeLocks(t *testing.T) {
+	c := newTestServer(t)
+	for name, ttl := range map[string]time.Duration{"expired": time.Millisecond, "held": time.Hour} {
+		if _, err := c.AcquireLock(name, "u", ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if purged, err := c.PurgeLocks(time.Now()); err != nil || purged != 1 {
+		t.Fatalf("PurgeLocks = %d, %v", purged, err)
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		if c.getLease("expired", tx) != nil || c.getLease("held", tx) == nil {
+			t.Error("PurgeLocks removed the wrong leases")
+		}
+		return nil
+	})
+}
+
+func TestLocksHandlerReservesDavNames(t *testing.T) {
+	c := newTestServer(t)
+	serve(c, http.MethodPut, "/docs/a.txt", []byte("a"))
+	lockInfo := []byte(`<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`)
+	if w := serve(c, "LOCK", "/_dav/docs/a.txt", lockInfo); w.Code != http.StatusOK {
+		t.Fatalf("WebDAV lock returned %d", w.Code)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/_locks/dav:docs/a.txt", http.StatusOK},
+		{http.MethodPost, "/_locks/dav:docs/a.txt?renew", http.StatusForbidden},
+		{http.MethodDelete, "/_locks/dav:docs/a.txt", http.StatusForbidden},
+		{http.MethodPost, "/_locks/dav:docs/b.txt", http.StatusForbidden},
+		{http.MethodPost, "/_locks/docs/b.txt", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if w := serve(c, tt.method, tt.target, nil); w.Code != tt.status {
+			t.Errorf("%s %s returned %d, want %d", tt.method, tt.target, w.Code, tt.status)
+		}
+	}
+}
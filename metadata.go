@@ -1,20 +1,42 @@
 package main
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CUBBY_META_HEADER_PREFIX = "X-Cubby-Meta-"
+	CUBBY_META_HEADER        = "X-Cubby-Meta" // resets the metadata, even without X-Cubby-Meta-* headers
+	CUBBY_TAGS_HEADER        = "X-Cubby-Tags"
+	MAX_USER_METADATA_SIZE   = 2048
+)
 
 type CubbyMetadata struct {
 	ContentType string
 	UpdatedAt   time.Time
 	Readers     Group
 	Writers     Group
+	Meta        map[string]string // user defined, keyed by lowercase name
+	Tags        []string
+	// Size and ETag describe the value as of the last write, so that listings
+	// don't have to read it. ETag is empty for values written before they
+	// were recorded.
+	Size int
+	ETag string
 }
 
 func (m *CubbyMetadata) String() string {
-	return "CubbyMetadata{ContentType: " + m.ContentType + ", UpdatedAt: " + m.UpdatedAt.String() + ", Readers: " + m.Readers.String() + ", Writers: " + m.Writers.String() + "}"
+	return "CubbyMetadata{ContentType: " + m.ContentType + ", UpdatedAt: " + m.UpdatedAt.String() + ", Readers: " + m.Readers.String() + ", Writers: " + m.Writers.String() + fmt.Sprintf(", Meta: %v, Tags: %v}", m.Meta, m.Tags)
 }
 
 func (m *CubbyMetadata) Empty() bool {
-	return *m == CubbyMetadata{}
+	return m.ContentType == "" && m.UpdatedAt.IsZero() && m.Readers == UnknownGroup && m.Writers == UnknownGroup &&
+		len(m.Meta) == 0 && len(m.Tags) == 0
 }
 
 func (m *CubbyMetadata) SetContentType(contentType string) {
@@ -51,3 +73,78 @@ func (m *CubbyMetadata) UpdateWriters(group Group) {
 		}
 	}
 }
+
+// UpdateUserMetadata replaces the user defined metadata with any
+// X-Cubby-Meta-* headers, and the tags with the X-Cubby-Tags header. Either
+// is left unchanged if not specified, and an X-Cubby-Meta header forces the
+// metadata to be replaced.
+func (m *CubbyMetadata) UpdateUserMetadata(header http.Header) error {
+	meta := map[string]string{}
+	size := 0
+	for name, values := range header {
+		if !strings.HasPrefix(name, CUBBY_META_HEADER_PREFIX) || len(name) == len(CUBBY_META_HEADER_PREFIX) {
+			continue
+		}
+		name = strings.ToLower(strings.TrimPrefix(name, CUBBY_META_HEADER_PREFIX))
+		meta[name] = values[0]
+		size += len(name) + len(values[0])
+	}
+
+	tags := m.Tags
+	if values, ok := header[CUBBY_TAGS_HEADER]; ok {
+		tags = ParseTags(strings.Join(values, ","))
+	}
+	for _, tag := range tags {
+		size += len(tag)
+	}
+	if size > MAX_USER_METADATA_SIZE {
+		return fmt.Errorf("user metadata and tags exceed %d bytes", MAX_USER_METADATA_SIZE)
+	}
+
+	if _, reset := header[CUBBY_META_HEADER]; reset || len(meta) > 0 {
+		m.Meta = meta
+	}
+	m.Tags = tags
+	return nil
+}
+
+// ParseTags splits a comma separated list of tags, dropping empty and
+// duplicate ones.
+func ParseTags(list string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func (m *CubbyMetadata) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteUserHeaders sets the user defined metadata and tags as response
+// headers.
+func (m *CubbyMetadata) WriteUserHeaders(header http.Header) {
+	for name, value := range m.Meta {
+		header.Set(CUBBY_META_HEADER_PREFIX+name, value)
+	}
+	if len(m.Tags) > 0 {
+		header.Set(CUBBY_TAGS_HEADER, strings.Join(m.Tags, ", "))
+	}
+}
+
+// ETag returns a strong entity tag for the given value.
+func ETag(value []byte) string {
+	sum := sha256.Sum256(value)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
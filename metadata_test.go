@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpdateUserMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		meta   map[string]string
+		tags   []string
+	}{
+		{"unchanged", http.Header{}, map[string]string{"a": "1"}, []string{"x"}},
+		{"replaced meta", http.Header{"X-Cubby-Meta-B": {"2"}}, map[string]string{"b": "2"}, []string{"x"}},
+		{"cleared meta", http.Header{CUBBY_META_HEADER: {""}}, map[string]string{}, []string{"x"}},
+		{"reset with new meta", http.Header{CUBBY_META_HEADER: {""}, "X-Cubby-Meta-B": {"2"}}, map[string]string{"b": "2"}, []string{"x"}},
+		{"replaced tags", http.Header{CUBBY_TAGS_HEADER: {"y, z,y"}}, map[string]string{"a": "1"}, []string{"y", "z"}},
+		{"cleared tags", http.Header{CUBBY_TAGS_HEADER: {""}}, map[string]string{"a": "1"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := &CubbyMetadata{Meta: map[string]string{"a": "1"}, Tags: []string{"x"}}
+			if err := metadata.UpdateUserMetadata(tt.header); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(metadata.Meta, tt.meta) || !reflect.DeepEqual(metadata.Tags, tt.tags) {
+				t.Errorf("metadata = %v %v, want %v %v", metadata.Meta, metadata.Tags, tt.meta, tt.tags)
+			}
+		})
+	}
+
+	tooLarge := http.Header{"X-Cubby-Meta-A": {strings.Repeat("x", MAX_USER_METADATA_SIZE)}}
+	if err := (&CubbyMetadata{}).UpdateUserMetadata(tooLarge); err == nil {
+		t.Error("oversized metadata was accepted")
+	}
+}
+
+func TestTaggedKeysOnlyShowReadableTags(t *testing.T) {
+	c := newTestServer(t)
+	serveWithHeaders(c, http.MethodPut, "/public", http.Header{CUBBY_READER_HEADER: {"public"}, CUBBY_TAGS_HEADER: {"shared"}}, []byte("x"))
+	serveWithHeaders(c, http.MethodPut, "/private", http.Header{CUBBY_READER_HEADER: {"user"}, CUBBY_TAGS_HEADER: {"secret"}}, []byte("x"))
+
+	tests := []struct {
+		name string
+		user User
+		tag  string
+		keys []string
+		tags []string
+	}{
+		{"user", c.FetchUser("u", "p"), "", []string{"private", "public"}, []string{"secret", "shared"}},
+		{"anonymous", &AnonymousUser{}, "", []string{"private", "public"}, []string{"shared"}},
+		{"anonymous by readable tag", &AnonymousUser{}, "shared", []string{"public"}, []string{"shared"}},
+		{"anonymous by unreadable tag", &AnonymousUser{}, "secret", []string{}, []string{"shared"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, tags := c.TaggedKeys(tt.tag, tt.user)
+			if !reflect.DeepEqual(keys, tt.keys) || !reflect.DeepEqual(tags, tt.tags) {
+				t.Errorf("TaggedKeys = %v %v, want %v %v", keys, tags, tt.keys, tt.tags)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -19,6 +21,110 @@ func acceptsHTML(r *http.Request) bool {
 	return false
 }
 
+type acceptedType struct {
+	mediaType string
+	quality   float64
+}
+
+// parseAccept returns the media types listed in an Accept header, most
+// preferred first. Types with a quality of 0 are dropped.
+func parseAccept(accept string) []acceptedType {
+	accepted := []acceptedType{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		entry := acceptedType{mediaType: mediaType(params[0]), quality: 1}
+		if entry.mediaType == "" {
+			continue
+		}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(name) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					entry.quality = q
+				}
+			}
+		}
+		if entry.quality > 0 {
+			accepted = append(accepted, entry)
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].quality > accepted[j].quality
+	})
+	return accepted
+}
+
+// mediaTypeMatches returns true if the accepted media range (which may be a
+// wildcard like */* or text/*) includes contentType.
+func mediaTypeMatches(accepted, contentType string) bool {
+	ct := mediaType(contentType)
+	if accepted == "*/*" || accepted == ct {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(accepted, "/*"); ok {
+		return strings.HasPrefix(ct, prefix+"/")
+	}
+	return false
+}
+
+// negotiateFormat decides how to serve a value stored as storedType. It
+// returns the content type to convert the value to (or an empty string to
+// serve it as is), and false if a structured value was requested only in
+// other structured formats that it can't be converted to. Any other mismatch
+// gets the value as is, as it did before conversions existed.
+func negotiateFormat(r *http.Request, storedType string) (string, bool) {
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return "", true
+	}
+
+	accepted := parseAccept(accept)
+	for _, entry := range accepted {
+		if mediaTypeMatches(entry.mediaType, storedType) {
+			return "", true
+		}
+		if canConvert(storedType, entry.mediaType) {
+			return entry.mediaType, true
+		}
+	}
+	if !isStructured(storedType) {
+		return "", true
+	}
+	for _, entry := range accepted {
+		if isStructured(entry.mediaType) {
+			return "", false
+		}
+	}
+	return "", true
+}
+
+// isStructured returns true for data formats (as opposed to documents, media
+// or opaque bytes), which clients may ask for in place of one another.
+func isStructured(contentType string) bool {
+	if formatOf(contentType) != "" || isJSON(contentType) {
+		return true
+	}
+	ct := mediaType(contentType)
+	switch ct {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml",
+		"application/toml", "text/x-toml", "application/xml", "text/xml",
+		"text/tab-separated-values":
+		return true
+	}
+	return strings.HasSuffix(ct, "+xml")
+}
+
+// mediaType strips any parameters (eg. charset) from a content type.
+func mediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+}
+
+// isJSON returns true for application/json and structured +json types.
+func isJSON(contentType string) bool {
+	ct := mediaType(contentType)
+	return ct == "application/json" || strings.HasSuffix(ct, "+json")
+}
+
 // hasTheme returns true if the given content type has a themed viewer.
 func hasTheme(contentType string) bool {
 	ct := strings.SplitN(contentType, ";", 2)[0]
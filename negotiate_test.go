@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		accept     string
+		storedType string
+		target     string
+		ok         bool
+	}{
+		{"no accept", "", "application/json", "", true},
+		{"wildcard", "*/*", "text/csv", "", true},
+		{"stored type", "application/json", "application/json; charset=utf-8", "", true},
+		{"type wildcard", "text/*", "text/csv", "", true},
+		{"conversion", "text/csv", "application/json", "text/csv", true},
+		{"preferred conversion", "application/json;q=0.5, application/x-ndjson", "text/csv", "application/x-ndjson", true},
+		{"conversion preferred", "text/csv, application/json;q=0.9", "application/json", "text/csv", true},
+		{"excluded stored type", "text/csv;q=0, application/json", "text/csv", "application/json", true},
+		{"unconvertible structured", "application/yaml", "application/json", "", false},
+		{"unconvertible +json", "text/csv", "application/ld+json", "", false},
+		{"unstructured accept", "image/png", "application/json", "", true},
+		{"unstructured value", "application/json", "text/plain", "", true},
+		{"opaque value", "text/csv", "application/octet-stream", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/key", nil)
+			r.Header.Set("Accept", tt.accept)
+			target, ok := negotiateFormat(r, tt.storedType)
+			if target != tt.target || ok != tt.ok {
+				t.Errorf("negotiateFormat = %q, %t, want %q, %t", target, ok, tt.target, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// OperationError aborts a write with the given HTTP status.
+type OperationError struct {
+	Status  int
+	Message string
+}
+
+func (e *OperationError) Error() string {
+	return e.Message
+}
+
+// ValueOperation computes the new value of a cubby from its current value and
+// the request body, inside the same transaction that persists it.
+type ValueOperation struct {
+	Name  string
+	Apply func(current []byte, body []byte) ([]byte, error)
+	// Replaces indicates that the request body becomes the whole new value,
+	// so the request's Content-Type always applies.
+	Replaces bool
+	// BodyIsPatch indicates that the request's Content-Type describes the
+	// patch format rather than the resulting value.
+	BodyIsPatch bool
+	// RequiresJSON indicates that the operation only applies to existing
+	// cubbies holding JSON.
+	RequiresJSON bool
+	// ReturnsValue indicates that the new value is sent back in the response.
+	ReturnsValue bool
+	// DefaultContentType is used for new cubbies when the request doesn't
+	// specify a content type.
+	DefaultContentType string
+}
+
+var ReplaceOperation = ValueOperation{
+	Name:     "replace",
+	Replaces: true,
+	Apply: func(current []byte, body []byte) ([]byte, error) {
+		return body, nil
+	},
+}
+
+// CounterOperation atomically adds delta to an integer value, treating a
+// missing or empty value as zero.
+func CounterOperation(delta int64) ValueOperation {
+	return ValueOperation{
+		Name:               "counter",
+		ReturnsValue:       true,
+		DefaultContentType: "text/plain",
+		Apply: func(current []byte, body []byte) ([]byte, error) {
+			var n int64
+			if trimmed := strings.TrimSpace(string(current)); trimmed != "" {
+				var err error
+				n, err = strconv.ParseInt(trimmed, 10, 64)
+				if err != nil {
+					return nil, &OperationError{http.StatusConflict, "Value is not an integer"}
+				}
+			}
+			if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+				return nil, &OperationError{http.StatusConflict, "Counter overflow"}
+			}
+			return []byte(strconv.FormatInt(n+delta, 10)), nil
+		},
+	}
+}
+
+// AppendOperation atomically appends the request body to the current value,
+// optionally separating entries with a newline, and optionally truncating the
+// result to its last maxLines lines and/or maxBytes bytes (0 means no limit)
+// so that the cubby can be used as a rolling log.
+func AppendOperation(newline bool, maxLines int, maxBytes int) ValueOperation {
+	return ValueOperation{
+		Name:               "append",
+		DefaultContentType: "text/plain",
+		Apply: func(current []byte, body []byte) ([]byte, error) {
+			value := append([]byte{}, current...)
+			if newline && len(value) > 0 && !bytes.HasSuffix(value, []byte("\n")) {
+				value = append(value, '\n')
+			}
+			value = append(value, body...)
+
+			if maxLines > 0 {
+				value = lastLines(value, maxLines)
+			}
+			if maxBytes > 0 && len(value) > maxBytes {
+				cut := len(value) - maxBytes
+				// avoid keeping a partial line at the start
+				partial := newline && value[cut-1] != '\n'
+				value = value[cut:]
+				if partial {
+					if i := bytes.IndexByte(value, '\n'); i >= 0 {
+						value = value[i+1:]
+					}
+				}
+			}
+			return value, nil
+		},
+	}
+}
+
+// lastLines returns the suffix of value containing its last n lines, where a
+// trailing newline doesn't start a new line.
+func lastLines(value []byte, n int) []byte {
+	end := len(value)
+	if bytes.HasSuffix(value, []byte("\n")) {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if value[i] == '\n' {
+			n--
+			if n == 0 {
+				return value[i+1:]
+			}
+		}
+	}
+	return value
+}
+
+// PatchOperation applies a JSON merge patch (RFC 7396) or JSON Patch
+// (RFC 6902), depending on patchType, to a JSON cubby.
+func PatchOperation(patchType string) (ValueOperation, error) {
+	var patch func(doc any, body []byte) (any, error)
+	switch mediaType(patchType) {
+	case MERGE_PATCH_CONTENT_TYPE:
+		patch = func(doc any, body []byte) (any, error) {
+			mergePatch, err := decodeJSON(body)
+			if err != nil {
+				return nil, patchError(ErrInvalidPatch, "%v", err)
+			}
+			return MergePatch(doc, mergePatch), nil
+		}
+	case JSON_PATCH_CONTENT_TYPE:
+		patch = func(doc any, body []byte) (any, error) {
+			var ops []PatchOp
+			if err := json.Unmarshal(body, &ops); err != nil {
+				return nil, patchError(ErrInvalidPatch, "%v", err)
+			}
+			return ApplyJSONPatch(doc, ops)
+		}
+	default:
+		return ValueOperation{}, &OperationError{http.StatusUnsupportedMediaType,
+			"PATCH requires " + MERGE_PATCH_CONTENT_TYPE + " or " + JSON_PATCH_CONTENT_TYPE}
+	}
+
+	return ValueOperation{
+		Name:         "patch",
+		BodyIsPatch:  true,
+		RequiresJSON: true,
+		ReturnsValue: true,
+		Apply: func(current []byte, body []byte) ([]byte, error) {
+			doc, err := decodeJSON(current)
+			if err != nil {
+				return nil, &OperationError{http.StatusConflict, "Stored value is not valid JSON"}
+			}
+			doc, err = patch(doc, body)
+			if errors.Is(err, ErrInvalidPatch) {
+				return nil, &OperationError{http.StatusUnprocessableEntity, err.Error()}
+			} else if err != nil {
+				return nil, &OperationError{http.StatusConflict, err.Error()}
+			}
+			return encodeJSON(doc)
+		},
+	}, nil
+}
+
+func parseLimit(query url.Values, param string) (int, error) {
+	value := query.Get(param)
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", param, value)
+	}
+	return limit, nil
+}
+
+func parseDelta(query url.Values, param string) (int64, error) {
+	value := query.Get(param)
+	if value == "" {
+		return 1, nil
+	}
+	delta, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s amount: %s", param, value)
+	}
+	return delta, nil
+}
+
+// ParseValueOperation determines the write operation requested via the
+// method and query parameters, defaulting to replacing the value with the
+// request body.
+func ParseValueOperation(r *http.Request) (ValueOperation, error) {
+	if r.Method == http.MethodPatch {
+		return PatchOperation(r.Header.Get("Content-Type"))
+	}
+
+	query := r.URL.Query()
+	if r.Method == http.MethodPut {
+		// PUT is idempotent, so it always replaces the value
+		for _, name := range []string{"incr", "decr", "append"} {
+			if _, ok := query[name]; ok {
+				return ValueOperation{}, &OperationError{http.StatusBadRequest, "PUT always replaces the value, use POST to " + name}
+			}
+		}
+		return ReplaceOperation, nil
+	}
+	if _, ok := query["incr"]; ok {
+		delta, err := parseDelta(query, "incr")
+		return CounterOperation(delta), err
+	}
+	if _, ok := query["decr"]; ok {
+		delta, err := parseDelta(query, "decr")
+		return CounterOperation(-delta), err
+	}
+	if _, ok := query["append"]; ok {
+		maxLines, err := parseLimit(query, "maxlines")
+		if err != nil {
+			return ValueOperation{}, err
+		}
+		maxBytes, err := parseLimit(query, "maxbytes")
+		if err != nil {
+			return ValueOperation{}, err
+		}
+		_, newline := query["newline"]
+		return AppendOperation(newline, maxLines, maxBytes), nil
+	}
+	return ReplaceOperation, nil
+}
+
+// CheckPreconditions evaluates compare-and-swap style conditions against the
+// current state of a cubby: the standard If-Match and If-None-Match headers
+// (against its ETag), and a cas parameter holding the expected current value.
+func CheckPreconditions(r *http.Request, metadata *CubbyMetadata, current []byte) *OperationError {
+	exists := !metadata.Empty()
+	failed := &OperationError{http.StatusPreconditionFailed, "Precondition Failed"}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !exists || (ifMatch != "*" && !etagListContains(ifMatch, ETag(current))) {
+			return failed
+		}
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if exists && (ifNoneMatch == "*" || etagListContains(ifNoneMatch, ETag(current))) {
+			return failed
+		}
+	}
+	if expected, ok := r.URL.Query()["cas"]; ok {
+		if !exists || !bytes.Equal(current, []byte(expected[0])) {
+			return failed
+		}
+	}
+	return nil
+}
+
+func etagListContains(list string, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
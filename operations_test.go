@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCounterOperation(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		delta   int64
+		want    string
+		status  int
+	}{
+		{"missing value", "", 1, "1", 0},
+		{"whitespace only", " \n", 5, "5", 0},
+		{"surrounding whitespace", " 41\n", 1, "42", 0},
+		{"explicit sign", "+7", 1, "8", 0},
+		{"zero delta", "7", 0, "7", 0},
+		{"below zero", "3", -5, "-2", 0},
+		{"large delta", "0", math.MaxInt64, strconv.FormatInt(math.MaxInt64, 10), 0},
+		{"reaches maximum", strconv.FormatInt(math.MaxInt64-1, 10), 1, strconv.FormatInt(math.MaxInt64, 10), 0},
+		{"reaches minimum", strconv.FormatInt(math.MinInt64+1, 10), -1, strconv.FormatInt(math.MinInt64, 10), 0},
+		{"up from minimum", strconv.FormatInt(math.MinInt64, 10), math.MaxInt64, "-1", 0},
+		{"overflow", strconv.FormatInt(math.MaxInt64, 10), 1, "", http.StatusConflict},
+		{"underflow", strconv.FormatInt(math.MinInt64, 10), -1, "", http.StatusConflict},
+		{"out of range value", "9223372036854775808", -1, "", http.StatusConflict},
+		{"decimal", "1.5", 1, "", http.StatusConflict},
+		{"hexadecimal", "0x10", 1, "", http.StatusConflict},
+		{"inner whitespace", "1 2", 1, "", http.StatusConflict},
+		{"text", "hello", 1, "", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CounterOperation(tt.delta).Apply([]byte(tt.current), nil)
+			var opErr *OperationError
+			if tt.status != 0 {
+				if !errors.As(err, &opErr) || opErr.Status != tt.status {
+					t.Errorf("Apply = %q, %v, want status %d", got, err, tt.status)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Errorf("Apply = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDelta(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int64
+		ok    bool
+	}{
+		{"incr", 1, true},
+		{"incr=", 1, true},
+		{"incr=5", 5, true},
+		{"incr=-3", -3, true},
+		{"incr=0", 0, true},
+		{"incr=9223372036854775807", math.MaxInt64, true},
+		{"incr=9223372036854775808", 0, false},
+		{"incr=1.5", 0, false},
+		{"incr=one", 0, false},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := parseDelta(query, "incr")
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseDelta(%q) = %d, %v", tt.query, got, err)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	current := []byte("v1")
+	etag := ETag(current)
+	existing := &CubbyMetadata{ContentType: "text/plain", UpdatedAt: time.Now()}
+	missing := &CubbyMetadata{}
+
+	tests := []struct {
+		name     string
+		target   string
+		header   http.Header
+		metadata *CubbyMetadata
+		current  string
+		ok       bool
+	}{
+		{"no conditions", "/k", nil, existing, "v1", true},
+		{"if-match", "/k", http.Header{"If-Match": {etag}}, existing, "v1", true},
+		{"if-match in list", "/k", http.Header{"If-Match": {`"other", ` + etag}}, existing, "v1", true},
+		{"if-match weak", "/k", http.Header{"If-Match": {"W/" + etag}}, existing, "v1", true},
+		{"if-match stale", "/k", http.Header{"If-Match": {etag}}, existing, "v2", false},
+		{"if-match any", "/k", http.Header{"If-Match": {"*"}}, existing, "v1", true},
+		{"if-match any missing", "/k", http.Header{"If-Match": {"*"}}, missing, "", false},
+		{"if-match empty value missing", "/k", http.Header{"If-Match": {ETag(nil)}}, missing, "", false},
+		{"if-none-match any", "/k", http.Header{"If-None-Match": {"*"}}, existing, "v1", false},
+		{"if-none-match any missing", "/k", http.Header{"If-None-Match": {"*"}}, missing, "", true},
+		{"if-none-match current", "/k", http.Header{"If-None-Match": {etag}}, existing, "v1", false},
+		{"if-none-match stale", "/k", http.Header{"If-None-Match": {etag}}, existing, "v2", true},
+		{"cas", "/k?cas=v1", nil, existing, "v1", true},
+		{"cas stale", "/k?cas=v1", nil, existing, "v2", false},
+		{"cas empty value", "/k?cas=", nil, existing, "", true},
+		{"cas missing", "/k?cas=", nil, missing, "", false},
+		{"cas and stale if-match", "/k?cas=v1", http.Header{"If-Match": {`"other"`}}, existing, "v1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			err := CheckPreconditions(r, tt.metadata, []byte(tt.current))
+			if tt.ok && err != nil {
+				t.Errorf("CheckPreconditions failed: %v", err)
+			} else if !tt.ok && (err == nil || err.Status != http.StatusPreconditionFailed) {
+				t.Errorf("CheckPreconditions = %v, want %d", err, http.StatusPreconditionFailed)
+			}
+		})
+	}
+}
+
+func TestAppendOperation(t *testing.T) {
+	tests := []struct {
+		name     string
+		newline  bool
+		maxLines int
+		maxBytes int
+		current  string
+		body     string
+		want     string
+	}{
+		{"missing value", false, 0, 0, "", "a", "a"},
+		{"concatenates", false, 0, 0, "ab", "cd", "abcd"},
+		{"empty body", false, 0, 0, "ab", "", "ab"},
+		{"no separator before first entry", true, 0, 0, "", "a", "a"},
+		{"newline separator", true, 0, 0, "a", "b", "a\nb"},
+		{"existing trailing newline", true, 0, 0, "a\n", "b", "a\nb"},
+		{"body with own newline", true, 0, 0, "a", "b\n", "a\nb\n"},
+		{"empty body with newline", true, 0, 0, "a", "", "a\n"},
+		{"max lines", true, 2, 0, "1\n2\n3", "4", "3\n4"},
+		{"max lines with trailing newline", true, 2, 0, "1\n2\n", "3\n", "2\n3\n"},
+		{"max lines from a multi-line body", true, 1, 0, "1", "2\n3", "3"},
+		{"fewer lines than max", true, 5, 0, "1", "2", "1\n2"},
+		{"max lines keeps empty lines", false, 2, 0, "a\n\n", "b", "\nb"},
+		{"max bytes", false, 0, 5, "hello", "world", "world"},
+		{"max bytes splits a line", false, 0, 3, "one\n", "two", "two"},
+		{"max bytes mid-line without newline", false, 0, 4, "abc", "def", "cdef"},
+		{"value within max bytes", true, 0, 100, "a", "b", "a\nb"},
+		{"value exactly max bytes", true, 0, 3, "a", "b", "a\nb"},
+		{"max bytes cut on a newline", true, 0, 6, "one\ntwo", "three", "three"},
+		{"max bytes drops partial line", true, 0, 7, "one\ntwo", "three", "three"},
+		{"max bytes cut at a line start", true, 0, 9, "one\ntwo", "three", "two\nthree"},
+		{"max bytes cut at the last line start", true, 0, 5, "one\ntwo", "three", "three"},
+		{"max bytes cut at a line start with trailing newline", true, 0, 4, "one\n", "two\n", "two\n"},
+		{"max bytes within the last line", true, 0, 3, "", "abcdef", "def"},
+		{"max lines then bytes", true, 1, 4, "a", "bcdefg", "defg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AppendOperation(tt.newline, tt.maxLines, tt.maxBytes).Apply([]byte(tt.current), []byte(tt.body))
+			if err != nil || string(got) != tt.want {
+				t.Errorf("Apply = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	tests := []struct {
+		value string
+		n     int
+		want  string
+	}{
+		{"", 1, ""},
+		{"\n", 1, "\n"},
+		{"a", 1, "a"},
+		{"a\n", 1, "a\n"},
+		{"a\nb", 1, "b"},
+		{"a\nb\n", 1, "b\n"},
+		{"a\nb\n", 2, "a\nb\n"},
+		{"a\n\nb", 2, "\nb"},
+		{"a\nb\nc", 5, "a\nb\nc"},
+		{"\n\n", 1, "\n"},
+	}
+	for _, tt := range tests {
+		if got := lastLines([]byte(tt.value), tt.n); string(got) != tt.want {
+			t.Errorf("lastLines(%q, %d) = %q, want %q", tt.value, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+		ok    bool
+	}{
+		{"", 0, true},
+		{"maxlines=", 0, true},
+		{"maxlines=0", 0, true},
+		{"maxlines=10", 10, true},
+		{"maxlines=-1", 0, false},
+		{"maxlines=1e3", 0, false},
+		{"maxlines=ten", 0, false},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := parseLimit(query, "maxlines")
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseLimit(%q) = %d, %v", tt.query, got, err)
+		}
+	}
+}
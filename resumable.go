@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	UPLOADS_BUCKET         = "uploads"
+	UPLOAD_CHUNKS_BUCKET   = "upload_chunks"
+	UPLOAD_EXPIRY          = 24 * time.Hour
+	UPLOAD_PURGE_INTERVAL  = time.Hour
+	UPLOAD_OFFSET_HEADER   = "Upload-Offset"
+	UPLOAD_LENGTH_HEADER   = "Upload-Length"
+	UPLOAD_EXPIRES_HEADER  = "Upload-Expires"
+	UPLOAD_CHUNK_MEDIATYPE = "application/offset+octet-stream"
+)
+
+// UploadSession is a resumable upload in progress. Its data is staged in
+// chunks (keyed by upload ID and offset) until Length bytes have been
+// received, at which point it is written to Key like a regular POST with the
+// headers the upload was created with.
+type UploadSession struct {
+	ID        string
+	Key       string
+	Length    int64
+	Offset    int64
+	Header    http.Header
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// uploadHeaders keeps the headers of an upload's creation request that apply
+// to the final write.
+func uploadHeaders(header http.Header) http.Header {
+	kept := http.Header{}
+	for name, values := range header {
+		switch {
+		case name == "Content-Type", name == CUBBY_READER_HEADER, name == CUBBY_WRITER_HEADER,
+			name == CUBBY_TAGS_HEADER, name == CUBBY_META_HEADER, strings.HasPrefix(name, CUBBY_META_HEADER_PREFIX):
+			kept[name] = values
+		}
+	}
+	return kept
+}
+
+func chunkKey(id string, offset int64) []byte {
+	return []byte(fmt.Sprintf("%s/%016x", id, offset))
+}
+
+func (c *CubbyServer) getUploadSession(id string, tx *bolt.Tx) *UploadSession {
+	var session UploadSession
+	if !c.getSealedGob(UPLOADS_BUCKET, []byte(id), &session, tx) {
+		return nil
+	}
+	return &session
+}
+
+// deleteUploadSession removes an upload and its staged chunks.
+func (c *CubbyServer) deleteUploadSession(id string, tx *bolt.Tx) error {
+	chunks := tx.Bucket([]byte(UPLOAD_CHUNKS_BUCKET))
+	prefix := []byte(id + "/")
+	var keys [][]byte
+	cursor := chunks.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	for _, k := range keys {
+		if err := chunks.Delete(k); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(UPLOADS_BUCKET)).Delete([]byte(id))
+}
+
+// assembleUpload joins an upload's staged chunks in offset order.
+func (c *CubbyServer) assembleUpload(session *UploadSession, tx *bolt.Tx) ([]byte, error) {
+	value := make([]byte, 0, session.Length)
+	prefix := []byte(session.ID + "/")
+	cursor := tx.Bucket([]byte(UPLOAD_CHUNKS_BUCKET)).Cursor()
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		chunk, err := c.unseal(v)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, chunk...)
+	}
+	if int64(len(value)) != session.Length {
+		return nil, fmt.Errorf("upload %s has %d bytes staged, expected %d", session.ID, len(value), session.Length)
+	}
+	return value, nil
+}
+
+// PurgeUploads removes uploads that expired before cutoff, along with their
+// staged data.
+func (c *CubbyServer) PurgeUploads(cutoff time.Time) (int, error) {
+	purged := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		var expired []string
+		tx.Bucket([]byte(UPLOADS_BUCKET)).ForEach(func(k, v []byte) error {
+			session := c.getUploadSession(string(k), tx)
+			if session == nil || session.ExpiresAt.Before(cutoff) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+		for _, id := range expired {
+			if err := c.deleteUploadSession(id, tx); err != nil {
+				return err
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+	return purged, err
+}
+
+// StartUploads periodically garbage collects abandoned uploads.
+func (c *CubbyServer) StartUploads() {
+	go func() {
+		for {
+			purged, err := c.PurgeUploads(time.Now())
+			if err != nil {
+				c.log.Printf("Error purging uploads: %v", err)
+			} else if purged > 0 {
+				c.log.Printf("Purged %d expired uploads", purged)
+			}
+			time.Sleep(UPLOAD_PURGE_INTERVAL)
+		}
+	}()
+}
+
+func writeUploadHeaders(w http.ResponseWriter, session *UploadSession) {
+	w.Header().Set(UPLOAD_OFFSET_HEADER, strconv.FormatInt(session.Offset, 10))
+	w.Header().Set(UPLOAD_LENGTH_HEADER, strconv.FormatInt(session.Length, 10))
+	w.Header().Set(UPLOAD_EXPIRES_HEADER, session.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// UploadsHandler implements resumable uploads, for large values over
+// unreliable connections:
+//
+//	POST   /_uploads?key=<key>   create an upload of Upload-Length bytes
+//	HEAD   /_uploads/<id>        get the Upload-Offset to resume from
+//	PATCH  /_uploads/<id>        append the body at Upload-Offset
+//	DELETE /_uploads/<id>        abandon an upload
+//
+// The Content-Type, reader/writer and user metadata headers given on creation
+// apply to the key. Once the last byte arrives the value is written to the key
+// in the same transaction. Uploads expire a day after their last chunk.
+func (c *CubbyServer) UploadsHandler(w http.ResponseWriter, r *http.Request, user User) {
+	// auth check: disallow public writes
+	if _, ok := user.(*AnonymousUser); ok {
+		log.Println("Unauthorized upload attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized Writer", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/_uploads"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		c.createUpload(w, r, user)
+
+	case id != "" && (r.Method == http.MethodHead || r.Method == http.MethodGet):
+		c.db.View(func(tx *bolt.Tx) error {
+			session := c.getUploadSession(id, tx)
+			if session == nil || session.Owner != user.Name() {
+				http.NotFound(w, r)
+				return nil
+			}
+			writeUploadHeaders(w, session)
+			w.WriteHeader(http.StatusOK)
+			return nil
+		})
+
+	case id != "" && r.Method == http.MethodPatch:
+		c.patchUpload(w, r, id, user)
+
+	case id != "" && r.Method == http.MethodDelete:
+		c.db.Update(func(tx *bolt.Tx) error {
+			session := c.getUploadSession(id, tx)
+			if session == nil || session.Owner != user.Name() {
+				http.NotFound(w, r)
+				return nil
+			}
+			if err := c.deleteUploadSession(id, tx); err != nil {
+				http.Error(w, "Could not delete upload", http.StatusInternalServerError)
+				return err
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		})
+
+	default:
+		http.Error(w, "Invalid upload action", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *CubbyServer) createUpload(w http.ResponseWriter, r *http.Request, user User) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "A key to upload to is required", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get(UPLOAD_LENGTH_HEADER), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid "+UPLOAD_LENGTH_HEADER+" header", http.StatusBadRequest)
+		return
+	}
+	if length > c.maxObjectSize {
+		http.Error(w, "Value exceeds the maximum object size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// catch bad metadata now rather than after the upload
+	if err := (&CubbyMetadata{}).UpdateUserMetadata(r.Header); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session := &UploadSession{
+		ID:        randomHex(16),
+		Key:       key,
+		Length:    length,
+		Header:    uploadHeaders(r.Header),
+		Owner:     user.Name(),
+		ExpiresAt: time.Now().Add(UPLOAD_EXPIRY),
+	}
+	var event *ChangeEvent
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		metadata, err := c.GetMetadata(key, tx)
+		if err != nil {
+			return err
+		}
+		// auth check: writer allowlist
+		if !metadata.Empty() && !user.InGroup(metadata.Writers) {
+			log.Println("Unauthorized overwrite attempt")
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			http.Error(w, "Unauthorized Overwrite", http.StatusUnauthorized)
+			return nil
+		}
+
+		// an empty upload is complete as soon as it is created
+		if length == 0 {
+			var err error
+			event, err = c.finishUpload(session, []byte{}, tx)
+			if err != nil {
+				return err
+			}
+			w.Header().Set("Location", "/"+(&url.URL{Path: key}).EscapedPath())
+			w.WriteHeader(http.StatusCreated)
+			return nil
+		}
+
+		if err := c.putSealedGob(UPLOADS_BUCKET, []byte(session.ID), session, tx); err != nil {
+			return err
+		}
+		writeUploadHeaders(w, session)
+		w.Header().Set("Location", "/_uploads/"+session.ID)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	})
+	if writeSchemaError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Error creating upload: %v", err)
+		http.Error(w, "Could not create upload", http.StatusInternalServerError)
+		return
+	}
+	c.publish(event)
+}
+
+func (c *CubbyServer) patchUpload(w http.ResponseWriter, r *http.Request, id string, user User) {
+	if mediaType(r.Header.Get("Content-Type")) != UPLOAD_CHUNK_MEDIATYPE {
+		http.Error(w, "Chunks must be sent as "+UPLOAD_CHUNK_MEDIATYPE, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(UPLOAD_OFFSET_HEADER), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid "+UPLOAD_OFFSET_HEADER+" header", http.StatusBadRequest)
+		return
+	}
+
+	var session *UploadSession
+	c.db.View(func(tx *bolt.Tx) error {
+		session = c.getUploadSession(id, tx)
+		return nil
+	})
+	if session == nil || session.Owner != user.Name() {
+		http.NotFound(w, r)
+		return
+	}
+	if offset != session.Offset {
+		writeUploadHeaders(w, session)
+		http.Error(w, "Offset does not match the upload", http.StatusConflict)
+		return
+	}
+
+	// keep whatever arrived before a dropped connection, so that the client
+	// can resume from there
+	r.Body = http.MaxBytesReader(w, r.Body, session.Length-session.Offset)
+	chunk, err := io.ReadAll(r.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "Chunk exceeds the upload length", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Printf("Error reading upload chunk, keeping %d bytes: %v", len(chunk), err)
+	}
+
+	var event *ChangeEvent
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		// another request may have advanced the upload while this one was
+		// reading its body
+		session = c.getUploadSession(id, tx)
+		if session == nil {
+			http.NotFound(w, r)
+			return nil
+		}
+		if offset != session.Offset {
+			writeUploadHeaders(w, session)
+			http.Error(w, "Offset does not match the upload", http.StatusConflict)
+			return nil
+		}
+
+		complete := session.Offset+int64(len(chunk)) == session.Length
+		// auth check: writer allowlist (again, in case it changed)
+		metadata, err := c.GetMetadata(session.Key, tx)
+		if err != nil {
+			return err
+		}
+		if complete && !metadata.Empty() && !user.InGroup(metadata.Writers) {
+			log.Println("Unauthorized overwrite attempt")
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			http.Error(w, "Unauthorized Overwrite", http.StatusUnauthorized)
+			return nil
+		}
+
+		if len(chunk) > 0 {
+			sealed, err := c.seal(chunk)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(UPLOAD_CHUNKS_BUCKET)).Put(chunkKey(id, offset), sealed); err != nil {
+				return err
+			}
+		}
+		session.Offset += int64(len(chunk))
+		session.ExpiresAt = time.Now().Add(UPLOAD_EXPIRY)
+
+		if !complete {
+			if err := c.putSealedGob(UPLOADS_BUCKET, []byte(id), session, tx); err != nil {
+				return err
+			}
+			writeUploadHeaders(w, session)
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+
+		value, err := c.assembleUpload(session, tx)
+		if err != nil {
+			return err
+		}
+		event, err = c.finishUpload(session, value, tx)
+		if err != nil {
+			return err
+		}
+		if err := c.deleteUploadSession(id, tx); err != nil {
+			return err
+		}
+		writeUploadHeaders(w, session)
+		w.Header().Set("ETag", ETag(value))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+	if writeSchemaError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Error persisting upload chunk: %v", err)
+		http.Error(w, "Could not persist data", http.StatusInternalServerError)
+		return
+	}
+	if event != nil {
+		c.publish(event)
+		log.Printf("Finished upload of %d bytes to %s", session.Length, session.Key)
+	}
+}
+
+// finishUpload writes a completed upload to its key, applying the headers it
+// was created with.
+func (c *CubbyServer) finishUpload(session *UploadSession, value []byte, tx *bolt.Tx) (*ChangeEvent, error) {
+	metadata, err := c.GetMetadata(session.Key, tx)
+	if err != nil {
+		return nil, err
+	}
+	metadata.UpdateReaders(StringToGroup(session.Header.Get(CUBBY_READER_HEADER)))
+	metadata.UpdateWriters(StringToGroup(session.Header.Get(CUBBY_WRITER_HEADER)))
+	if err := metadata.UpdateUserMetadata(session.Header); err != nil {
+		return nil, err
+	}
+	metadata.SetContentType(session.Header.Get("Content-Type"))
+	metadata.MarkUpdated()
+	return c.CommitPut(session.Key, value, metadata, tx)
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	S3_XMLNS              = "http://s3.amazonaws.com/doc/2006-03-01/"
+	S3_TIME_FORMAT        = "2006-01-02T15:04:05.000Z"
+	S3_MAX_KEYS           = 1000
+	S3_META_HEADER        = "X-Amz-Meta-"
+	S3_COPY_SOURCE        = "X-Amz-Copy-Source"
+	S3_METADATA_REPLACE   = "REPLACE"
+	S3_METADATA_DIRECTIVE = "X-Amz-Metadata-Directive"
+)
+
+// S3Error is returned to S3 clients as an XML error document.
+type S3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *S3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errS3AccessDenied = &S3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3NoSuchKey    = &S3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errS3Internal     = &S3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error, please try again"}
+)
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding XML response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err *S3Error) {
+	if r.Method == http.MethodHead {
+		// HEAD responses can't have a body, so the status is all there is
+		w.WriteHeader(err.Status)
+		return
+	}
+	writeXML(w, err.Status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: err.Code, Message: err.Message, Resource: r.URL.Path})
+}
+
+// s3ETag is the hex MD5 of a value, which S3 clients check uploads against
+// (unlike cubby's own ETags).
+func s3ETag(value []byte) string {
+	sum := md5.Sum(value)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// s3Meta collects the x-amz-meta-* headers of a request as user metadata.
+func s3Meta(header http.Header) (map[string]string, *S3Error) {
+	meta := map[string]string{}
+	size := 0
+	for name, values := range header {
+		if strings.HasPrefix(name, S3_META_HEADER) && len(name) > len(S3_META_HEADER) {
+			name = strings.ToLower(strings.TrimPrefix(name, S3_META_HEADER))
+			meta[name] = values[0]
+			size += len(name) + len(values[0])
+		}
+	}
+	if size > MAX_USER_METADATA_SIZE {
+		return nil, &S3Error{http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size"}
+	}
+	return meta, nil
+}
+
+// s3Readers maps the canned ACLs onto cubby's reader groups. Without an ACL
+// (or with bucket-owner-full-control, which changes nothing) the key keeps its
+// readers. The other ACLs, including private (readable by the owner only),
+// can't be represented by the groups and are rejected.
+func s3Readers(header http.Header) (Group, *S3Error) {
+	switch acl := header.Get("X-Amz-Acl"); acl {
+	case "", "bucket-owner-full-control":
+		return UnknownGroup, nil
+	case "authenticated-read":
+		return UserGroup, nil
+	case "public-read":
+		return PublicGroup, nil
+	default:
+		return UnknownGroup, &S3Error{http.StatusBadRequest, "AccessControlListNotSupported", "The " + acl + " ACL is not supported, only authenticated-read and public-read are"}
+	}
+}
+
+// S3Handler serves a subset of the S3 API, for tools like the aws cli and
+// rclone. Buckets are the first segment of keys (ie. s3://photos/cat.png is
+// the key photos/cat.png) and exist as long as keys under them do. Requests
+// are authenticated with SigV4 signatures from access keys, or are anonymous
+// if unsigned, and are then subject to the usual reader/writer ACLs.
+//
+// Only path style addressing is supported (eg. http://host:port/bucket/key).
+func (c *CubbyServer) S3Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Amz-Request-Id", strings.ToUpper(randomHex(8)))
+	user, auth, s3err := c.authenticateS3(r)
+	if s3err != nil {
+		log.Printf("Rejected S3 request: %v", s3err)
+		writeS3Error(w, r, s3err)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if strings.HasPrefix(bucket, "_") {
+		writeS3Error(w, r, &S3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"})
+		return
+	}
+	query := r.URL.Query()
+	for _, unsupported := range []string{"uploads", "uploadId", "tagging", "acl", "versioning", "delete"} {
+		if _, ok := query[unsupported]; ok {
+			writeS3Error(w, r, &S3Error{http.StatusNotImplemented, "NotImplemented", "This operation is not supported by cubby"})
+			return
+		}
+	}
+
+	var err *S3Error
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		err = c.s3ListBuckets(w, user)
+	case bucket == "":
+		err = &S3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+	case key == "" && r.Method == http.MethodGet && query.Has("location"):
+		writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: S3_XMLNS})
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		err = c.s3ListObjectsV2(w, r, bucket, user)
+	case key == "" && (r.Method == http.MethodHead || r.Method == http.MethodPut):
+		// buckets are implicit, so they always exist and creating one is a
+		// no-op (it appears once there are keys in it)
+		w.WriteHeader(http.StatusOK)
+	case key == "":
+		err = &S3Error{http.StatusNotImplemented, "NotImplemented", "This operation is not supported by cubby"}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		err = c.s3GetObject(w, r, bucket+"/"+key, user)
+	case r.Method == http.MethodPut && r.Header.Get(S3_COPY_SOURCE) != "":
+		err = c.s3CopyObject(w, r, bucket+"/"+key, user)
+	case r.Method == http.MethodPut:
+		err = c.s3PutObject(w, r, bucket+"/"+key, user, auth)
+	case r.Method == http.MethodDelete:
+		err = c.s3DeleteObject(w, bucket+"/"+key, user)
+	default:
+		err = &S3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+	}
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+func (c *CubbyServer) s3ListBuckets(w http.ResponseWriter, user User) *S3Error {
+	if _, ok := user.(*AnonymousUser); ok {
+		return errS3AccessDenied
+	}
+
+	buckets := []s3Bucket{}
+	c.db.View(func(tx *bolt.Tx) error {
+		created := map[string]time.Time{}
+		for _, key := range c.List(tx) {
+			bucket, _, ok := strings.Cut(key, "/")
+			if !ok || strings.HasPrefix(bucket, "_") {
+				continue
+			}
+			metadata, err := c.GetMetadata(key, tx)
+			// auth check: reader allowlist
+			if err != nil || !user.InGroup(metadata.Readers) {
+				continue
+			}
+			// there's no record of when a bucket was created, so use its
+			// oldest key
+			if oldest, ok := created[bucket]; !ok {
+				buckets = append(buckets, s3Bucket{Name: bucket})
+				created[bucket] = metadata.UpdatedAt
+			} else if metadata.UpdatedAt.Before(oldest) {
+				created[bucket] = metadata.UpdatedAt
+			}
+		}
+		for i := range buckets {
+			buckets[i].CreationDate = created[buckets[i].Name].UTC().Format(S3_TIME_FORMAT)
+		}
+		return nil
+	})
+
+	type owner struct {
+		ID          string
+		DisplayName string
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		Owner   owner      `xml:"Owner"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: S3_XMLNS, Owner: owner{user.Name(), user.Name()}, Buckets: buckets})
+	return nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+func (c *CubbyServer) s3ListObjectsV2(w http.ResponseWriter, r *http.Request, bucket string, user User) *S3Error {
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := S3_MAX_KEYS
+	if query.Has("max-keys") {
+		var err error
+		maxKeys, err = strconv.Atoi(query.Get("max-keys"))
+		if err != nil || maxKeys < 0 {
+			return &S3Error{http.StatusBadRequest, "InvalidArgument", "Invalid max-keys"}
+		}
+		maxKeys = min(maxKeys, S3_MAX_KEYS)
+	}
+	// the continuation token is just the last key or common prefix returned
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return &S3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"}
+		}
+		after = string(decoded)
+	}
+
+	var objects []s3Object
+	var prefixes []s3CommonPrefix
+	last, truncated := "", false
+	c.db.View(func(tx *bolt.Tx) error {
+		for _, fullKey := range c.ListPrefix(bucket+"/"+prefix, tx) {
+			key := strings.TrimPrefix(fullKey, bucket+"/")
+			if key <= after || delimiter != "" && strings.HasSuffix(after, delimiter) && strings.HasPrefix(key, after) {
+				continue
+			}
+			metadata, err := c.GetMetadata(fullKey, tx)
+			// auth check: reader allowlist
+			if err != nil || metadata.Empty() || !user.InGroup(metadata.Readers) {
+				continue
+			}
+
+			commonPrefix := ""
+			if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				commonPrefix = key[:len(prefix)+i+len(delimiter)]
+				if commonPrefix == last {
+					continue
+				}
+			}
+			if len(objects)+len(prefixes) == maxKeys {
+				truncated = true
+				break
+			}
+
+			if commonPrefix != "" {
+				prefixes = append(prefixes, s3CommonPrefix{commonPrefix})
+				last = commonPrefix
+				continue
+			}
+			data, err := c.Get(fullKey, tx)
+			if err != nil {
+				continue
+			}
+			objects = append(objects, s3Object{
+				Key:          key,
+				LastModified: metadata.UpdatedAt.UTC().Format(S3_TIME_FORMAT),
+				ETag:         s3ETag(data),
+				Size:         len(data),
+				StorageClass: "STANDARD",
+			})
+			last = key
+		}
+		return nil
+	})
+
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = func(s string) string { return awsEscape(s, true) }
+	}
+	for i := range objects {
+		objects[i].Key = encode(objects[i].Key)
+	}
+	for i := range prefixes {
+		prefixes[i].Prefix = encode(prefixes[i].Prefix)
+	}
+	nextToken := ""
+	if truncated {
+		nextToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName               xml.Name         `xml:"ListBucketResult"`
+		Xmlns                 string           `xml:"xmlns,attr"`
+		Name                  string           `xml:"Name"`
+		Prefix                string           `xml:"Prefix"`
+		Delimiter             string           `xml:"Delimiter,omitempty"`
+		StartAfter            string           `xml:"StartAfter,omitempty"`
+		ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+		EncodingType          string           `xml:"EncodingType,omitempty"`
+		MaxKeys               int              `xml:"MaxKeys"`
+		KeyCount              int              `xml:"KeyCount"`
+		IsTruncated           bool             `xml:"IsTruncated"`
+		Contents              []s3Object       `xml:"Contents"`
+		CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+	}{
+		Xmlns:                 S3_XMLNS,
+		Name:                  bucket,
+		Prefix:                encode(prefix),
+		Delimiter:             encode(delimiter),
+		StartAfter:            encode(query.Get("start-after")),
+		ContinuationToken:     query.Get("continuation-token"),
+		NextContinuationToken: nextToken,
+		EncodingType:          query.Get("encoding-type"),
+		MaxKeys:               maxKeys,
+		KeyCount:              len(objects) + len(prefixes),
+		IsTruncated:           truncated,
+		Contents:              objects,
+		CommonPrefixes:        prefixes,
+	})
+	return nil
+}
+
+func (c *CubbyServer) s3GetObject(w http.ResponseWriter, r *http.Request, key string, user User) *S3Error {
+	var metadata *CubbyMetadata
+	var data []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		if metadata, err = c.GetMetadata(key, tx); err != nil {
+			return err
+		}
+		data, err = c.Get(key, tx)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error reading key %s: %v", key, err)
+		return errS3Internal
+	}
+	if metadata.Empty() {
+		return errS3NoSuchKey
+	}
+	// auth check: reader allowlist
+	if !user.InGroup(metadata.Readers) {
+		return errS3AccessDenied
+	}
+
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", s3ETag(data))
+	for name, value := range metadata.Meta {
+		w.Header().Set(S3_META_HEADER+name, value)
+	}
+	// handles ranges, conditional requests and HEAD
+	http.ServeContent(w, r, "", metadata.UpdatedAt, bytes.NewReader(data))
+	return nil
+}
+
+// s3Put writes value to key as PutObject (and CopyObject when replacing
+// metadata) do: the content type, user metadata and canned ACL come from the
+// request headers.
+func (c *CubbyServer) s3Put(r *http.Request, key string, value []byte, user User, tx *bolt.Tx) (*ChangeEvent, error) {
+	metadata, err := c.GetMetadata(key, tx)
+	if err != nil {
+		return nil, err
+	}
+	// auth check: writer allowlist
+	if !metadata.Empty() && !user.InGroup(metadata.Writers) {
+		return nil, errS3AccessDenied
+	}
+	if int64(len(value)) > c.maxObjectSize {
+		return nil, &S3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size"}
+	}
+	meta, s3err := s3Meta(r.Header)
+	if s3err != nil {
+		return nil, s3err
+	}
+	readers, s3err := s3Readers(r.Header)
+	if s3err != nil {
+		return nil, s3err
+	}
+
+	metadata.UpdateReaders(readers)
+	metadata.UpdateWriters(UnknownGroup)
+	metadata.Meta = meta
+	metadata.SetContentType(r.Header.Get("Content-Type"))
+	metadata.MarkUpdated()
+
+	event, err := c.CommitPut(key, value, metadata, tx)
+	var schemaErr *SchemaError
+	if errors.As(err, &schemaErr) {
+		return nil, &S3Error{http.StatusBadRequest, "InvalidArgument", "Value does not match schema " + schemaErr.Schema + ": " + strings.Join(schemaErr.Errors, "; ")}
+	}
+	return event, err
+}
+
+// s3Commit runs an S3 write, publishing its events and translating errors.
+func (c *CubbyServer) s3Commit(fn func(tx *bolt.Tx) ([]*ChangeEvent, error)) *S3Error {
+	var events []*ChangeEvent
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		events, err = fn(tx)
+		return err
+	})
+	var s3err *S3Error
+	if errors.As(err, &s3err) {
+		return s3err
+	} else if err != nil {
+		log.Printf("Error persisting S3 write: %v", err)
+		return errS3Internal
+	}
+	for _, event := range events {
+		c.publish(event)
+	}
+	return nil
+}
+
+func (c *CubbyServer) s3PutObject(w http.ResponseWriter, r *http.Request, key string, user User, auth *sigV4) *S3Error {
+	// auth check: disallow public writes
+	if _, ok := user.(*AnonymousUser); ok {
+		return errS3AccessDenied
+	}
+	value, s3err := readS3Body(r, auth, c.maxObjectSize)
+	if s3err != nil {
+		return s3err
+	}
+	if contentMD5 := r.Header.Get("Content-Md5"); contentMD5 != "" {
+		sum := md5.Sum(value)
+		if contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			return &S3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received"}
+		}
+	}
+
+	s3err = c.s3Commit(func(tx *bolt.Tx) ([]*ChangeEvent, error) {
+		event, err := c.s3Put(r, key, value, user, tx)
+		return []*ChangeEvent{event}, err
+	})
+	if s3err != nil {
+		return s3err
+	}
+	w.Header().Set("ETag", s3ETag(value))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (c *CubbyServer) s3CopyObject(w http.ResponseWriter, r *http.Request, key string, user User) *S3Error {
+	// auth check: disallow public writes
+	if _, ok := user.(*AnonymousUser); ok {
+		return errS3AccessDenied
+	}
+	source, err := url.PathUnescape(r.Header.Get(S3_COPY_SOURCE))
+	if err != nil {
+		return &S3Error{http.StatusBadRequest, "InvalidArgument", "Invalid copy source"}
+	}
+	source, _, _ = strings.Cut(strings.TrimPrefix(source, "/"), "?versionId=")
+	if bucket, _, _ := strings.Cut(source, "/"); strings.HasPrefix(bucket, "_") {
+		return &S3Error{http.StatusBadRequest, "InvalidArgument", "Invalid copy source"}
+	}
+
+	var value []byte
+	var updatedAt time.Time
+	s3err := c.s3Commit(func(tx *bolt.Tx) ([]*ChangeEvent, error) {
+		if !strings.EqualFold(r.Header.Get(S3_METADATA_DIRECTIVE), S3_METADATA_REPLACE) {
+			_, events, err := c.CopyKey(source, key, false, true, user, tx)
+			var copyErr *CopyError
+			if errors.As(err, &copyErr) && copyErr.Status == http.StatusNotFound {
+				return nil, errS3NoSuchKey
+			} else if errors.As(err, &copyErr) && copyErr.Status == http.StatusUnauthorized {
+				return nil, errS3AccessDenied
+			} else if err != nil {
+				return nil, err
+			}
+			copied, err := c.GetMetadata(key, tx)
+			if err != nil {
+				return nil, err
+			}
+			value, err = c.Get(key, tx)
+			updatedAt = copied.UpdatedAt
+			return events, err
+		}
+
+		metadata, err := c.GetMetadata(source, tx)
+		if err != nil {
+			return nil, err
+		}
+		if metadata.Empty() {
+			return nil, errS3NoSuchKey
+		}
+		// auth check: reader allowlist on the source
+		if !user.InGroup(metadata.Readers) {
+			return nil, errS3AccessDenied
+		}
+		if value, err = c.Get(source, tx); err != nil {
+			return nil, err
+		}
+		event, err := c.s3Put(r, key, value, user, tx)
+		updatedAt = time.Now()
+		return []*ChangeEvent{event}, err
+	})
+	if s3err != nil {
+		return s3err
+	}
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		LastModified string
+		ETag         string
+	}{Xmlns: S3_XMLNS, LastModified: updatedAt.UTC().Format(S3_TIME_FORMAT), ETag: s3ETag(value)})
+	return nil
+}
+
+func (c *CubbyServer) s3DeleteObject(w http.ResponseWriter, key string, user User) *S3Error {
+	// auth check: disallow public deletes
+	if _, ok := user.(*AnonymousUser); ok {
+		return errS3AccessDenied
+	}
+	s3err := c.s3Commit(func(tx *bolt.Tx) ([]*ChangeEvent, error) {
+		metadata, err := c.GetMetadata(key, tx)
+		if err != nil {
+			return nil, err
+		}
+		// deleting a missing key succeeds in S3
+		if metadata.Empty() {
+			return nil, nil
+		}
+		// auth check: writer allowlist
+		if !user.InGroup(metadata.Writers) {
+			return nil, errS3AccessDenied
+		}
+		event, err := c.CommitTrash(key, metadata, user.Name(), tx)
+		return []*ChangeEvent{event}, err
+	})
+	if s3err != nil {
+		return s3err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signS3 signs a request with the access key's SigV4 signature, returning
+// the signing state that streaming chunk signatures chain from.
+func signS3(r *http.Request, key *AccessKey, payloadHash string, at time.Time) *sigV4 {
+	amzDate := at.UTC().Format(SIGV4_TIME_FORMAT)
+	auth := &sigV4{date: amzDate, scope: amzDate[:8] + "/us-east-1/s3/aws4_request", signingKey: []byte("AWS4" + key.Secret)}
+	for _, part := range strings.Split(auth.scope, "/") {
+		auth.signingKey = hmacSHA256(auth.signingKey, part)
+	}
+
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsEscape(r.URL.Path, true),
+		canonicalQuery(r.URL.Query()),
+		"host:" + r.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{SIGV4_ALGORITHM, amzDate, auth.scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	auth.signature = hex.EncodeToString(hmacSHA256(auth.signingKey, stringToSign))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", SIGV4_ALGORITHM, key.ID, auth.scope, signedHeaders, auth.signature))
+	return auth
+}
+
+// awsChunked encodes chunks (and the final empty chunk) as an aws-chunked
+// body, each signed with the previous chunk's signature.
+func awsChunked(auth *sigV4, chunks ...string) string {
+	var body strings.Builder
+	previous := auth.signature
+	for _, chunk := range append(chunks, "") {
+		stringToSign := strings.Join([]string{SIGV4_ALGORITHM + "-PAYLOAD", auth.date, auth.scope, previous, EMPTY_SHA256, sha256Hex([]byte(chunk))}, "\n")
+		previous = hex.EncodeToString(hmacSHA256(auth.signingKey, stringToSign))
+		fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), previous, chunk)
+	}
+	return body.String()
+}
+
+func TestS3SignedRequests(t *testing.T) {
+	c := newTestServer(t)
+	key, err := c.CreateAccessKey("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey := &AccessKey{ID: key.ID, Secret: "not the secret"}
+	helloMD5 := `"5d41402abc4b2a76b9719d911017c592"`
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		sign   func(r *http.Request) string
+		status int
+		code   string
+	}{
+		{"put", http.MethodPut, "/b/hello", "hello", func(r *http.Request) string {
+			signS3(r, key, sha256Hex([]byte("hello")), time.Now())
+			return "hello"
+		}, http.StatusOK, ""},
+		{"get", http.MethodGet, "/b/hello", "", func(r *http.Request) string {
+			signS3(r, key, EMPTY_SHA256, time.Now())
+			return ""
+		}, http.StatusOK, ""},
+		{"list with query", http.MethodGet, "/b?list-type=2&prefix=hel", "", func(r *http.Request) string {
+			signS3(r, key, EMPTY_SHA256, time.Now())
+			return ""
+		}, http.StatusOK, ""},
+		{"unsigned payload", http.MethodPut, "/b/unsigned", "hello", func(r *http.Request) string {
+			signS3(r, key, UNSIGNED_PAYLOAD, time.Now())
+			return "hello"
+		}, http.StatusOK, ""},
+		{"payload hash mismatch", http.MethodPut, "/b/hello", "tampered", func(r *http.Request) string {
+			signS3(r, key, sha256Hex([]byte("hello")), time.Now())
+			return "tampered"
+		}, http.StatusBadRequest, "XAmzContentSHA256Mismatch"},
+		{"wrong secret", http.MethodGet, "/b/hello", "", func(r *http.Request) string {
+			signS3(r, wrongKey, EMPTY_SHA256, time.Now())
+			return ""
+		}, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"signed for another path", http.MethodGet, "/b/hello", "", func(r *http.Request) string {
+			signS3(r, key, EMPTY_SHA256, time.Now())
+			r.URL.Path = "/b/other"
+			return ""
+		}, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"clock skew", http.MethodGet, "/b/hello", "", func(r *http.Request) string {
+			signS3(r, key, EMPTY_SHA256, time.Now().Add(-SIGV4_MAX_SKEW-time.Minute))
+			return ""
+		}, http.StatusForbidden, "RequestTimeTooSkewed"},
+		{"streaming", http.MethodPut, "/b/streamed", "", func(r *http.Request) string {
+			return awsChunked(signS3(r, key, STREAMING_PAYLOAD, time.Now()), "hel", "lo")
+		}, http.StatusOK, ""},
+		{"streaming chunk signature mismatch", http.MethodPut, "/b/streamed", "", func(r *http.Request) string {
+			body := awsChunked(signS3(r, key, STREAMING_PAYLOAD, time.Now()), "hel", "lo")
+			return strings.Replace(body, "\r\nhel\r\n", "\r\nHEL\r\n", 1)
+		}, http.StatusForbidden, "SignatureDoesNotMatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Body = io.NopCloser(strings.NewReader(tt.sign(r)))
+			w := httptest.NewRecorder()
+			c.S3Handler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), "<Code>"+tt.code+"</Code>") {
+				t.Errorf("error = %s, want %s", w.Body.String(), tt.code)
+			}
+			if tt.status == http.StatusOK && strings.Contains(tt.target, "hello") && w.Header().Get("ETag") != helloMD5 {
+				t.Errorf("ETag = %s, want %s", w.Header().Get("ETag"), helloMD5)
+			}
+		})
+	}
+
+	for _, key := range []string{"b/hello", "b/unsigned", "b/streamed"} {
+		if value, err := c.GetAtomic(key); err != nil || value != "hello" {
+			t.Errorf("%s = %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"list-type=2&prefix=a", "list-type=2&prefix=a"},
+		{"prefix=a&list-type=2", "list-type=2&prefix=a"},
+		{"location", "location="},
+		{"prefix=a%20b%2Fc~d", "prefix=a%20b%2Fc~d"},
+		{"prefix=a+b", "prefix=a%20b"},
+		{"k=2&k=1", "k=1&k=2"},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := canonicalQuery(query); got != tt.want {
+			t.Errorf("canonicalQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeAWSChunked(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		limit int64
+		want  string
+		err   error
+	}{
+		{"chunks", "3\r\nhel\r\n2\r\nlo\r\n0\r\n\r\n", 10, "hello", nil},
+		{"empty", "0\r\n\r\n", 10, "", nil},
+		{"extensions", "5;chunk-signature=abc\r\nhello\r\n0;chunk-signature=def\r\n\r\n", 10, "hello", nil},
+		{"trailers", "5\r\nhello\r\n0\r\nx-amz-checksum-crc32:NhCmhg==\r\n\r\n", 10, "hello", nil},
+		{"trailers at eof", "5\r\nhello\r\n0\r\nx-amz-checksum-crc32:NhCmhg==\r\n", 10, "hello", nil},
+		{"at limit", "5\r\nhello\r\n0\r\n\r\n", 5, "hello", nil},
+		{"over limit", "3\r\nhel\r\n3\r\nlo!\r\n0\r\n\r\n", 5, "", errChunkTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeAWSChunked(bufio.NewReader(strings.NewReader(tt.body)), tt.limit, nil)
+			if err != tt.err || string(got) != tt.want {
+				t.Errorf("decodeAWSChunked = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+
+	for _, body := range []string{"x\r\n", "-1\r\n", "5\r\nhel", "5\r\nhello\r\n"} {
+		if _, err := decodeAWSChunked(bufio.NewReader(strings.NewReader(body)), 10, nil); err == nil {
+			t.Errorf("decodeAWSChunked accepted %q", body)
+		}
+	}
+
+	signatures := []string{}
+	verify := func(chunk []byte, signature string) bool {
+		signatures = append(signatures, signature)
+		return signature != "bad"
+	}
+	body := "5;chunk-signature=good\r\nhello\r\n0;chunk-signature=bad\r\n\r\n"
+	if _, err := decodeAWSChunked(bufio.NewReader(strings.NewReader(body)), 10, verify); err != errChunkSignature {
+		t.Errorf("bad signature returned %v", err)
+	}
+	if strings.Join(signatures, ",") != "good,bad" {
+		t.Errorf("verified signatures %v", signatures)
+	}
+}
+
+func TestS3Readers(t *testing.T) {
+	tests := []struct {
+		acl  string
+		want Group
+		ok   bool
+	}{
+		{"", UnknownGroup, true},
+		{"bucket-owner-full-control", UnknownGroup, true},
+		{"authenticated-read", UserGroup, true},
+		{"public-read", PublicGroup, true},
+		{"private", UnknownGroup, false},
+		{"public-read-write", UnknownGroup, false},
+		{"bucket-owner-read", UnknownGroup, false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.acl != "" {
+			header.Set("X-Amz-Acl", tt.acl)
+		}
+		got, s3err := s3Readers(header)
+		if got != tt.want || (s3err == nil) != tt.ok {
+			t.Errorf("s3Readers(%q) = %v, %v", tt.acl, got, s3err)
+		}
+	}
+}
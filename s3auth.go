@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	ACCESS_KEYS_BUCKET         = "access_keys"
+	SIGV4_ALGORITHM            = "AWS4-HMAC-SHA256"
+	SIGV4_TIME_FORMAT          = "20060102T150405Z"
+	SIGV4_MAX_SKEW             = 15 * time.Minute
+	UNSIGNED_PAYLOAD           = "UNSIGNED-PAYLOAD"
+	STREAMING_PAYLOAD          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	STREAMING_UNSIGNED_PAYLOAD = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	EMPTY_SHA256               = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// AccessKey lets a user sign S3 requests. Unlike passwords, the secret has to
+// be stored (sealed) rather than hashed, since SigV4 signatures are HMACs
+// keyed by it.
+type AccessKey struct {
+	ID        string
+	Secret    string
+	Username  string
+	CreatedAt time.Time
+}
+
+func (c *CubbyServer) getAccessKey(id string, tx *bolt.Tx) *AccessKey {
+	var key AccessKey
+	if !c.getSealedGob(ACCESS_KEYS_BUCKET, []byte(id), &key, tx) {
+		return nil
+	}
+	return &key
+}
+
+// CreateAccessKey generates a new access key for an existing user.
+func (c *CubbyServer) CreateAccessKey(username string) (*AccessKey, error) {
+	if c.lookupUser(username) == nil {
+		return nil, fmt.Errorf("no such user: %s", username)
+	}
+	key := &AccessKey{
+		ID:        "CUBBY" + strings.ToUpper(randomHex(8)),
+		Secret:    randomHex(20),
+		Username:  username,
+		CreatedAt: time.Now(),
+	}
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return c.putSealedGob(ACCESS_KEYS_BUCKET, []byte(key.ID), key, tx)
+	})
+	if err != nil {
+		c.log.Printf("Error adding access key for user: %s", username)
+		return nil, err
+	}
+	c.log.Printf("Successfully added access key %s for user: %s", key.ID, username)
+	return key, nil
+}
+
+// ListAccessKeys returns the access keys (without their secrets) of the named
+// user, or of every user if username is empty.
+func (c *CubbyServer) ListAccessKeys(username string) []AccessKey {
+	keys := []AccessKey{}
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(ACCESS_KEYS_BUCKET)).ForEach(func(k, v []byte) error {
+			if key := c.getAccessKey(string(k), tx); key != nil && (username == "" || key.Username == username) {
+				key.Secret = ""
+				keys = append(keys, *key)
+			}
+			return nil
+		})
+	})
+	return keys
+}
+
+func (c *CubbyServer) RevokeAccessKey(id string) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		if c.getAccessKey(id, tx) == nil {
+			return fmt.Errorf("no such access key: %s", id)
+		}
+		return tx.Bucket([]byte(ACCESS_KEYS_BUCKET)).Delete([]byte(id))
+	})
+	if err == nil {
+		c.log.Printf("Successfully revoked access key: %s", id)
+	}
+	return err
+}
+
+func (c *CubbyServer) revokeUserAccessKeys(username string, tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(ACCESS_KEYS_BUCKET))
+	var revoked [][]byte
+	b.ForEach(func(k, v []byte) error {
+		if key := c.getAccessKey(string(k), tx); key != nil && key.Username == username {
+			revoked = append(revoked, append([]byte{}, k...))
+		}
+		return nil
+	})
+	for _, k := range revoked {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sigV4 is a verified AWS Signature Version 4 Authorization header, kept
+// around to check the payload (and for streaming uploads, each chunk's
+// signature) against.
+type sigV4 struct {
+	date        string
+	scope       string
+	signature   string
+	signingKey  []byte
+	payloadHash string
+}
+
+// awsEscape percent-encodes everything but unreserved characters (and
+// slashes, if path is set) as SigV4 canonical requests require.
+func awsEscape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || path && ch == '/' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsEscape(name, false)+"="+awsEscape(value, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticateS3 verifies a request's SigV4 signature, returning the user
+// whose access key signed it. Unsigned requests are anonymous.
+func (c *CubbyServer) authenticateS3(r *http.Request) (User, *sigV4, *S3Error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return &AnonymousUser{}, nil, nil
+	}
+	if !strings.HasPrefix(authorization, SIGV4_ALGORITHM+" ") {
+		return nil, nil, &S3Error{http.StatusBadRequest, "InvalidArgument", "Only " + SIGV4_ALGORITHM + " signatures are supported"}
+	}
+	malformed := &S3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, SIGV4_ALGORITHM+" "), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, nil, malformed
+		}
+		fields[name] = value
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if len(credential) != 5 || credential[3] != "s3" || credential[4] != "aws4_request" || fields["Signature"] == "" {
+		return nil, nil, malformed
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	requestTime, err := time.Parse(SIGV4_TIME_FORMAT, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, credential[1]) {
+		return nil, nil, &S3Error{http.StatusForbidden, "AccessDenied", "Invalid X-Amz-Date"}
+	}
+	if skew := time.Since(requestTime); skew > SIGV4_MAX_SKEW || skew < -SIGV4_MAX_SKEW {
+		return nil, nil, &S3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return nil, nil, &S3Error{http.StatusBadRequest, "InvalidRequest", "Missing x-amz-content-sha256 header"}
+	}
+
+	var accessKey *AccessKey
+	c.db.View(func(tx *bolt.Tx) error {
+		accessKey = c.getAccessKey(credential[0], tx)
+		return nil
+	})
+	if accessKey == nil {
+		return nil, nil, &S3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist"}
+	}
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsEscape(path, true),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+
+	auth := &sigV4{
+		date:        amzDate,
+		scope:       strings.Join(credential[1:], "/"),
+		signingKey:  []byte("AWS4" + accessKey.Secret),
+		payloadHash: payloadHash,
+	}
+	for _, part := range credential[1:] {
+		auth.signingKey = hmacSHA256(auth.signingKey, part)
+	}
+	stringToSign := strings.Join([]string{SIGV4_ALGORITHM, amzDate, auth.scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	auth.signature = hex.EncodeToString(hmacSHA256(auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(auth.signature), []byte(fields["Signature"])) {
+		return nil, nil, &S3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match"}
+	}
+
+	user := c.lookupUser(accessKey.Username)
+	if user == nil {
+		return nil, nil, &S3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist"}
+	}
+	return user, auth, nil
+}
+
+// readS3Body reads up to limit bytes of a request body, checking it against
+// the signed payload hash and decoding aws-chunked uploads.
+func readS3Body(r *http.Request, auth *sigV4, limit int64) ([]byte, *S3Error) {
+	tooLarge := &S3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size"}
+	var body []byte
+	var err error
+	switch payloadHash := auth.payloadHashOrUnsigned(); payloadHash {
+	case STREAMING_PAYLOAD:
+		body, err = decodeAWSChunked(bufio.NewReader(r.Body), limit, auth.verifyChunk)
+	case STREAMING_UNSIGNED_PAYLOAD:
+		body, err = decodeAWSChunked(bufio.NewReader(r.Body), limit, nil)
+	default:
+		body, err = io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err == nil && int64(len(body)) > limit {
+			return nil, tooLarge
+		}
+		if err == nil && payloadHash != UNSIGNED_PAYLOAD && sha256Hex(body) != payloadHash {
+			return nil, &S3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed"}
+		}
+	}
+	if errors.Is(err, errChunkTooLarge) {
+		return nil, tooLarge
+	} else if errors.Is(err, errChunkSignature) {
+		return nil, &S3Error{http.StatusForbidden, "SignatureDoesNotMatch", "A chunk signature does not match"}
+	} else if err != nil {
+		return nil, &S3Error{http.StatusBadRequest, "IncompleteBody", "Could not read the request body"}
+	}
+	return body, nil
+}
+
+// payloadHashOrUnsigned lets anonymous requests (which have no signature)
+// through without payload checks.
+func (a *sigV4) payloadHashOrUnsigned() string {
+	if a == nil {
+		return UNSIGNED_PAYLOAD
+	}
+	return a.payloadHash
+}
+
+// verifyChunk checks a streaming upload chunk's signature, which chains from
+// the previous chunk's (or the request's) signature.
+func (a *sigV4) verifyChunk(chunk []byte, signature string) bool {
+	stringToSign := strings.Join([]string{SIGV4_ALGORITHM + "-PAYLOAD", a.date, a.scope, a.signature, EMPTY_SHA256, sha256Hex(chunk)}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(a.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return false
+	}
+	a.signature = expected
+	return true
+}
+
+var (
+	errChunkTooLarge  = errors.New("aws-chunked body exceeds the limit")
+	errChunkSignature = errors.New("aws-chunked signature mismatch")
+)
+
+// decodeAWSChunked decodes an aws-chunked body, made up of chunks like
+// "<hex size>;chunk-signature=<sig>\r\n<data>\r\n" ending with an empty chunk
+// and optional trailers. Signatures are checked if verify is given.
+func decodeAWSChunked(reader *bufio.Reader, limit int64, verify func([]byte, string) bool) ([]byte, error) {
+	var body bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeField, extension, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid chunk size %q", sizeField)
+		}
+		if int64(body.Len())+size > limit {
+			return nil, errChunkTooLarge
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		if verify != nil && !verify(chunk, strings.TrimPrefix(extension, "chunk-signature=")) {
+			return nil, errChunkSignature
+		}
+		body.Write(chunk)
+
+		if size == 0 {
+			// skip any trailers (eg. checksums) up to the final empty line
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil && err != io.EOF {
+					return nil, err
+				}
+				if strings.TrimSpace(line) == "" {
+					return body.Bytes(), nil
+				}
+			}
+		}
+		if _, err := reader.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
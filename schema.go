@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	SCHEMAS_BUCKET = "schemas"
+	// SCHEMA_WILDCARD at the end of a binding pattern makes it match a prefix.
+	SCHEMA_WILDCARD = "*"
+)
+
+// SchemaBinding attaches a JSON Schema, stored as another cubby, to a key or,
+// if the pattern ends in a wildcard (eg. configs/*), to every key under a
+// prefix.
+type SchemaBinding struct {
+	Pattern   string    `json:"pattern"`
+	Schema    string    `json:"schema"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (b *SchemaBinding) Matches(key string) bool {
+	if prefix, ok := strings.CutSuffix(b.Pattern, SCHEMA_WILDCARD); ok {
+		return strings.HasPrefix(key, prefix)
+	}
+	return key == b.Pattern
+}
+
+// SchemaError is returned when a value does not validate against the schema
+// bound to its key.
+type SchemaError struct {
+	Key    string   `json:"key"`
+	Schema string   `json:"schema"`
+	Errors []string `json:"errors"`
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("value for %s does not match schema %s: %s", e.Key, e.Schema, strings.Join(e.Errors, "; "))
+}
+
+func (c *CubbyServer) ListSchemaBindings(tx *bolt.Tx) []SchemaBinding {
+	bindings := []SchemaBinding{}
+	tx.Bucket([]byte(SCHEMAS_BUCKET)).ForEach(func(k, v []byte) error {
+		var binding SchemaBinding
+		if c.getSealedGob(SCHEMAS_BUCKET, k, &binding, tx) {
+			bindings = append(bindings, binding)
+		}
+		return nil
+	})
+	return bindings
+}
+
+func (c *CubbyServer) PutSchemaBinding(binding *SchemaBinding, tx *bolt.Tx) error {
+	return c.putSealedGob(SCHEMAS_BUCKET, []byte(binding.Pattern), binding, tx)
+}
+
+// SchemaFor returns the binding that applies to a key, if any. An exact key
+// binding wins over prefix bindings, and the longest prefix wins otherwise.
+// Bindings are stored by pattern, so this looks up the key and then each of
+// its prefixes rather than scanning every binding.
+func (c *CubbyServer) SchemaFor(key string, tx *bolt.Tx) *SchemaBinding {
+	patterns := []string{key}
+	for i := len(key); i >= 0; i-- {
+		patterns = append(patterns, key[:i]+SCHEMA_WILDCARD)
+	}
+	for _, pattern := range patterns {
+		var binding SchemaBinding
+		if c.getSealedGob(SCHEMAS_BUCKET, []byte(pattern), &binding, tx) {
+			return &binding
+		}
+	}
+	return nil
+}
+
+// ValidateSchema checks a value against the schema bound to its key, returning
+// a *SchemaError if it doesn't validate. Keys without a schema always pass.
+func (c *CubbyServer) ValidateSchema(key string, value []byte, tx *bolt.Tx) error {
+	binding := c.SchemaFor(key, tx)
+	if binding == nil {
+		return nil
+	}
+	fail := func(errs ...string) error {
+		return &SchemaError{Key: key, Schema: binding.Schema, Errors: errs}
+	}
+
+	schema, err := c.Get(binding.Schema, tx)
+	if err != nil {
+		return err
+	}
+	if schema == nil {
+		return fail(fmt.Sprintf("schema %s does not exist", binding.Schema))
+	}
+	validator, err := NewSchemaValidator(schema)
+	if err != nil {
+		return fail(err.Error())
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return fail(fmt.Sprintf("$: value is not valid JSON: %v", err))
+	}
+	if errs := validator.Validate(doc); len(errs) > 0 {
+		return fail(errs...)
+	}
+	return nil
+}
+
+// SchemasHandler lets admins manage schema bindings:
+//
+//	GET    /_schemas            list bindings
+//	POST   /_schemas            bind a schema, eg. {"pattern": "configs/*", "schema": "schemas/config"}
+//	DELETE /_schemas/<pattern>  remove a binding
+func (c *CubbyServer) SchemasHandler(w http.ResponseWriter, r *http.Request, user User) {
+	if !user.InGroup(AdminGroup) {
+		log.Println("Unauthorized schema management attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized Admin", http.StatusUnauthorized)
+		return
+	}
+
+	pattern := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/_schemas"), "/")
+
+	switch {
+	case pattern == "" && r.Method == http.MethodGet:
+		var bindings []SchemaBinding
+		c.db.View(func(tx *bolt.Tx) error {
+			bindings = c.ListSchemaBindings(tx)
+			return nil
+		})
+		writeJSON(w, http.StatusOK, bindings)
+
+	case pattern == "" && r.Method == http.MethodPost:
+		var binding SchemaBinding
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&binding); err != nil {
+			http.Error(w, "Invalid schema binding", http.StatusBadRequest)
+			return
+		}
+		if binding.Pattern == "" || binding.Schema == "" {
+			http.Error(w, "Schema binding requires a pattern and a schema", http.StatusBadRequest)
+			return
+		}
+		binding.CreatedBy = user.Name()
+		binding.CreatedAt = time.Now()
+
+		var invalid error
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			schema, err := c.Get(binding.Schema, tx)
+			if err != nil {
+				return err
+			}
+			if schema == nil {
+				invalid = fmt.Errorf("schema %s does not exist", binding.Schema)
+				return nil
+			}
+			if _, invalid = NewSchemaValidator(schema); invalid != nil {
+				return nil
+			}
+			return c.PutSchemaBinding(&binding, tx)
+		})
+		if invalid != nil {
+			http.Error(w, invalid.Error(), http.StatusUnprocessableEntity)
+		} else if err != nil {
+			log.Printf("Error persisting schema binding: %v", err)
+			http.Error(w, "Could not persist schema binding", http.StatusInternalServerError)
+		} else {
+			log.Printf("Bound schema %s to %q", binding.Schema, binding.Pattern)
+			writeJSON(w, http.StatusCreated, binding)
+		}
+
+	case pattern != "" && r.Method == http.MethodDelete:
+		found := false
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(SCHEMAS_BUCKET))
+			found = b.Get([]byte(pattern)) != nil
+			return b.Delete([]byte(pattern))
+		})
+		if err != nil {
+			http.Error(w, "Could not remove schema binding", http.StatusInternalServerError)
+		} else if !found {
+			http.NotFound(w, r)
+		} else {
+			log.Printf("Removed schema binding %q", pattern)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		http.Error(w, "Invalid schema action", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeSchemaError responds with 422 and the list of validation errors, if
+// err is a *SchemaError. It returns false for any other error.
+func writeSchemaError(w http.ResponseWriter, err error) bool {
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) {
+		return false
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, schemaErr)
+	return true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestSchemaFor(t *testing.T) {
+	c := newTestServer(t)
+	c.db.Update(func(tx *bolt.Tx) error {
+		for _, pattern := range []string{"a/b", "a/*", "a/b*", "a/b/c/*", "*"} {
+			if err := c.PutSchemaBinding(&SchemaBinding{Pattern: pattern, Schema: "schema for " + pattern}, tx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	})
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"a/b", "a/b"},
+		{"a/bc", "a/b*"},
+		{"a/b/c", "a/b*"},
+		{"a/b/c/d", "a/b/c/*"},
+		{"a/c", "a/*"},
+		{"a/", "a/*"},
+		{"a", "*"},
+		{"z/a/b", "*"},
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		for _, tt := range tests {
+			if binding := c.SchemaFor(tt.key, tx); binding == nil || binding.Pattern != tt.want {
+				t.Errorf("SchemaFor(%q) = %+v, want %s", tt.key, binding, tt.want)
+			}
+		}
+		return nil
+	})
+
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(SCHEMAS_BUCKET)).Delete([]byte("*"))
+	})
+	c.db.View(func(tx *bolt.Tx) error {
+		if binding := c.SchemaFor("z", tx); binding != nil {
+			t.Errorf("SchemaFor(z) = %+v without a catch-all binding", binding)
+		}
+		return nil
+	})
+}
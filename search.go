@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	SEARCH_DOCS_BUCKET   = "search_docs"
+	SEARCH_TERMS_BUCKET  = "search_terms"
+	SEARCH_STATS_BUCKET  = "search_stats"
+	SEARCH_STATS_KEY     = "stats"
+	SEARCH_INDEX_VERSION = 2
+	DEFAULT_SEARCH_LIMIT = 20
+	MAX_SEARCH_LIMIT     = 100
+	SNIPPET_LENGTH       = 160
+	MIN_TERM_LENGTH      = 2
+	MAX_TERM_LENGTH      = 64
+
+	// BM25 ranking parameters
+	BM25_K1 = 1.2
+	BM25_B  = 0.75
+)
+
+// SearchStats describes the search index as a whole. When encryption at rest
+// is enabled, terms are stored as HMACs (keyed with HashKey) rather than in
+// the clear, and the index is rebuilt if that setting changes.
+type SearchStats struct {
+	Version     int
+	Hashed      bool
+	HashKey     []byte
+	Docs        int
+	TotalLength int
+}
+
+// SearchDoc records the indexed terms of a key, so that its postings can be
+// removed when it changes.
+type SearchDoc struct {
+	Terms  map[string]int
+	Length int
+}
+
+// SearchPosting records how often a term occurs in a key. Postings are stored
+// one per (term, key), so that writing a key only touches its own postings.
+type SearchPosting struct {
+	Key       string
+	Frequency int
+}
+
+// SearchResult is a single search hit.
+type SearchResult struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"contentType"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	Score       float64   `json:"score"`
+	Snippet     string    `json:"snippet"`
+}
+
+// isSearchable returns true for content types that hold text worth indexing.
+func isSearchable(contentType string) bool {
+	mt := mediaType(contentType)
+	switch {
+	case strings.HasPrefix(mt, "text/"):
+		return true
+	case strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	switch mt {
+	case "application/json", "application/javascript", "application/xml", "application/x-yaml",
+		"application/toml", "application/x-ndjson", "application/jsonl", "application/sql":
+		return true
+	}
+	return false
+}
+
+// tokenize splits text into lowercase terms of letters and digits.
+func tokenize(text string) []string {
+	terms := []string{}
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if length := utf8.RuneCountInString(field); length >= MIN_TERM_LENGTH && length <= MAX_TERM_LENGTH {
+			terms = append(terms, strings.ToLower(field))
+		}
+	}
+	return terms
+}
+
+func (s *SearchStats) termKey(term string) []byte {
+	if !s.Hashed {
+		return []byte(term)
+	}
+	mac := hmac.New(sha256.New, s.HashKey)
+	mac.Write([]byte(term))
+	return mac.Sum(nil)
+}
+
+// postingKey returns where the posting of a term in key is stored: after the
+// term key and a separator (terms never contain zero bytes, and hashed terms
+// are of fixed length), followed by the key. For hashed indexes, the key is
+// replaced by an HMAC of both, so that postings don't reveal which keys share
+// terms.
+func (s *SearchStats) postingKey(termKey []byte, key string) []byte {
+	postingKey := append(append([]byte{}, termKey...), 0)
+	if !s.Hashed {
+		return append(postingKey, key...)
+	}
+	mac := hmac.New(sha256.New, s.HashKey)
+	mac.Write(postingKey)
+	mac.Write([]byte(key))
+	return mac.Sum(postingKey)
+}
+
+// getSealedGob decodes a sealed gob value from a bucket, returning false if it
+// doesn't exist or can't be read.
+func (c *CubbyServer) getSealedGob(bucket string, key []byte, v any, tx *bolt.Tx) bool {
+	stored := tx.Bucket([]byte(bucket)).Get(key)
+	if stored == nil {
+		return false
+	}
+	value, err := c.unseal(stored)
+	if err != nil {
+		c.log.Printf("Error decrypting %s entry: %v", bucket, err)
+		return false
+	}
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(v); err != nil {
+		c.log.Printf("Error decoding %s entry: %v", bucket, err)
+		return false
+	}
+	return true
+}
+
+func (c *CubbyServer) putSealedGob(bucket string, key []byte, v any, tx *bolt.Tx) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	sealed, err := c.seal(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(bucket)).Put(key, sealed)
+}
+
+func (c *CubbyServer) searchStats(tx *bolt.Tx) *SearchStats {
+	var stats SearchStats
+	if !c.getSealedGob(SEARCH_STATS_BUCKET, []byte(SEARCH_STATS_KEY), &stats, tx) {
+		return nil
+	}
+	return &stats
+}
+
+// postings returns the frequency of a term in each key containing it.
+func (c *CubbyServer) postings(termKey []byte, tx *bolt.Tx) map[string]int {
+	postings := map[string]int{}
+	prefix := append(append([]byte{}, termKey...), 0)
+	cursor := tx.Bucket([]byte(SEARCH_TERMS_BUCKET)).Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		var posting SearchPosting
+		if c.getSealedGob(SEARCH_TERMS_BUCKET, k, &posting, tx) {
+			postings[posting.Key] = posting.Frequency
+		}
+	}
+	return postings
+}
+
+// IndexDocument (re)indexes the value stored at key, only writing the postings
+// that changed (eg. the new terms of an append). Values that aren't text are
+// only removed from the index.
+func (c *CubbyServer) IndexDocument(key string, value []byte, metadata *CubbyMetadata, tx *bolt.Tx) error {
+	stats := c.searchStats(tx)
+	if stats == nil || !isSearchable(metadata.ContentType) || !utf8.Valid(value) {
+		return c.UnindexDocument(key, tx)
+	}
+
+	var indexed SearchDoc
+	reindex := c.getSealedGob(SEARCH_DOCS_BUCKET, []byte(key), &indexed, tx)
+
+	terms := append(tokenize(key), tokenize(string(value))...)
+	doc := SearchDoc{Terms: map[string]int{}, Length: len(terms)}
+	for _, term := range terms {
+		doc.Terms[string(stats.termKey(term))]++
+	}
+	b := tx.Bucket([]byte(SEARCH_TERMS_BUCKET))
+	for termKey, frequency := range doc.Terms {
+		if indexed.Terms[termKey] == frequency {
+			continue
+		}
+		posting := &SearchPosting{Key: key, Frequency: frequency}
+		if err := c.putSealedGob(SEARCH_TERMS_BUCKET, stats.postingKey([]byte(termKey), key), posting, tx); err != nil {
+			return err
+		}
+	}
+	for termKey := range indexed.Terms {
+		if _, ok := doc.Terms[termKey]; !ok {
+			if err := b.Delete(stats.postingKey([]byte(termKey), key)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.putSealedGob(SEARCH_DOCS_BUCKET, []byte(key), &doc, tx); err != nil {
+		return err
+	}
+
+	if !reindex {
+		stats.Docs++
+	}
+	stats.TotalLength += doc.Length - indexed.Length
+	return c.putSealedGob(SEARCH_STATS_BUCKET, []byte(SEARCH_STATS_KEY), stats, tx)
+}
+
+// UnindexDocument removes a key from the search index.
+func (c *CubbyServer) UnindexDocument(key string, tx *bolt.Tx) error {
+	var doc SearchDoc
+	if !c.getSealedGob(SEARCH_DOCS_BUCKET, []byte(key), &doc, tx) {
+		return nil
+	}
+	stats := c.searchStats(tx)
+	if stats == nil {
+		return tx.Bucket([]byte(SEARCH_DOCS_BUCKET)).Delete([]byte(key))
+	}
+
+	b := tx.Bucket([]byte(SEARCH_TERMS_BUCKET))
+	for termKey := range doc.Terms {
+		if err := b.Delete(stats.postingKey([]byte(termKey), key)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket([]byte(SEARCH_DOCS_BUCKET)).Delete([]byte(key)); err != nil {
+		return err
+	}
+
+	stats.Docs--
+	stats.TotalLength -= doc.Length
+	return c.putSealedGob(SEARCH_STATS_BUCKET, []byte(SEARCH_STATS_KEY), stats, tx)
+}
+
+// EnsureSearchIndex builds the search index from scratch if it doesn't exist
+// yet, was built by an older version, or was built with a different
+// encryption setting.
+func (c *CubbyServer) EnsureSearchIndex() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		stats := c.searchStats(tx)
+		hashed := c.masterKey != nil
+		if stats != nil && stats.Version == SEARCH_INDEX_VERSION && stats.Hashed == hashed {
+			return nil
+		}
+
+		for _, bucket := range []string{SEARCH_DOCS_BUCKET, SEARCH_TERMS_BUCKET, SEARCH_STATS_BUCKET} {
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+
+		stats = &SearchStats{Version: SEARCH_INDEX_VERSION, Hashed: hashed}
+		if hashed {
+			stats.HashKey = make([]byte, 32)
+			if _, err := rand.Read(stats.HashKey); err != nil {
+				return err
+			}
+		}
+		if err := c.putSealedGob(SEARCH_STATS_BUCKET, []byte(SEARCH_STATS_KEY), stats, tx); err != nil {
+			return err
+		}
+
+		keys := c.List(tx)
+		for _, key := range keys {
+			metadata, err := c.GetMetadata(key, tx)
+			if err != nil {
+				continue
+			}
+			value, err := c.Get(key, tx)
+			if err != nil {
+				continue
+			}
+			if err := c.IndexDocument(key, value, metadata, tx); err != nil {
+				return err
+			}
+		}
+		c.log.Printf("Built search index over %d keys", len(keys))
+		return nil
+	})
+}
+
+// Search ranks the keys matching the query with BM25, returning at most limit
+// results that the user is allowed to read.
+func (c *CubbyServer) Search(query, prefix string, limit int, user User, tx *bolt.Tx) []SearchResult {
+	results := []SearchResult{}
+	stats := c.searchStats(tx)
+	if stats == nil || stats.Docs == 0 {
+		return results
+	}
+
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, term := range tokenize(query) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	avgLength := math.Max(float64(stats.TotalLength)/float64(stats.Docs), 1)
+	lengths := map[string]int{}
+	scores := map[string]float64{}
+	for _, term := range terms {
+		postings := c.postings(stats.termKey(term), tx)
+		if len(postings) == 0 {
+			continue
+		}
+		df := float64(len(postings))
+		idf := math.Log(1 + (float64(stats.Docs)-df+0.5)/(df+0.5))
+		for key, frequency := range postings {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			length, ok := lengths[key]
+			if !ok {
+				var doc SearchDoc
+				c.getSealedGob(SEARCH_DOCS_BUCKET, []byte(key), &doc, tx)
+				length = doc.Length
+				lengths[key] = length
+			}
+			tf := float64(frequency)
+			scores[key] += idf * tf * (BM25_K1 + 1) / (tf + BM25_K1*(1-BM25_B+BM25_B*float64(length)/avgLength))
+		}
+	}
+
+	keys := make([]string, 0, len(scores))
+	for key := range scores {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, key := range keys {
+		metadata, err := c.GetMetadata(key, tx)
+		// auth check: reader allowlist
+		if err != nil || metadata.Empty() || !user.InGroup(metadata.Readers) {
+			continue
+		}
+		value, err := c.Get(key, tx)
+		if err != nil {
+			continue
+		}
+		results = append(results, SearchResult{
+			Key:         key,
+			ContentType: metadata.ContentType,
+			UpdatedAt:   metadata.UpdatedAt,
+			Score:       math.Round(scores[key]*1000) / 1000,
+			Snippet:     snippet(string(value), terms),
+		})
+		if len(results) == limit {
+			break
+		}
+	}
+	return results
+}
+
+// snippet returns an excerpt of text around the first occurrence of any of
+// the terms, with whitespace collapsed.
+func snippet(text string, terms []string) string {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	match := -1
+	for _, term := range terms {
+		if i := indexRunes(lower, []rune(term)); i >= 0 && (match < 0 || i < match) {
+			match = i
+		}
+	}
+
+	start := 0
+	if match > SNIPPET_LENGTH/3 {
+		start = match - SNIPPET_LENGTH/3
+	}
+	end := min(start+SNIPPET_LENGTH, len(runes))
+
+	excerpt := strings.Join(strings.Fields(string(runes[start:end])), " ")
+	if start > 0 {
+		excerpt = "…" + excerpt
+	}
+	if end < len(runes) {
+		excerpt += "…"
+	}
+	return excerpt
+}
+
+func indexRunes(haystack, needle []rune) int {
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		match := true
+		for j := range needle {
+			if haystack[i+j] != needle[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+// SearchHandler serves GET /_search?q=...&prefix=...&limit=...
+func (c *CubbyServer) SearchHandler(w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid search action", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if len(tokenize(query)) == 0 {
+		http.Error(w, "Search query required", http.StatusBadRequest)
+		return
+	}
+	limit := DEFAULT_SEARCH_LIMIT
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 || limit > MAX_SEARCH_LIMIT {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var results []SearchResult
+	c.db.View(func(tx *bolt.Tx) error {
+		results = c.Search(query, r.URL.Query().Get("prefix"), limit, user, tx)
+		return nil
+	})
+	log.Printf("Search for %q returned %d results", query, len(results))
+	writeJSON(w, http.StatusOK, results)
+}
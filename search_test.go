@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", []string{}},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"a b cd", []string{"cd"}},
+		{"logs/2024-01-02.txt", []string{"logs", "2024", "01", "02", "txt"}},
+		{"Größe über", []string{"größe", "über"}},
+	}
+	for _, tt := range tests {
+		got := tokenize(tt.text)
+		if len(got) != len(tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	for _, masterKey := range [][]byte{nil, bytes.Repeat([]byte{1}, MASTER_KEY_SIZE)} {
+		c := newTestServer(t)
+		c.SetMasterKey(masterKey)
+		if err := c.EnsureSearchIndex(); err != nil {
+			t.Fatal(err)
+		}
+		user := c.FetchUser("u", "p")
+		search := func(query string) []string {
+			keys := []string{}
+			c.db.View(func(tx *bolt.Tx) error {
+				for _, result := range c.Search(query, "", 10, user, tx) {
+					keys = append(keys, result.Key)
+				}
+				return nil
+			})
+			return keys
+		}
+		postings := func() int {
+			count := 0
+			c.db.View(func(tx *bolt.Tx) error {
+				count = tx.Bucket([]byte(SEARCH_TERMS_BUCKET)).Stats().KeyN
+				return nil
+			})
+			return count
+		}
+		rawPosting := func(term, key string) []byte {
+			var stored []byte
+			c.db.View(func(tx *bolt.Tx) error {
+				stats := c.searchStats(tx)
+				stored = append(stored, tx.Bucket([]byte(SEARCH_TERMS_BUCKET)).Get(stats.postingKey(stats.termKey(term), key))...)
+				return nil
+			})
+			return stored
+		}
+
+		write := func(method, target, contentType, body string) {
+			serveWithHeaders(c, method, target, http.Header{"Content-Type": {contentType}}, []byte(body))
+		}
+
+		write(http.MethodPut, "/notes/a", "text/plain", "apple banana apple")
+		write(http.MethodPut, "/notes/b", "text/plain", "banana cherry")
+		write(http.MethodPut, "/notes/c", "image/png", "apple")
+		if got := search("apple"); len(got) != 1 || got[0] != "notes/a" {
+			t.Errorf("search for apple (key %t) = %v", masterKey != nil, got)
+		}
+		if got := search("banana apple"); len(got) != 2 || got[0] != "notes/a" {
+			t.Errorf("search for banana apple (key %t) = %v", masterKey != nil, got)
+		}
+		// a: notes, apple, banana; b: notes, banana, cherry
+		if got := postings(); got != 6 {
+			t.Errorf("%d postings, want 6", got)
+		}
+
+		before := rawPosting("banana", "notes/b")
+		write(http.MethodPost, "/notes/b?append&newline", "", "durian")
+		if after := rawPosting("banana", "notes/b"); after == nil || !bytes.Equal(before, after) {
+			t.Errorf("append rewrote an unchanged posting (key %t)", masterKey != nil)
+		}
+		if got := search("durian"); len(got) != 1 || got[0] != "notes/b" {
+			t.Errorf("search after append (key %t) = %v", masterKey != nil, got)
+		}
+		write(http.MethodPut, "/notes/a", "text/plain", "elderberry")
+		if got := search("apple"); len(got) != 0 {
+			t.Errorf("search for replaced term (key %t) = %v", masterKey != nil, got)
+		}
+		serve(c, http.MethodDelete, "/notes/b", nil)
+		if got := search("banana"); len(got) != 0 {
+			t.Errorf("search for deleted key (key %t) = %v", masterKey != nil, got)
+		}
+		// a: notes, elderberry
+		if got := postings(); got != 2 {
+			t.Errorf("%d postings, want 2", got)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	htmltemplate "html/template"
 	"log"
+	"net/http"
+	"sync"
 	"text/template"
 	"time"
 
@@ -23,9 +25,17 @@ type CubbyServer struct {
 	usersBucket    string
 	db             *bolt.DB
 	maxObjectSize  int64
+	masterKey      []byte
+	events         *EventBroker
+	webhookQueue   chan webhookJob
+	webhookClient  *http.Client
+	webhookBackoff time.Duration
+	trashRetention time.Duration
 	log            *log.Logger
 	indexTemplate  *template.Template
 	viewerTemplate *htmltemplate.Template
+	sitesMu        sync.Mutex
+	sites          []Site
 }
 
 func NewCubbyServer(dbFilename string, maxObjectSizeMB int) (*CubbyServer, error) {
@@ -35,6 +45,11 @@ func NewCubbyServer(dbFilename string, maxObjectSizeMB int) (*CubbyServer, error
 		metaBucket:     DB_BUCKET + "_metadata",
 		usersBucket:    USERS_BUCKET,
 		maxObjectSize:  int64(maxObjectSizeMB * 1024 * 1024),
+		events:         NewEventBroker(),
+		webhookQueue:   make(chan webhookJob, WEBHOOK_QUEUE_SIZE),
+		webhookClient:  &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		webhookBackoff: WEBHOOK_INITIAL_BACKOFF,
+		trashRetention: DEFAULT_TRASH_RETENTION,
 		log:            log.Default(),
 		indexTemplate:  IndexTemplate(),
 		viewerTemplate: ViewerTemplate(),
@@ -74,6 +89,79 @@ func (c *CubbyServer) initialize() error {
 			return fmt.Errorf("DB create users bucket: %s", err)
 		}
 
+		_, err = tx.CreateBucketIfNotExists([]byte(EVENTS_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create events bucket: %s", err)
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(WEBHOOKS_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create webhooks bucket: %s", err)
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(WEBHOOK_DELIVERIES_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create webhook deliveries bucket: %s", err)
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(WEBHOOK_RETRIES_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create webhook retries bucket: %s", err)
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(LOCKS_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create locks bucket: %s", err)
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(SCHEMAS_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create schemas bucket: %s", err)
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(TRASH_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create trash bucket: %s", err)
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(DAV_DIRS_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create dav dirs bucket: %s", err)
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(SITES_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create sites bucket: %s", err)
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(ACCESS_KEYS_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create access keys bucket: %s", err)
+		}
+
+		for _, bucket := range []string{UPLOADS_BUCKET, UPLOAD_CHUNKS_BUCKET} {
+			_, err = tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return fmt.Errorf("DB create uploads bucket %s: %s", bucket, err)
+			}
+		}
+
+		for _, bucket := range []string{SEARCH_DOCS_BUCKET, SEARCH_TERMS_BUCKET, SEARCH_STATS_BUCKET} {
+			_, err = tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return fmt.Errorf("DB create search bucket %s: %s", bucket, err)
+			}
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(SETTINGS_BUCKET))
+		if err != nil {
+			return fmt.Errorf("DB create settings bucket: %s", err)
+		}
+
+		if err := c.migrateStorageFormat(tx); err != nil {
+			return fmt.Errorf("DB migrate storage format: %s", err)
+		}
+
 		return nil
 	})
 }
@@ -87,42 +175,62 @@ func (c *CubbyServer) Version() string {
 	return BuiltGitCommit
 }
 
-func (c *CubbyServer) GetMetadata(key string, tx *bolt.Tx) *CubbyMetadata {
+// GetMetadata returns the metadata for key, which is empty if the key doesn't
+// exist. An error means that the metadata exists but can't be read (eg. it
+// was encrypted with a different master key), in which case callers must not
+// treat the key as empty.
+func (c *CubbyServer) GetMetadata(key string, tx *bolt.Tx) (*CubbyMetadata, error) {
+	var metadata CubbyMetadata
 	b := tx.Bucket([]byte(c.metaBucket))
-	v := b.Get([]byte(key))
+	stored := b.Get([]byte(key))
+	if stored == nil {
+		return &metadata, nil
+	}
 
+	v, err := c.unseal(stored)
+	if err != nil {
+		c.log.Printf("Error decrypting metadata for key: %v. %v", key, err)
+		return nil, fmt.Errorf("decrypt metadata for %s: %w", key, err)
+	}
 	decoder := gob.NewDecoder(bytes.NewBuffer(v))
-	var metadata CubbyMetadata
-	err := decoder.Decode(&metadata)
+	err = decoder.Decode(&metadata)
 	if err != nil {
 		c.log.Printf("Error decoding metadata for key: %v. %v", key, err)
+		return nil, fmt.Errorf("decode metadata for %s: %w", key, err)
 	}
-
-	// In either case, return the metadata struct. Either it will be empty, or
-	// it will contain the requested metadata
-	return &metadata
+	return &metadata, nil
 }
 
-func (c *CubbyServer) GetAtomic(key string) string {
+func (c *CubbyServer) GetAtomic(key string) (string, error) {
 	var value []byte
-	c.db.View(func(tx *bolt.Tx) error {
-		value = c.Get(key, tx)
-		return nil
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		value, err = c.Get(key, tx)
+		return err
 	})
+	if err != nil {
+		return "", err
+	}
 
 	c.log.Printf("Successfully got key: %s", key)
-	return string(value)
+	return string(value), nil
 }
 
-func (c *CubbyServer) Get(key string, tx *bolt.Tx) []byte {
+// Get returns the value stored at key, or nil if there is none. Like
+// GetMetadata, an error means that the value exists but can't be read.
+func (c *CubbyServer) Get(key string, tx *bolt.Tx) ([]byte, error) {
 	b := tx.Bucket([]byte(c.dataBucket))
-	v := b.Get([]byte(key))
+	v, err := c.unseal(b.Get([]byte(key)))
+	if err != nil {
+		c.log.Printf("Error decrypting key: %v. %v", key, err)
+		return nil, fmt.Errorf("decrypt %s: %w", key, err)
+	}
 
 	// v is only valid for the duration of the transaction, so copy the value
 	// to a new byte array for use later on
 	var value []byte
 	value = append(value, v...)
-	return value
+	return value, nil
 }
 
 func (c *CubbyServer) PutMetadata(key string, metadata *CubbyMetadata, tx *bolt.Tx) error {
@@ -136,7 +244,13 @@ func (c *CubbyServer) PutMetadata(key string, metadata *CubbyMetadata, tx *bolt.
 		return err
 	}
 
-	err = b.Put([]byte(key), buf.Bytes())
+	sealed, err := c.seal(buf.Bytes())
+	if err != nil {
+		c.log.Printf("Error encrypting metadata for key: %s", key)
+		return err
+	}
+
+	err = b.Put([]byte(key), sealed)
 	if err != nil {
 		c.log.Printf("Error putting metadata for key: %s", key)
 	} else {
@@ -160,8 +274,58 @@ func (c *CubbyServer) PutAtomic(key, value string) error {
 
 func (c *CubbyServer) Put(key string, value []byte, tx *bolt.Tx) error {
 	b := tx.Bucket([]byte(c.dataBucket))
-	err := b.Put([]byte(key), value)
-	return err
+	sealed, err := c.seal(value)
+	if err != nil {
+		c.log.Printf("Error encrypting key: %s", key)
+		return err
+	}
+	return b.Put([]byte(key), sealed)
+}
+
+// CommitPut stores a value along with its metadata and records the change in
+// the event log. The value must validate against any schema bound to the key.
+// The returned event should be published once the transaction has been
+// committed.
+func (c *CubbyServer) CommitPut(key string, value []byte, metadata *CubbyMetadata, tx *bolt.Tx) (*ChangeEvent, error) {
+	if err := c.ValidateSchema(key, value, tx); err != nil {
+		return nil, err
+	}
+	if err := c.Put(key, value, tx); err != nil {
+		return nil, err
+	}
+	metadata.Size = len(value)
+	metadata.ETag = ETag(value)
+	if err := c.PutMetadata(key, metadata, tx); err != nil {
+		return nil, err
+	}
+	if err := c.IndexDocument(key, value, metadata, tx); err != nil {
+		return nil, err
+	}
+
+	event := NewPutEvent(key, metadata)
+	return event, c.recordEvent(event, tx)
+}
+
+// CommitDelete removes a value and its metadata and records the change in the
+// event log. The returned event should be published once the transaction has
+// been committed.
+func (c *CubbyServer) CommitDelete(key string, metadata *CubbyMetadata, tx *bolt.Tx) (*ChangeEvent, error) {
+	if err := c.Remove(key, tx); err != nil {
+		return nil, err
+	}
+	if err := c.RemoveMetadata(key, tx); err != nil {
+		return nil, err
+	}
+	if err := c.UnindexDocument(key, tx); err != nil {
+		return nil, err
+	}
+
+	if metadata.Empty() {
+		// nothing was actually deleted
+		return nil, nil
+	}
+	event := NewDeleteEvent(key, metadata)
+	return event, c.recordEvent(event, tx)
 }
 
 func (c *CubbyServer) RemoveMetadata(key string, tx *bolt.Tx) error {
@@ -216,3 +380,14 @@ func (c *CubbyServer) List(tx *bolt.Tx) []string {
 
 	return keys
 }
+
+// ListPrefix returns the keys starting with prefix, in order.
+func (c *CubbyServer) ListPrefix(prefix string, tx *bolt.Tx) []string {
+	cursor := tx.Bucket([]byte(c.dataBucket)).Cursor()
+
+	keys := []string{}
+	for k, _ := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = cursor.Next() {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
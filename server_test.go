@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestServer opens a cubby server on a fresh database, with a regular user
+// u:p and an admin a:p.
+func newTestServer(t *testing.T) *CubbyServer {
+	t.Helper()
+	c, err := NewCubbyServer(filepath.Join(t.TempDir(), "cubby.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if err := c.AddUser("u", "p", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddUser("a", "p", true); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// serve runs a request through the server's handler, as user u.
+func serve(c *CubbyServer, method, target string, body []byte) *httptest.ResponseRecorder {
+	return serveAs(c, "u", method, target, body)
+}
+
+// serveAs runs a request through the server's handler, as the given user.
+func serveAs(c *CubbyServer, username, method, target string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.SetBasicAuth(username, "p")
+	w := httptest.NewRecorder()
+	c.Handler(w, r)
+	return w
+}
+
+// serveWithHeaders runs a request with the given headers through the
+// server's handler, as user u.
+func serveWithHeaders(c *CubbyServer, method, target string, header http.Header, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.SetBasicAuth("u", "p")
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	c.Handler(w, r)
+	return w
+}
+
+func TestUnreadableValuesAreNotOverwritten(t *testing.T) {
+	c := newTestServer(t)
+	oldKey := bytes.Repeat([]byte{1}, MASTER_KEY_SIZE)
+	c.SetMasterKey(oldKey)
+	if w := serve(c, http.MethodPut, "/counter", []byte("5")); w.Code != http.StatusCreated {
+		t.Fatalf("PUT returned %d", w.Code)
+	}
+
+	c.SetMasterKey(bytes.Repeat([]byte{2}, MASTER_KEY_SIZE))
+	c.db.View(func(tx *bolt.Tx) error {
+		if _, err := c.Get("counter", tx); err == nil {
+			t.Error("Get with the wrong master key succeeded")
+		}
+		if _, err := c.GetMetadata("counter", tx); err == nil {
+			t.Error("GetMetadata with the wrong master key succeeded")
+		}
+		if metadata, err := c.GetMetadata("missing", tx); err != nil || !metadata.Empty() {
+			t.Errorf("GetMetadata of a missing key = %v, %v", metadata, err)
+		}
+		return nil
+	})
+
+	for _, req := range []struct{ method, target string }{
+		{http.MethodGet, "/counter"},
+		{http.MethodHead, "/counter"},
+		{http.MethodPost, "/counter?incr=1"},
+		{http.MethodPost, "/counter?append"},
+		{http.MethodDelete, "/counter"},
+	} {
+		if w := serve(c, req.method, req.target, []byte("1")); w.Code != http.StatusInternalServerError {
+			t.Errorf("%s %s returned %d, want 500", req.method, req.target, w.Code)
+		}
+	}
+
+	c.SetMasterKey(oldKey)
+	if w := serve(c, http.MethodGet, "/counter", nil); w.Body.String() != "5" {
+		t.Errorf("value after failed writes = %q, want 5", w.Body.String())
+	}
+}
+
+func TestGetAtomicReportsUnreadableValues(t *testing.T) {
+	c := newTestServer(t)
+	c.SetMasterKey(bytes.Repeat([]byte{1}, MASTER_KEY_SIZE))
+	if err := c.PutAtomic("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetMasterKey(nil)
+	if _, err := c.GetAtomic("k"); !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("GetAtomic without a master key returned %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	SITES_BUCKET               = "sites"
+	SITE_DEFAULT_INDEX         = "index.html"
+	SITE_DEFAULT_CACHE_CONTROL = "public, max-age=300"
+	// SITE_HTML_CACHE_CONTROL makes browsers revalidate pages (cheaply, by
+	// ETag) so that a deploy shows up immediately.
+	SITE_HTML_CACHE_CONTROL    = "no-cache"
+	SITE_PRIVATE_CACHE_CONTROL = "private, no-cache"
+)
+
+// Site serves the keys under Prefix as a static website, at /<Prefix> and, if
+// Host is set, at the root of that virtual host. Index and NotFound are keys
+// relative to the prefix.
+type Site struct {
+	Prefix       string    `json:"prefix"`
+	Host         string    `json:"host,omitempty"`
+	Index        string    `json:"index,omitempty"`
+	NotFound     string    `json:"notFound,omitempty"`
+	SPA          bool      `json:"spa,omitempty"`
+	CacheControl string    `json:"cacheControl,omitempty"`
+	CreatedBy    string    `json:"createdBy"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func (s *Site) index() string {
+	if s.Index == "" {
+		return SITE_DEFAULT_INDEX
+	}
+	return s.Index
+}
+
+// siteHost normalizes a Host header (or configured host) for comparison.
+func siteHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (c *CubbyServer) ListSites(tx *bolt.Tx) []Site {
+	sites := []Site{}
+	tx.Bucket([]byte(SITES_BUCKET)).ForEach(func(k, v []byte) error {
+		var site Site
+		if c.getSealedGob(SITES_BUCKET, k, &site, tx) {
+			sites = append(sites, site)
+		}
+		return nil
+	})
+	return sites
+}
+
+func (c *CubbyServer) PutSite(site *Site, tx *bolt.Tx) error {
+	return c.putSealedGob(SITES_BUCKET, []byte(site.Prefix), site, tx)
+}
+
+// cachedSites returns the site table, which is consulted on every request,
+// loading it from the database if it isn't cached.
+func (c *CubbyServer) cachedSites() []Site {
+	c.sitesMu.Lock()
+	defer c.sitesMu.Unlock()
+	if c.sites == nil {
+		c.db.View(func(tx *bolt.Tx) error {
+			c.sites = c.ListSites(tx)
+			return nil
+		})
+	}
+	return c.sites
+}
+
+// invalidateSites drops the cached site table. Changes to sites must call it
+// once committed, so that it isn't reloaded from a stale transaction.
+func (c *CubbyServer) invalidateSites() {
+	c.sitesMu.Lock()
+	defer c.sitesMu.Unlock()
+	c.sites = nil
+}
+
+// SiteForHost returns the site served at the root of a virtual host, if any.
+func (c *CubbyServer) SiteForHost(host string) *Site {
+	host = siteHost(host)
+	for _, site := range c.cachedSites() {
+		if site.Host != "" && site.Host == host {
+			return &site
+		}
+	}
+	return nil
+}
+
+// SiteForKey returns the site whose prefix the key falls under (or is, minus
+// the trailing slash), preferring the longest prefix.
+func (c *CubbyServer) SiteForKey(key string) *Site {
+	var best *Site
+	for _, site := range c.cachedSites() {
+		if !strings.HasPrefix(key, site.Prefix) && key+"/" != site.Prefix {
+			continue
+		}
+		if best == nil || len(site.Prefix) > len(best.Prefix) {
+			best = &site
+		}
+	}
+	return best
+}
+
+// SiteHandler serves a GET or HEAD of a path (relative to the site's prefix):
+// directories serve their index, and missing paths fall back to the index
+// for single page apps, or to the site's 404 page.
+func (c *CubbyServer) SiteHandler(w http.ResponseWriter, r *http.Request, site *Site, sitePath string, user User) {
+	key := site.Prefix + sitePath
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if sitePath == "" || strings.HasSuffix(sitePath, "/") {
+			key += site.index()
+		}
+		status := http.StatusOK
+		metadata, err := c.GetMetadata(key, tx)
+		if err != nil {
+			return err
+		}
+
+		if metadata.Empty() && sitePath != "" && !strings.HasSuffix(sitePath, "/") {
+			index, err := c.GetMetadata(key+"/"+site.index(), tx)
+			if err != nil {
+				return err
+			}
+			if !index.Empty() {
+				// directories need their trailing slash for relative links to work
+				http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+				return nil
+			}
+		}
+		if metadata.Empty() && site.SPA && path.Ext(sitePath) == "" {
+			// client side routes, as opposed to missing assets
+			key = site.Prefix + site.index()
+			metadata, err = c.GetMetadata(key, tx)
+		} else if metadata.Empty() && site.NotFound != "" {
+			key = site.Prefix + site.NotFound
+			metadata, err = c.GetMetadata(key, tx)
+			status = http.StatusNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if metadata.Empty() {
+			http.NotFound(w, r)
+			return nil
+		}
+
+		// auth check: reader allowlist
+		if !user.InGroup(metadata.Readers) {
+			log.Println("Unauthorized site read attempt")
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			http.Error(w, "Unauthorized Reader", http.StatusUnauthorized)
+			return nil
+		}
+
+		data, err := c.Get(key, tx)
+		if err != nil {
+			return err
+		}
+		contentType := siteContentType(key, metadata.ContentType, data)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", ETag(data))
+		switch {
+		case metadata.Readers != PublicGroup:
+			w.Header().Set("Cache-Control", SITE_PRIVATE_CACHE_CONTROL)
+		case strings.HasPrefix(contentType, "text/html"):
+			w.Header().Set("Cache-Control", SITE_HTML_CACHE_CONTROL)
+		case site.CacheControl != "":
+			w.Header().Set("Cache-Control", site.CacheControl)
+		default:
+			w.Header().Set("Cache-Control", SITE_DEFAULT_CACHE_CONTROL)
+		}
+
+		if status == http.StatusOK {
+			http.ServeContent(w, r, key, metadata.UpdatedAt, bytes.NewReader(data))
+			return nil
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			w.Write(data)
+		}
+		return nil
+	})
+	if err != nil {
+		writeReadError(w, key, err)
+	}
+}
+
+// siteContentType prefers the stored content type, unless it's missing or
+// generic, in which case it's guessed from the key's extension (or sniffed).
+func siteContentType(key, contentType string, data []byte) string {
+	if contentType != "" && !strings.HasPrefix(contentType, "application/octet-stream") {
+		return contentType
+	}
+	if guessed := mime.TypeByExtension(path.Ext(key)); guessed != "" {
+		return guessed
+	}
+	return http.DetectContentType(data)
+}
+
+// SitesHandler lets admins manage sites:
+//
+//	GET    /_sites           list sites
+//	POST   /_sites           create or replace a site, eg. {"prefix": "site/", "host": "www.example.com", "notFound": "404.html", "spa": false}
+//	DELETE /_sites/<prefix>  remove a site (its keys are left alone)
+func (c *CubbyServer) SitesHandler(w http.ResponseWriter, r *http.Request, user User) {
+	if !user.InGroup(AdminGroup) {
+		log.Println("Unauthorized site management attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized Admin", http.StatusUnauthorized)
+		return
+	}
+
+	prefix := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/_sites"), "/")
+
+	switch {
+	case prefix == "" && r.Method == http.MethodGet:
+		var sites []Site
+		c.db.View(func(tx *bolt.Tx) error {
+			sites = c.ListSites(tx)
+			return nil
+		})
+		writeJSON(w, http.StatusOK, sites)
+
+	case prefix == "" && r.Method == http.MethodPost:
+		var site Site
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&site); err != nil {
+			http.Error(w, "Invalid site", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasSuffix(site.Prefix, "/") || strings.HasPrefix(site.Prefix, "/") || strings.HasPrefix(site.Prefix, "_") {
+			http.Error(w, "Site prefix must end in a slash, eg. site/", http.StatusBadRequest)
+			return
+		}
+		site.Host = siteHost(site.Host)
+		site.CreatedBy = user.Name()
+		site.CreatedAt = time.Now()
+
+		conflict := false
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			for _, existing := range c.ListSites(tx) {
+				if site.Host != "" && existing.Host == site.Host && existing.Prefix != site.Prefix {
+					conflict = true
+					return nil
+				}
+			}
+			return c.PutSite(&site, tx)
+		})
+		c.invalidateSites()
+		if conflict {
+			http.Error(w, "Another site is already served at "+site.Host, http.StatusConflict)
+		} else if err != nil {
+			log.Printf("Error persisting site: %v", err)
+			http.Error(w, "Could not persist site", http.StatusInternalServerError)
+		} else {
+			log.Printf("Serving site %q (host %q)", site.Prefix, site.Host)
+			writeJSON(w, http.StatusCreated, site)
+		}
+
+	case prefix != "" && r.Method == http.MethodDelete:
+		found := false
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(SITES_BUCKET))
+			found = b.Get([]byte(prefix)) != nil
+			return b.Delete([]byte(prefix))
+		})
+		c.invalidateSites()
+		if err != nil {
+			http.Error(w, "Could not remove site", http.StatusInternalServerError)
+		} else if !found {
+			http.NotFound(w, r)
+		} else {
+			log.Printf("Removed site %q", prefix)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		http.Error(w, "Invalid site action", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestVirtualHostSite(t *testing.T) {
+	c := newTestServer(t)
+	c.SetMasterKey(bytes.Repeat([]byte{1}, MASTER_KEY_SIZE))
+	page := "<h1>hello</h1>"
+	serve(c, http.MethodPut, "/site/index.html?readers=public", []byte(page))
+
+	definition := `{"prefix": "site/", "host": "www.example.com"}`
+	if w := serveAs(c, "a", http.MethodPost, "/_sites", []byte(definition)); w.Code != http.StatusCreated {
+		t.Fatalf("creating site returned %d: %s", w.Code, w.Body.String())
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		if stored := tx.Bucket([]byte(SITES_BUCKET)).Get([]byte("site/")); !isEnvelope(stored) {
+			t.Error("site is not encrypted at rest")
+		}
+		return nil
+	})
+
+	if w := serve(c, http.MethodGet, "http://www.example.com/", nil); w.Body.String() != page {
+		t.Errorf("virtual host served %d %q", w.Code, w.Body.String())
+	}
+	if w := serve(c, http.MethodGet, "http://www.example.com:8383/site/", nil); w.Code != http.StatusNotFound {
+		t.Errorf("virtual host path outside the site returned %d", w.Code)
+	}
+	w := serve(c, http.MethodGet, "http://www.example.com/_keys", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "site/index.html") {
+		t.Errorf("reserved route on virtual host returned %d %q", w.Code, w.Body.String())
+	}
+
+	if w := serveAs(c, "a", http.MethodDelete, "/_sites/site/", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("removing site returned %d", w.Code)
+	}
+	if w := serve(c, http.MethodGet, "http://www.example.com/index.html", nil); w.Body.String() == page {
+		t.Error("removed site is still served")
+	}
+}
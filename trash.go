@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	TRASH_BUCKET            = "trash"
+	DEFAULT_TRASH_RETENTION = 30 * 24 * time.Hour
+	TRASH_PURGE_INTERVAL    = time.Hour
+)
+
+// TrashEntry is a deleted value along with its metadata, kept around so that
+// it can be restored until the trash retention period has passed. Only the
+// most recent deletion of each key is kept.
+type TrashEntry struct {
+	Key       string
+	Value     []byte
+	Metadata  CubbyMetadata
+	DeletedAt time.Time
+	DeletedBy string
+}
+
+// TrashListing describes a trash entry without its value.
+type TrashListing struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"contentType"`
+	Size        int       `json:"size"`
+	DeletedAt   time.Time `json:"deletedAt"`
+	DeletedBy   string    `json:"deletedBy"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+func (c *CubbyServer) getTrashEntry(key string, tx *bolt.Tx) *TrashEntry {
+	v := tx.Bucket([]byte(TRASH_BUCKET)).Get([]byte(key))
+	if v == nil {
+		return nil
+	}
+	return c.decodeTrashEntry(key, v)
+}
+
+func (c *CubbyServer) decodeTrashEntry(key string, v []byte) *TrashEntry {
+	value, err := c.unseal(v)
+	if err != nil {
+		c.log.Printf("Error decrypting trash entry %s: %v", key, err)
+		return nil
+	}
+	var entry TrashEntry
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&entry); err != nil {
+		c.log.Printf("Error decoding trash entry %s: %v", key, err)
+		return nil
+	}
+	return &entry
+}
+
+func (c *CubbyServer) putTrashEntry(entry *TrashEntry, tx *bolt.Tx) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		c.log.Printf("Error encoding trash entry: %s", entry.Key)
+		return err
+	}
+	sealed, err := c.seal(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(TRASH_BUCKET)).Put([]byte(entry.Key), sealed)
+}
+
+// CommitTrash moves a value into the trash and then deletes it like
+// CommitDelete. If the trash is disabled (ie. a zero retention), the value is
+// deleted outright.
+func (c *CubbyServer) CommitTrash(key string, metadata *CubbyMetadata, deletedBy string, tx *bolt.Tx) (*ChangeEvent, error) {
+	if err := c.keepInTrash(key, metadata, deletedBy, tx); err != nil {
+		return nil, err
+	}
+	return c.CommitDelete(key, metadata, tx)
+}
+
+// keepInTrash copies the current value of key into the trash, eg. before it's
+// deleted or overwritten, unless the trash is disabled.
+func (c *CubbyServer) keepInTrash(key string, metadata *CubbyMetadata, deletedBy string, tx *bolt.Tx) error {
+	if c.trashRetention <= 0 || metadata.Empty() {
+		return nil
+	}
+	value, err := c.Get(key, tx)
+	if err != nil {
+		return err
+	}
+	return c.putTrashEntry(&TrashEntry{
+		Key:       key,
+		Value:     value,
+		Metadata:  *metadata,
+		DeletedAt: time.Now(),
+		DeletedBy: deletedBy,
+	}, tx)
+}
+
+// ListTrash returns the trash entries that the user is allowed to read.
+func (c *CubbyServer) ListTrash(user User, tx *bolt.Tx) []TrashListing {
+	listings := []TrashListing{}
+	tx.Bucket([]byte(TRASH_BUCKET)).ForEach(func(k, v []byte) error {
+		entry := c.decodeTrashEntry(string(k), v)
+		if entry == nil || !user.InGroup(entry.Metadata.Readers) {
+			return nil
+		}
+		listings = append(listings, TrashListing{
+			Key:         entry.Key,
+			ContentType: entry.Metadata.ContentType,
+			Size:        len(entry.Value),
+			DeletedAt:   entry.DeletedAt,
+			DeletedBy:   entry.DeletedBy,
+			ExpiresAt:   entry.DeletedAt.Add(c.trashRetention),
+		})
+		return nil
+	})
+	return listings
+}
+
+// PurgeTrash permanently removes trash entries deleted before cutoff.
+func (c *CubbyServer) PurgeTrash(cutoff time.Time) (int, error) {
+	purged := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(TRASH_BUCKET))
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if entry := c.decodeTrashEntry(string(k), v); entry != nil && entry.DeletedAt.Before(cutoff) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+	return purged, err
+}
+
+// StartTrash sets how long deleted values are kept for, and periodically
+// purges older ones. A zero retention disables the trash.
+func (c *CubbyServer) StartTrash(retention time.Duration) {
+	c.trashRetention = retention
+	if retention <= 0 {
+		c.log.Println("Trash disabled, deletes are permanent")
+		return
+	}
+
+	go func() {
+		for {
+			purged, err := c.PurgeTrash(time.Now().Add(-c.trashRetention))
+			if err != nil {
+				c.log.Printf("Error purging trash: %v", err)
+			} else if purged > 0 {
+				c.log.Printf("Purged %d expired trash entries", purged)
+			}
+			time.Sleep(TRASH_PURGE_INTERVAL)
+		}
+	}()
+	c.log.Printf("Keeping deleted values in the trash for %s", retention)
+}
+
+// TrashHandler exposes the trash:
+//
+//	GET    /_trash                 list deleted keys
+//	POST   /_trash/<key>?restore   restore a deleted key
+//	DELETE /_trash/<key>           permanently delete a trash entry
+func (c *CubbyServer) TrashHandler(w http.ResponseWriter, r *http.Request, user User) {
+	// auth check: disallow public trash access
+	if _, ok := user.(*AnonymousUser); ok {
+		log.Println("Unauthorized trash access attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/_trash"), "/")
+	_, restore := r.URL.Query()["restore"]
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		var listings []TrashListing
+		c.db.View(func(tx *bolt.Tx) error {
+			listings = c.ListTrash(user, tx)
+			return nil
+		})
+		writeJSON(w, http.StatusOK, listings)
+
+	case key != "" && r.Method == http.MethodPost && restore:
+		var event *ChangeEvent
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			entry := c.getTrashEntry(key, tx)
+			if entry == nil {
+				http.NotFound(w, r)
+				return nil
+			}
+			// auth check: restoring needs the same access as deleting did
+			if !user.InGroup(entry.Metadata.Readers) || !user.InGroup(entry.Metadata.Writers) {
+				log.Println("Unauthorized restore attempt")
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+				http.Error(w, "Unauthorized Writer", http.StatusUnauthorized)
+				return nil
+			}
+			existing, err := c.GetMetadata(key, tx)
+			if err != nil {
+				return err
+			}
+			if !existing.Empty() {
+				http.Error(w, "Key already exists, remove or move it first", http.StatusConflict)
+				return nil
+			}
+
+			metadata := entry.Metadata
+			metadata.MarkUpdated()
+			event, err = c.CommitPut(key, entry.Value, &metadata, tx)
+			if err != nil {
+				return err
+			}
+			return tx.Bucket([]byte(TRASH_BUCKET)).Delete([]byte(key))
+		})
+		if writeSchemaError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Error restoring %s: %v", key, err)
+			http.Error(w, "Could not restore key", http.StatusInternalServerError)
+			return
+		}
+		if event != nil {
+			c.publish(event)
+			log.Printf("Restored %s from the trash", key)
+			w.WriteHeader(http.StatusOK)
+		}
+
+	case key != "" && r.Method == http.MethodDelete:
+		c.db.Update(func(tx *bolt.Tx) error {
+			entry := c.getTrashEntry(key, tx)
+			if entry == nil {
+				http.NotFound(w, r)
+				return nil
+			}
+			// auth check: writer allowlist
+			if !user.InGroup(entry.Metadata.Writers) {
+				log.Println("Unauthorized trash purge attempt")
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+				http.Error(w, "Unauthorized Writer", http.StatusUnauthorized)
+				return nil
+			}
+			if err := tx.Bucket([]byte(TRASH_BUCKET)).Delete([]byte(key)); err != nil {
+				http.Error(w, "Could not purge trash entry", http.StatusInternalServerError)
+				return err
+			}
+			log.Printf("Purged %s from the trash", key)
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		})
+
+	default:
+		http.Error(w, "Invalid trash action", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	MAX_UPLOAD_FILES     = 100
+	MAX_UPLOAD_SIZE      = 64 << 20 // for all files together, unless one object may be larger
+	UPLOAD_FORM_OVERHEAD = 1 << 20  // room for form fields and part headers
+	UPLOAD_MEMORY_BUFFER = 32 << 20 // larger uploads are buffered on disk
+)
+
+// UploadResult describes a file stored by a multipart upload.
+type UploadResult struct {
+	Key         string `json:"key"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	ETag        string `json:"etag"`
+	Created     bool   `json:"created"`
+}
+
+func isMultipartUpload(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "multipart/form-data" && r.Method == http.MethodPost
+}
+
+// uploadRedirect returns where to send a browser after an upload: the local
+// path in the redirect form field, or otherwise the index page.
+func uploadRedirect(r *http.Request) string {
+	redirect := r.FormValue("redirect")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+func readUploadedFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// UploadHandler stores the files of a multipart/form-data POST, so that plain
+// HTML forms and curl -F can upload to cubby. Posting to a prefix (a path
+// ending in a slash, or the root) stores each file under the prefix by its
+// filename, and posting to a key stores a single file at that key. The
+// reader, writer and tags form fields work like the corresponding headers.
+// All files are stored in one transaction, so either all or none of them are,
+// and their total size is limited to MAX_UPLOAD_SIZE.
+func (c *CubbyServer) UploadHandler(w http.ResponseWriter, r *http.Request, key string, user User) {
+	// auth check: disallow public writes
+	if _, ok := user.(*AnonymousUser); ok {
+		log.Println("Unauthorized upload attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized Writer", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, max(MAX_UPLOAD_SIZE, c.maxObjectSize)+UPLOAD_FORM_OVERHEAD)
+	if err := r.ParseMultipartForm(UPLOAD_MEMORY_BUFFER); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Upload exceeds the maximum total size", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Invalid multipart upload: "+err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	var files []UploadResult
+	var headers []*multipart.FileHeader
+	keys := map[string]bool{}
+	// form fields are unordered, but files within a field keep their order
+	fields := make([]string, 0, len(r.MultipartForm.File))
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, header := range r.MultipartForm.File[field] {
+			if header.Size > c.maxObjectSize {
+				http.Error(w, "File exceeds the maximum object size: "+header.Filename, http.StatusRequestEntityTooLarge)
+				return
+			}
+			if header.Filename == "" || header.Filename == "." || header.Filename == ".." {
+				http.Error(w, "Invalid filename", http.StatusBadRequest)
+				return
+			}
+			if keys[header.Filename] {
+				http.Error(w, "Duplicate filename: "+header.Filename, http.StatusBadRequest)
+				return
+			}
+			keys[header.Filename] = true
+
+			contentType := header.Header.Get("Content-Type")
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			files = append(files, UploadResult{Key: key + header.Filename, ContentType: contentType})
+			headers = append(headers, header)
+		}
+	}
+
+	prefix := key == "" || strings.HasSuffix(key, "/")
+	switch {
+	case len(files) == 0:
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return
+	case len(files) > MAX_UPLOAD_FILES:
+		http.Error(w, "Too many files uploaded", http.StatusBadRequest)
+		return
+	case !prefix && len(files) > 1:
+		http.Error(w, "Only one file can be uploaded to a key, post to a prefix ending in / for several", http.StatusBadRequest)
+		return
+	case !prefix:
+		files[0].Key = key
+	}
+
+	errUnauthorized := errors.New("unauthorized")
+	var events []*ChangeEvent
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for i := range files {
+			// read files one at a time, rather than all of them up front
+			value, err := readUploadedFile(headers[i])
+			if err != nil {
+				return err
+			}
+			files[i].Size, files[i].ETag = len(value), ETag(value)
+
+			metadata, err := c.GetMetadata(files[i].Key, tx)
+			if err != nil {
+				return err
+			}
+			files[i].Created = metadata.Empty()
+
+			// auth check: writer allowlist
+			if !metadata.Empty() && !user.InGroup(metadata.Writers) {
+				return errUnauthorized
+			}
+
+			metadata.UpdateReaders(StringToGroup(r.FormValue("reader")))
+			metadata.UpdateWriters(StringToGroup(r.FormValue("writer")))
+			if tags, ok := r.MultipartForm.Value["tags"]; ok {
+				metadata.Tags = ParseTags(strings.Join(tags, ","))
+			}
+			metadata.SetContentType(files[i].ContentType)
+			metadata.MarkUpdated()
+
+			event, err := c.CommitPut(files[i].Key, value, metadata, tx)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if errors.Is(err, errUnauthorized) {
+		log.Println("Unauthorized overwrite attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized Overwrite", http.StatusUnauthorized)
+		return
+	} else if writeSchemaError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Error persisting upload: %v", err)
+		http.Error(w, "Could not persist data", http.StatusInternalServerError)
+		return
+	}
+
+	for _, event := range events {
+		c.publish(event)
+	}
+	log.Printf("Uploaded %d files to %q for %s", len(files), key, user.Name())
+
+	if acceptsHTML(r) {
+		http.Redirect(w, r, uploadRedirect(r), http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, files)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// multipartUpload builds a multipart/form-data POST with one part per file,
+// written as the body is read.
+func multipartUpload(target string, names []string, file func(i int, w io.Writer)) *http.Request {
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		for i, name := range names {
+			part, err := form.CreateFormFile("file", name)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			file(i, part)
+		}
+		pw.CloseWithError(form.Close())
+	}()
+	r := httptest.NewRequest(http.MethodPost, target, pr)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.SetBasicAuth("u", "p")
+	return r
+}
+
+func TestUploadLimits(t *testing.T) {
+	c := newTestServer(t)
+	serve(c, http.MethodPut, "/files/b.txt", []byte("old"))
+
+	tests := []struct {
+		name    string
+		names   []string
+		size    int
+		status  int
+		created []bool
+	}{
+		{"several files", []string{"a.txt", "b.txt"}, 10, http.StatusOK, []bool{true, false}},
+		{"duplicate filenames", []string{"c.txt", "d.txt", "c.txt"}, 10, http.StatusBadRequest, nil},
+		{"file too large", []string{"e.txt"}, int(c.maxObjectSize) + 1, http.StatusRequestEntityTooLarge, nil},
+		{"upload too large", []string{"f.txt"}, MAX_UPLOAD_SIZE + UPLOAD_FORM_OVERHEAD, http.StatusRequestEntityTooLarge, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := multipartUpload("/files/", tt.names, func(i int, w io.Writer) {
+				chunk := bytes.Repeat([]byte{'a' + byte(i)}, 1<<20)
+				for n := tt.size; n > 0; n -= len(chunk) {
+					w.Write(chunk[:min(n, len(chunk))])
+				}
+			})
+			w := httptest.NewRecorder()
+			c.Handler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("upload returned %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var files []UploadResult
+			if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil || len(files) != len(tt.created) {
+				t.Fatalf("upload returned %s", w.Body)
+			}
+			for i, file := range files {
+				if file.Created != tt.created[i] || file.Size != tt.size || file.ETag == "" {
+					t.Errorf("file %d = %+v", i, file)
+				}
+			}
+		})
+	}
+
+	for _, key := range []string{"c.txt", "d.txt", "e.txt", "f.txt"} {
+		if w := serve(c, http.MethodGet, "/files/"+key, nil); w.Code == http.StatusOK {
+			t.Errorf("a rejected upload stored %s", key)
+		}
+	}
+}
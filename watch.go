@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	DEFAULT_WATCH_TIMEOUT = 60 * time.Second
+	MAX_WATCH_TIMEOUT     = 5 * time.Minute
+)
+
+// WatchCondition captures the "since" parameter of a watch request, which is
+// either the ETag of the version the client already has, or a timestamp.
+type WatchCondition struct {
+	ETag  string
+	Since time.Time
+}
+
+// ParseWatchCondition interprets since as a timestamp (RFC 3339, RFC 1123 as
+// used by Last-Modified, or unix seconds), falling back to treating it as an
+// ETag. An empty string means "wait for the next change".
+func ParseWatchCondition(since string) WatchCondition {
+	if since == "" {
+		return WatchCondition{}
+	}
+	for _, layout := range []string{time.RFC3339Nano, time.RFC1123} {
+		if t, err := time.Parse(layout, since); err == nil {
+			return WatchCondition{Since: t}
+		}
+	}
+	if seconds, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return WatchCondition{Since: time.Unix(seconds, 0)}
+	}
+	if !strings.HasPrefix(since, `"`) {
+		since = `"` + since + `"`
+	}
+	return WatchCondition{ETag: since}
+}
+
+// ChangedFrom returns true if the current state of a key no longer matches
+// the watch condition.
+func (wc WatchCondition) ChangedFrom(metadata *CubbyMetadata, data []byte) bool {
+	exists := !metadata.Empty()
+	if wc.ETag != "" {
+		return !exists || ETag(data) != wc.ETag
+	}
+	if !wc.Since.IsZero() {
+		// Last-Modified only has second precision, so compare at that level
+		return exists && metadata.UpdatedAt.Truncate(time.Second).After(wc.Since)
+	}
+	return false
+}
+
+// WatchHandler blocks until the key changes relative to the "since"
+// parameter, or until the timeout elapses. Changed keys are returned as with
+// a regular GET, deleted keys produce a 404, and timeouts a 304.
+func (c *CubbyServer) WatchHandler(w http.ResponseWriter, r *http.Request, key string, user User) {
+	timeout := DEFAULT_WATCH_TIMEOUT
+	if timeoutParam := r.URL.Query().Get("timeout"); timeoutParam != "" {
+		var err error
+		timeout, err = time.ParseDuration(timeoutParam)
+		if err != nil {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+	if timeout > MAX_WATCH_TIMEOUT {
+		timeout = MAX_WATCH_TIMEOUT
+	}
+	condition := ParseWatchCondition(r.URL.Query().Get("since"))
+
+	// subscribe before checking the current state so that no change is missed
+	ch := c.events.Subscribe()
+	defer func() { c.events.Unsubscribe(ch) }()
+
+	// respond returns true once a response has been written
+	respond := func(force bool) bool {
+		var metadata *CubbyMetadata
+		var data []byte
+		err := c.db.View(func(tx *bolt.Tx) error {
+			var err error
+			if metadata, err = c.GetMetadata(key, tx); err != nil {
+				return err
+			}
+			data, err = c.Get(key, tx)
+			return err
+		})
+		if err != nil {
+			writeReadError(w, key, err)
+			return true
+		}
+
+		// keys that don't exist yet can be waited on, but once they do the
+		// reader allowlist applies
+		if !metadata.Empty() && !user.InGroup(metadata.Readers) {
+			log.Println("Unauthorized watch attempt")
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			http.Error(w, "Unauthorized Reader", http.StatusUnauthorized)
+			return true
+		}
+
+		if !force && !condition.ChangedFrom(metadata, data) {
+			return false
+		}
+		if metadata.Empty() {
+			http.NotFound(w, r)
+		} else {
+			writeValue(w, metadata, data)
+		}
+		return true
+	}
+
+	if respond(false) {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case event, ok := <-ch:
+			if !ok {
+				// dropped by the broker for falling behind; check whether the
+				// key changed in the meantime, and otherwise resubscribe
+				if respond(false) {
+					return
+				}
+				ch = c.events.Subscribe()
+				continue
+			}
+			if event.Key == key && respond(true) {
+				return
+			}
+		}
+	}
+}
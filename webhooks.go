@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	WEBHOOKS_BUCKET           = "webhooks"
+	WEBHOOK_DELIVERIES_BUCKET = "webhook_deliveries"
+	WEBHOOK_RETRIES_BUCKET    = "webhook_retries"
+	WEBHOOK_DELIVERY_LOG_SIZE = 1000
+	WEBHOOK_QUEUE_SIZE        = 256
+	WEBHOOK_WORKERS           = 4
+	WEBHOOK_MAX_ATTEMPTS      = 5
+	WEBHOOK_INITIAL_BACKOFF   = 2 * time.Second
+	WEBHOOK_RETRY_INTERVAL    = time.Second
+	WEBHOOK_TIMEOUT           = 10 * time.Second
+	WEBHOOK_SIGNATURE_HEADER  = "X-Cubby-Signature"
+	WEBHOOK_EVENT_HEADER      = "X-Cubby-Event"
+	WEBHOOK_DELIVERY_HEADER   = "X-Cubby-Delivery"
+)
+
+// Webhook is an admin registered subscription to change events for keys
+// under a prefix.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Prefix    string    `json:"prefix"`
+	Events    []string  `json:"events,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Matches returns true if the webhook is subscribed to the given event.
+func (h *Webhook) Matches(event *ChangeEvent) bool {
+	if !strings.HasPrefix(event.Key, h.Prefix) {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, eventType := range h.Events {
+		if eventType == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the value of the signature header for the given payload.
+func (h *Webhook) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDelivery records a single attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+	ID         uint64    `json:"id"`
+	WebhookID  string    `json:"webhookId"`
+	EventID    uint64    `json:"eventId"`
+	EventType  string    `json:"eventType"`
+	Key        string    `json:"key"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Success    bool      `json:"success"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+type webhookJob struct {
+	hook    Webhook
+	event   *ChangeEvent
+	attempt int
+}
+
+// webhookRetry is a failed delivery waiting to be attempted again. Retries are
+// persisted, so that they survive a restart.
+type webhookRetry struct {
+	WebhookID string
+	Event     ChangeEvent
+	Attempt   int
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (c *CubbyServer) ListWebhooks(tx *bolt.Tx) []Webhook {
+	b := tx.Bucket([]byte(WEBHOOKS_BUCKET))
+	hooks := []Webhook{}
+	b.ForEach(func(k, v []byte) error {
+		value, err := c.unseal(v)
+		if err != nil {
+			c.log.Printf("Error decrypting webhook %s: %v", k, err)
+			return nil
+		}
+		var hook Webhook
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&hook); err != nil {
+			c.log.Printf("Error decoding webhook %s: %v", k, err)
+			return nil
+		}
+		hooks = append(hooks, hook)
+		return nil
+	})
+	return hooks
+}
+
+func (c *CubbyServer) PutWebhook(hook *Webhook, tx *bolt.Tx) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(hook); err != nil {
+		c.log.Printf("Error encoding webhook: %s", hook.ID)
+		return err
+	}
+	// webhooks hold their signing secret, so encrypt them at rest
+	sealed, err := c.seal(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(WEBHOOKS_BUCKET)).Put([]byte(hook.ID), sealed)
+}
+
+func (c *CubbyServer) recordDelivery(delivery *WebhookDelivery) {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(WEBHOOK_DELIVERIES_BUCKET))
+		_, err := appendToLog(b, WEBHOOK_DELIVERY_LOG_SIZE, func(id uint64) ([]byte, error) {
+			delivery.ID = id
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(delivery); err != nil {
+				return nil, err
+			}
+			return c.seal(buf.Bytes())
+		})
+		return err
+	})
+	if err != nil {
+		c.log.Printf("Error recording webhook delivery: %v", err)
+	}
+}
+
+// Deliveries returns the logged delivery attempts for a webhook, newest first.
+func (c *CubbyServer) Deliveries(webhookID string, tx *bolt.Tx) []WebhookDelivery {
+	cursor := tx.Bucket([]byte(WEBHOOK_DELIVERIES_BUCKET)).Cursor()
+	deliveries := []WebhookDelivery{}
+	for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+		value, err := c.unseal(v)
+		if err != nil {
+			c.log.Printf("Error decrypting webhook delivery %d: %v", binary.BigEndian.Uint64(k), err)
+			continue
+		}
+		var delivery WebhookDelivery
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&delivery); err != nil {
+			c.log.Printf("Error decoding webhook delivery %d: %v", binary.BigEndian.Uint64(k), err)
+			continue
+		}
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries
+}
+
+// StartWebhooks subscribes to committed change events and delivers them to
+// matching webhooks from a pool of background workers.
+func (c *CubbyServer) StartWebhooks() {
+	for i := 0; i < WEBHOOK_WORKERS; i++ {
+		go func() {
+			for job := range c.webhookQueue {
+				c.deliverWebhook(job)
+			}
+		}()
+	}
+	// subscribe before returning, so no events committed after start are missed
+	go c.dispatchWebhooks(c.events.Subscribe())
+	go c.retryWebhooks()
+	c.log.Println("Started webhook delivery workers")
+}
+
+// retryWebhooks periodically enqueues the persisted retries that are due,
+// including any left over from before a restart.
+func (c *CubbyServer) retryWebhooks() {
+	ticker := time.NewTicker(min(c.webhookBackoff, WEBHOOK_RETRY_INTERVAL))
+	defer ticker.Stop()
+	for range ticker.C {
+		err := c.enqueueRetries()
+		if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+			return
+		} else if err != nil {
+			c.log.Printf("Error enqueueing webhook retries: %v", err)
+		}
+	}
+}
+
+// retryKey orders retries by when they are due, made unique by seq.
+func retryKey(due time.Time, seq uint64) []byte {
+	return append(eventKey(uint64(due.UnixNano())), eventKey(seq)...)
+}
+
+// scheduleRetry persists the job's next attempt, due after backoff.
+func (c *CubbyServer) scheduleRetry(job webhookJob, backoff time.Duration) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket([]byte(WEBHOOK_RETRIES_BUCKET)).NextSequence()
+		if err != nil {
+			return err
+		}
+		retry := &webhookRetry{WebhookID: job.hook.ID, Event: *job.event, Attempt: job.attempt}
+		return c.putSealedGob(WEBHOOK_RETRIES_BUCKET, retryKey(time.Now().Add(backoff), seq), retry, tx)
+	})
+}
+
+// enqueueRetries moves the retries that are due onto the delivery queue
+// without blocking. Retries that don't fit stay persisted until the next
+// round, and retries for removed webhooks are dropped.
+func (c *CubbyServer) enqueueRetries() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		hooks := map[string]Webhook{}
+		for _, hook := range c.ListWebhooks(tx) {
+			hooks[hook.ID] = hook
+		}
+
+		b := tx.Bucket([]byte(WEBHOOK_RETRIES_BUCKET))
+		now := retryKey(time.Now(), 0)
+		var due [][]byte
+		cursor := b.Cursor()
+		for k, _ := cursor.First(); k != nil && bytes.Compare(k, now) < 0; k, _ = cursor.Next() {
+			due = append(due, append([]byte{}, k...))
+		}
+
+		for _, k := range due {
+			var retry webhookRetry
+			if c.getSealedGob(WEBHOOK_RETRIES_BUCKET, k, &retry, tx) {
+				if hook, ok := hooks[retry.WebhookID]; ok {
+					select {
+					case c.webhookQueue <- webhookJob{hook: hook, event: &retry.Event, attempt: retry.Attempt}:
+					default:
+						// the queue is full
+						return nil
+					}
+				}
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *CubbyServer) dispatchWebhooks(ch chan *ChangeEvent) {
+	// lastID is the newest event seen, and caughtUp the newest one enqueued
+	// from the event log after falling behind, which the new subscription may
+	// deliver again
+	var lastID, caughtUp uint64
+	for {
+		event, ok := <-ch
+		if !ok {
+			// dropped by the broker for falling behind, so resubscribe and
+			// catch up on anything missed from the event log
+			ch = c.events.Subscribe()
+			var missed []*ChangeEvent
+			c.db.View(func(tx *bolt.Tx) error {
+				missed = c.EventsSince(lastID, tx)
+				return nil
+			})
+			for _, event := range missed {
+				c.enqueueWebhooks(event)
+				lastID, caughtUp = event.ID, event.ID
+			}
+			continue
+		}
+
+		if event.ID <= caughtUp {
+			continue
+		}
+		if event.ID > lastID {
+			lastID = event.ID
+		}
+		c.enqueueWebhooks(event)
+	}
+}
+
+func (c *CubbyServer) enqueueWebhooks(event *ChangeEvent) {
+	var hooks []Webhook
+	c.db.View(func(tx *bolt.Tx) error {
+		hooks = c.ListWebhooks(tx)
+		return nil
+	})
+
+	for _, hook := range hooks {
+		if hook.Matches(event) {
+			c.webhookQueue <- webhookJob{hook: hook, event: event, attempt: 1}
+		}
+	}
+}
+
+func (c *CubbyServer) deliverWebhook(job webhookJob) {
+	delivery := &WebhookDelivery{
+		WebhookID: job.hook.ID,
+		EventID:   job.event.ID,
+		EventType: job.event.Type,
+		Key:       job.event.Key,
+		Attempt:   job.attempt,
+		Timestamp: time.Now(),
+	}
+
+	retryable, err := c.postWebhook(job, delivery)
+	if err == nil {
+		delivery.Success = true
+		c.recordDelivery(delivery)
+		return
+	}
+
+	delivery.Error = err.Error()
+	c.recordDelivery(delivery)
+	log.Printf("Webhook %s delivery of event %d failed (attempt %d): %v", job.hook.ID, job.event.ID, job.attempt, err)
+
+	if retryable && job.attempt < WEBHOOK_MAX_ATTEMPTS {
+		backoff := c.webhookBackoff << (job.attempt - 1)
+		job.attempt++
+		if err := c.scheduleRetry(job, backoff); err != nil {
+			c.log.Printf("Error scheduling retry of webhook %s delivery of event %d: %v", job.hook.ID, job.event.ID, err)
+		}
+	}
+}
+
+// postWebhook sends the event to the webhook, returning whether a failure is
+// worth retrying.
+func (c *CubbyServer) postWebhook(job webhookJob, delivery *WebhookDelivery) (bool, error) {
+	payload, err := json.Marshal(job.event)
+	if err != nil {
+		return false, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, job.hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "cubby-webhooks")
+	request.Header.Set(WEBHOOK_EVENT_HEADER, job.event.Type)
+	request.Header.Set(WEBHOOK_DELIVERY_HEADER, fmt.Sprintf("%s-%d", job.hook.ID, job.event.ID))
+	request.Header.Set(WEBHOOK_SIGNATURE_HEADER, job.hook.Sign(payload))
+
+	resp, err := c.webhookClient.Do(request)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("receiver responded with status code %d", resp.StatusCode)
+}
+
+func validateWebhook(hook *Webhook) error {
+	parsed, err := url.Parse(hook.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("webhook url must be an absolute http(s) URL")
+	}
+	for _, eventType := range hook.Events {
+		if eventType != PUT_EVENT && eventType != DELETE_EVENT {
+			return fmt.Errorf("unknown event type: %s", eventType)
+		}
+	}
+	return nil
+}
+
+// WebhooksHandler lets admins manage webhooks:
+//
+//	GET    /_webhooks                  list webhooks
+//	POST   /_webhooks                  register a webhook (JSON body)
+//	DELETE /_webhooks/<id>             remove a webhook
+//	GET    /_webhooks/<id>/deliveries  show the delivery log for a webhook
+func (c *CubbyServer) WebhooksHandler(w http.ResponseWriter, r *http.Request, user User) {
+	if !user.InGroup(AdminGroup) {
+		log.Println("Unauthorized webhook management attempt")
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized Admin", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_webhooks"), "/")
+	id, sub, _ := strings.Cut(path, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		var hooks []Webhook
+		c.db.View(func(tx *bolt.Tx) error {
+			hooks = c.ListWebhooks(tx)
+			return nil
+		})
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		writeJSON(w, http.StatusOK, hooks)
+
+	case id == "" && r.Method == http.MethodPost:
+		var hook Webhook
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&hook); err != nil {
+			http.Error(w, "Invalid webhook definition", http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhook(&hook); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hook.ID = randomHex(8)
+		hook.CreatedAt = time.Now()
+		if hook.Secret == "" {
+			hook.Secret = randomHex(32)
+		}
+
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			return c.PutWebhook(&hook, tx)
+		})
+		if err != nil {
+			log.Printf("Error persisting webhook: %v", err)
+			http.Error(w, "Could not persist webhook", http.StatusInternalServerError)
+			return
+		}
+		// the secret is only ever returned when the webhook is created
+		log.Printf("Registered webhook %s for prefix %q", hook.ID, hook.Prefix)
+		writeJSON(w, http.StatusCreated, hook)
+
+	case id != "" && sub == "" && r.Method == http.MethodDelete:
+		found := false
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(WEBHOOKS_BUCKET))
+			found = b.Get([]byte(id)) != nil
+			return b.Delete([]byte(id))
+		})
+		if err != nil {
+			http.Error(w, "Could not remove webhook", http.StatusInternalServerError)
+		} else if !found {
+			http.NotFound(w, r)
+		} else {
+			log.Printf("Removed webhook %s", id)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case id != "" && sub == "deliveries" && r.Method == http.MethodGet:
+		var deliveries []WebhookDelivery
+		c.db.View(func(tx *bolt.Tx) error {
+			deliveries = c.Deliveries(id, tx)
+			return nil
+		})
+		writeJSON(w, http.StatusOK, deliveries)
+
+	default:
+		http.Error(w, "Invalid webhook action", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		hook  Webhook
+		event ChangeEvent
+		want  bool
+	}{
+		{"any event under prefix", Webhook{Prefix: "a/"}, ChangeEvent{Type: DELETE_EVENT, Key: "a/b"}, true},
+		{"empty prefix", Webhook{}, ChangeEvent{Type: PUT_EVENT, Key: "b"}, true},
+		{"outside prefix", Webhook{Prefix: "a/"}, ChangeEvent{Type: PUT_EVENT, Key: "b/a"}, false},
+		{"subscribed event", Webhook{Prefix: "a/", Events: []string{PUT_EVENT}}, ChangeEvent{Type: PUT_EVENT, Key: "a/b"}, true},
+		{"unsubscribed event", Webhook{Prefix: "a/", Events: []string{PUT_EVENT}}, ChangeEvent{Type: DELETE_EVENT, Key: "a/b"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hook.Matches(&tt.event); got != tt.want {
+				t.Errorf("Matches = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+type webhookRequest struct {
+	event     ChangeEvent
+	eventType string
+	signature string
+	payload   []byte
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var mu sync.Mutex
+	failed := map[string]bool{}
+	received := make(chan webhookRequest, 16)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		var event ChangeEvent
+		json.Unmarshal(payload, &event)
+		received <- webhookRequest{event, r.Header.Get(WEBHOOK_EVENT_HEADER), r.Header.Get(WEBHOOK_SIGNATURE_HEADER), payload}
+
+		// fail the first attempt at each key, to be retried
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed[event.Key] {
+			failed[event.Key] = true
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	c := newTestServer(t)
+	c.webhookBackoff = 10 * time.Millisecond
+	c.StartWebhooks()
+
+	definition := `{"url": "` + receiver.URL + `", "prefix": "hooks/", "events": ["put"]}`
+	w := serveAs(c, "a", http.MethodPost, "/_webhooks", []byte(definition))
+	var hook Webhook
+	if err := json.NewDecoder(w.Body).Decode(&hook); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("registering webhook returned %d, %v", w.Code, err)
+	}
+
+	serve(c, http.MethodPut, "/hooks/a", []byte("1"))
+	serve(c, http.MethodPut, "/other/b", []byte("2"))
+	serve(c, http.MethodDelete, "/hooks/a", nil)
+
+	attempts := 0
+	deadline := time.After(5 * time.Second)
+	for attempts < 2 {
+		select {
+		case req := <-received:
+			attempts++
+			if req.event.Key != "hooks/a" || req.event.Type != PUT_EVENT || req.eventType != PUT_EVENT {
+				t.Errorf("delivered unsubscribed %s of %s", req.event.Type, req.event.Key)
+			}
+			if want := hook.Sign(req.payload); req.signature != want {
+				t.Errorf("signature = %q, want %q", req.signature, want)
+			}
+		case <-deadline:
+			t.Fatalf("got %d webhook attempts, want 2", attempts)
+		}
+	}
+
+	var deliveries []WebhookDelivery
+	for len(deliveries) < 2 {
+		w := serveAs(c, "a", http.MethodGet, "/_webhooks/"+hook.ID+"/deliveries", nil)
+		json.NewDecoder(w.Body).Decode(&deliveries)
+		select {
+		case <-deadline:
+			t.Fatalf("delivery log = %+v", deliveries)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if first, retry := deliveries[1], deliveries[0]; first.Success || first.StatusCode != http.StatusInternalServerError || !retry.Success || retry.Attempt != 2 {
+		t.Errorf("delivery log = %+v", deliveries)
+	}
+
+	select {
+	case req := <-received:
+		t.Errorf("unexpected delivery of %s %s", req.event.Type, req.event.Key)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetriesArePersisted(t *testing.T) {
+	c := newTestServer(t)
+	w := serveAs(c, "a", http.MethodPost, "/_webhooks", []byte(`{"url": "http://localhost/hook"}`))
+	var hook Webhook
+	if err := json.NewDecoder(w.Body).Decode(&hook); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("registering webhook returned %d, %v", w.Code, err)
+	}
+	pending := func() int {
+		n := 0
+		c.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket([]byte(WEBHOOK_RETRIES_BUCKET)).Stats().KeyN
+			return nil
+		})
+		return n
+	}
+
+	event := &ChangeEvent{ID: 7, Type: PUT_EVENT, Key: "k"}
+	if err := c.scheduleRetry(webhookJob{hook: hook, event: event, attempt: 2}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.scheduleRetry(webhookJob{hook: Webhook{ID: "removed"}, event: event, attempt: 2}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.scheduleRetry(webhookJob{hook: hook, event: event, attempt: 3}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// a full queue must not block, and leaves due retries persisted
+	for i := 0; i < WEBHOOK_QUEUE_SIZE; i++ {
+		c.webhookQueue <- webhookJob{}
+	}
+	if err := c.enqueueRetries(); err != nil || pending() != 3 {
+		t.Fatalf("enqueueing into a full queue left %d retries, %v", pending(), err)
+	}
+	for i := 0; i < WEBHOOK_QUEUE_SIZE; i++ {
+		<-c.webhookQueue
+	}
+
+	if err := c.enqueueRetries(); err != nil || pending() != 1 {
+		t.Fatalf("enqueueing left %d retries, %v", pending(), err)
+	}
+	select {
+	case job := <-c.webhookQueue:
+		if job.hook.ID != hook.ID || job.event.ID != event.ID || job.attempt != 2 {
+			t.Errorf("enqueued %+v", job)
+		}
+	default:
+		t.Fatal("nothing was enqueued")
+	}
+	select {
+	case job := <-c.webhookQueue:
+		t.Errorf("unexpectedly enqueued %+v", job)
+	default:
+	}
+}